@@ -1,356 +1,1294 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io/fs"
+	"log"
 	"os"
+	"path/filepath"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
-// NewDB creates a new database connection and creates the database file if it doesn't exist
+// dbGenerations is how many previous versions of the database file are kept next to it
+const dbGenerations = 3
+
+// NewDB creates a new database connection and creates the database file if it doesn't exist.
+// An unreadable database file is replaced by the newest previous generation that still loads,
+// then the write-ahead log is replayed on top of it to rebuild the in-memory state.
 func NewDB(path string) (*DB, error){
 	newDB := DB{path: path, mux: &sync.RWMutex{}}
-	newDB.ensureDB()
+
+	report, err := newDB.recoverDB()
+	if err != nil {
+		return nil, err
+	}
+	if report != nil {
+		log.Printf("WARNING: %v", report)
+	}
+
+	err = newDB.ensureDB()
+	if err != nil {
+		return nil, err
+	}
+
+	newDB.data, err = newDB.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	if newDB.data.Version > dbSchemaVersion {
+		return nil, fmt.Errorf("%s has schema version %d but this build only supports up to %d", path, newDB.data.Version, dbSchemaVersion)
+	}
+
+	err = newDB.replayWAL()
+	if err != nil {
+		return nil, err
+	}
+	newDB.data.rebuildIndexes()
 	return &newDB, nil
 }
 
 // CreateChirp creates a new chirp and saves it to disk
-func (db *DB) CreateChirp(body string, authorID int) (Chirp, error){
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+func (db *DB) CreateChirp(body string, authorID int, inReplyTo int) (Chirp, error){
+	newChirp := Chirp{}
 
-	newChirp := Chirp{Body: body}
-	currentDB, err := db.loadDB()
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		newChirp, err = tx.createChirp(body, authorID, inReplyTo)
+		return err
+	})
 	if err != nil {
-		return newChirp, err
+		return Chirp{}, err
+	}
+	return newChirp, nil
+}
+
+// createChirp adds a chirp within a transaction and counts it as a reply on its parent
+func (tx *Tx) createChirp(body string, authorID int, inReplyTo int) (Chirp, error){
+	if inReplyTo != 0 {
+		parent, exist := tx.data.Chirps[inReplyTo]
+		if !exist || !parent.visible() {
+			return Chirp{}, ErrParentChirpNotExist
+		}
+		parent.ReplyCount++
+		err := tx.putChirp(parent)
+		if err != nil {
+			return Chirp{}, err
+		}
 	}
 
-	chirps, err := db.ReadChirps()
+	chirpID, err := tx.nextID("chirps")
 	if err != nil {
-		return newChirp, err
+		return Chirp{}, err
 	}
+	now := time.Now().UTC()
+	chirp := Chirp{ID: chirpID, AuthorID: authorID, Body: body, InReplyTo: inReplyTo, Entities: tx.data.chirpEntities(body), AuthorSuspended: tx.data.Users[authorID].Suspended, CreatedAt: now, UpdatedAt: now}
+	return chirp, tx.putChirp(chirp)
+}
 
-	sort.Slice(chirps, func(i, j int) bool { return chirps[i].ID < chirps[j].ID })
+// HoldChirp queues a chirp that moderation wants reviewed before it is published
+func (db *DB) HoldChirp(body string, authorID int, inReplyTo int, reasons []string) (HeldChirp, error){
+	held := HeldChirp{}
 
-	if len(chirps) == 0 {
-		newChirp.ID = 1
-	} else {
-		newChirp.ID = chirps[len(chirps) - 1].ID + 1
-	}
+	err := db.Update(func(tx *Tx) error {
+		if inReplyTo != 0 {
+			parent, exist := tx.data.Chirps[inReplyTo]
+			if !exist || !parent.visible() {
+				return ErrParentChirpNotExist
+			}
+		}
 
-	newChirp.AuthorID = authorID
+		heldID, err := tx.nextID("held_chirps")
+		if err != nil {
+			return err
+		}
+		held = HeldChirp{ID: heldID, AuthorID: authorID, Body: body, InReplyTo: inReplyTo, Reasons: reasons, CreatedAt: time.Now().UTC()}
+		return txPut(tx, "held_chirps", tx.data.HeldChirps, heldID, held)
+	})
+	return held, err
+}
 
-	chirps = append(chirps, newChirp)
+// ReadHeldChirps returns the chirps waiting for review, oldest first
+func (db *DB) ReadHeldChirps() ([]HeldChirp, error){
+	heldSlice := []HeldChirp{}
 
-	for i, chirp := range chirps {
-		currentDB.Chirps[i + 1] = chirp
-	}
+	err := db.View(func(tx *Tx) error {
+		for _, held := range tx.data.HeldChirps {
+			heldSlice = append(heldSlice, held)
+		}
+		return nil
+	})
+	slices.SortFunc(heldSlice, func(a, b HeldChirp) int { return a.ID - b.ID })
+	return heldSlice, err
+}
+
+// ApproveHeldChirp publishes a held chirp and removes it from the review queue
+func (db *DB) ApproveHeldChirp(heldID int) (Chirp, error){
+	newChirp := Chirp{}
 
-	db.writeDB(currentDB)
+	err := db.Update(func(tx *Tx) error {
+		held, exist := tx.data.HeldChirps[heldID]
+		if !exist {
+			return ErrHeldChirpNotExist
+		}
+		err := txDelete(tx, "held_chirps", tx.data.HeldChirps, heldID)
+		if err != nil {
+			return err
+		}
+		newChirp, err = tx.createChirp(held.Body, held.AuthorID, held.InReplyTo)
+		return err
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
 	return newChirp, nil
+}
 
+// DiscardHeldChirp drops a held chirp without publishing it
+func (db *DB) DiscardHeldChirp(heldID int) error{
+	return db.Update(func(tx *Tx) error {
+		_, exist := tx.data.HeldChirps[heldID]
+		if !exist {
+			return ErrHeldChirpNotExist
+		}
+		return txDelete(tx, "held_chirps", tx.data.HeldChirps, heldID)
+	})
 }
 
 // ReadChirps returns all chirps in the database
 func (db *DB) ReadChirps() ([]Chirp, error){
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+	chirpsSlice := []Chirp{}
 
+	err := db.View(func(tx *Tx) error {
+		for _, chirp := range tx.data.Chirps {
+			if chirp.visible() {
+				chirpsSlice = append(chirpsSlice, chirp)
+			}
+		}
+		return nil
+	})
+	return chirpsSlice, err
+}
+
+// ReadChirpsByAuthorID returns all chirps with the same authorID in the database
+func (db *DB) ReadChirpsByAuthorID(authorID int) ([]Chirp, error){
 	chirpsSlice := []Chirp{}
 
-	currentDB, err := db.loadDB()
-	if err != nil {
-		return chirpsSlice, err
-	}
+	err := db.View(func(tx *Tx) error {
+		for _, chirp := range tx.data.Chirps {
+			if chirp.AuthorID == authorID && chirp.visible() {
+				chirpsSlice = append(chirpsSlice, chirp)
+			}
+		}
+		return nil
+	})
+	return chirpsSlice, err
+}
 
-	for _, chirp := range currentDB.Chirps {
-		chirpsSlice = append(chirpsSlice, chirp)
+// QueryChirps returns one page of the chirps matching query in the order it asks for
+func (db *DB) QueryChirps(query ChirpQuery) (ChirpPage, error){
+	matching := []Chirp{}
+
+	err := db.View(func(tx *Tx) error {
+		chirpIDs, ok := tx.data.queryCandidates(query)
+		if ok {
+			for _, chirpID := range chirpIDs {
+				chirp := tx.data.Chirps[chirpID]
+				if query.matches(chirp) {
+					matching = append(matching, chirp.tombstone())
+				}
+			}
+			return nil
+		}
+		for _, chirp := range tx.data.Chirps {
+			if query.matches(chirp) {
+				matching = append(matching, chirp.tombstone())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return ChirpPage{}, err
 	}
 
-	return chirpsSlice, nil
+	query.sort(matching)
+	return query.page(matching), nil
 }
 
-// ReadChirps returns all chirps with the same authorID in the database
-func (db *DB) ReadChirpsByAuthorID(authorID int) ([]Chirp, error){
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+// ReadSingleChirp returns a chirp in the database using a chirpID
+func (db *DB) ReadSingleChirp(chirpID int) (Chirp, error){
+	var chirp Chirp
+
+	err := db.View(func(tx *Tx) error {
+		var exist bool
+		chirp, exist = tx.data.Chirps[chirpID]
+		if !exist || !chirp.visible() {
+			return ErrChirpNotExist
+		}
+		return nil
+	})
+	return chirp, err
+}
 
+// ReadChirpsByIDs returns the live chirps among chirpIDs in the order given, missing and deleted ones are skipped
+func (db *DB) ReadChirpsByIDs(chirpIDs []int) ([]Chirp, error){
 	chirpsSlice := []Chirp{}
 
-	currentDB, err := db.loadDB()
+	err := db.View(func(tx *Tx) error {
+		for _, chirpID := range chirpIDs {
+			chirp, exist := tx.data.Chirps[chirpID]
+			if exist && chirp.visible() {
+				chirpsSlice = append(chirpsSlice, chirp)
+			}
+		}
+		return nil
+	})
+	return chirpsSlice, err
+}
+
+// ReadChirpLineage returns a chirp followed by the chain of chirps it replies to, up to the root.
+// Deleted and hidden chirps are included as tombstones so that a thread stays connected, but a hidden
+// chirp cannot be asked for itself.
+func (db *DB) ReadChirpLineage(chirpID int) ([]Chirp, error){
+	lineage := []Chirp{}
+
+	err := db.View(func(tx *Tx) error {
+		if chirp, exist := tx.data.Chirps[chirpID]; !exist || chirp.Hidden || chirp.AuthorSuspended {
+			return ErrChirpNotExist
+		}
+		for id := chirpID; id != 0; {
+			chirp, exist := tx.data.Chirps[id]
+			if !exist {
+				break
+			}
+			lineage = append(lineage, chirp.tombstone())
+			id = chirp.InReplyTo
+		}
+		return nil
+	})
+	return lineage, err
+}
+
+// UpdateChirp replaces the body of a chirp and keeps the previous body as a revision
+func (db *DB) UpdateChirp(chirpID int, body string) (Chirp, error){
+	updatedChirp := Chirp{}
+
+	err := db.Update(func(tx *Tx) error {
+		chirp, exist := tx.data.Chirps[chirpID]
+		if !exist || chirp.Deleted {
+			return ErrChirpNotExist
+		}
+
+		now := time.Now().UTC()
+		revisions := tx.data.ChirpRevisions[chirpID]
+		revision := ChirpRevision{Revision: len(revisions) + 1, ChirpID: chirpID, Body: chirp.Body, CreatedAt: chirp.UpdatedAt, ReplacedAt: now}
+		err := tx.putChirpRevisions(chirpID, append(slices.Clip(revisions), revision))
+		if err != nil {
+			return err
+		}
+
+		updatedChirp = chirp
+		updatedChirp.Body = body
+		updatedChirp.Entities = tx.data.chirpEntities(body)
+		updatedChirp.UpdatedAt = now
+		return tx.putChirp(updatedChirp)
+	})
 	if err != nil {
-		return chirpsSlice, err
+		return Chirp{}, err
 	}
+	return updatedChirp, nil
+}
+
+// ReadChirpHistory returns the previous bodies of a chirp, oldest first
+func (db *DB) ReadChirpHistory(chirpID int) ([]ChirpRevision, error){
+	revisions := []ChirpRevision{}
 
-	for _, chirp := range currentDB.Chirps {
-		if chirp.AuthorID == authorID {
-			chirpsSlice = append(chirpsSlice, chirp)
+	err := db.View(func(tx *Tx) error {
+		revisions = append(revisions, tx.data.ChirpRevisions[chirpID]...)
+		return nil
+	})
+	return revisions, err
+}
+
+// DeleteSingleChirp deletes a Chirp and its revisions from the database. A chirp that has replies
+// is kept as an empty tombstone so the thread under it stays reachable, and tombstones left without
+// any replies are removed up the chain.
+func (db *DB) DeleteSingleChirp(chirpID int) error{
+	return db.Update(func(tx *Tx) error {
+		chirp, exist := tx.data.Chirps[chirpID]
+		if !exist || chirp.Deleted {
+			return ErrChirpNotExist
+		}
+		err := tx.deleteChirpRevisions(chirpID)
+		if err != nil {
+			return err
+		}
+		err = tx.deleteChirpEngagements(chirpID)
+		if err != nil {
+			return err
 		}
-	}
 
-	return chirpsSlice, nil
+		if chirp.ReplyCount > 0 {
+			chirp.Body = ""
+			chirp.Entities = ChirpEntities{Hashtags: []Hashtag{}, Mentions: []Mention{}}
+			chirp.Deleted = true
+			chirp.LikeCount = 0
+			chirp.RechirpCount = 0
+			chirp.UpdatedAt = time.Now().UTC()
+			return tx.putChirp(chirp)
+		}
+
+		for {
+			err = tx.deleteChirp(chirp.ID)
+			if err != nil {
+				return err
+			}
+			parent, exist := tx.data.Chirps[chirp.InReplyTo]
+			if !exist {
+				return nil
+			}
+			parent.ReplyCount--
+			if !parent.Deleted || parent.ReplyCount > 0 {
+				return tx.putChirp(parent)
+			}
+			chirp = parent
+		}
+	})
 }
 
-// ReadSingleChirp returns a chirp in the database using a chirpID
-func (db *DB) ReadSingleChirp(chirpID int) (Chirp, error){
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+// LikeChirp records that userID likes chirpID, liking a chirp twice keeps the first like
+func (db *DB) LikeChirp(userID int, chirpID int) (Chirp, error){
+	return db.engage("likes", userID, chirpID)
+}
 
-	var chirp Chirp
+// UnlikeChirp removes the like of userID from chirpID
+func (db *DB) UnlikeChirp(userID int, chirpID int) (Chirp, error){
+	return db.disengage("likes", userID, chirpID, ErrNotLiked)
+}
+
+// RechirpChirp records that userID rechirped chirpID, rechirping a chirp twice keeps the first rechirp
+func (db *DB) RechirpChirp(userID int, chirpID int) (Chirp, error){
+	return db.engage("rechirps", userID, chirpID)
+}
 
-	currentDB, err := db.loadDB()
+// UnrechirpChirp removes the rechirp of chirpID by userID
+func (db *DB) UnrechirpChirp(userID int, chirpID int) (Chirp, error){
+	return db.disengage("rechirps", userID, chirpID, ErrNotRechirped)
+}
+
+// engage adds a like or rechirp and bumps the chirp's matching counter
+func (db *DB) engage(table string, userID int, chirpID int) (Chirp, error){
+	chirp := Chirp{}
+
+	err := db.Update(func(tx *Tx) error {
+		var exist bool
+		chirp, exist = tx.data.Chirps[chirpID]
+		if !exist || !chirp.visible() {
+			return ErrChirpNotExist
+		}
+		if _, exist = tx.data.engagements(table)[engagementKey(chirpID, userID)]; exist {
+			return nil
+		}
+
+		err := tx.putEngagement(table, Engagement{UserID: userID, ChirpID: chirpID, CreatedAt: time.Now().UTC()})
+		if err != nil {
+			return err
+		}
+		chirp.addEngagement(table, 1)
+		return tx.putChirp(chirp)
+	})
 	if err != nil {
-		return chirp, err
-	}
-	
-	chirp, exist := currentDB.Chirps[chirpID]
-	if !exist {
-		return chirp, errors.New("Chirp does not exist")
+		return Chirp{}, err
 	}
-
 	return chirp, nil
 }
 
-// DeleteSingleChirp deletes a Chirp from the database
-func (db *DB) DeleteSingleChirp(chirpID int) error{
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+// disengage removes a like or rechirp and lowers the chirp's matching counter, notEngaged is returned when there is none
+func (db *DB) disengage(table string, userID int, chirpID int, notEngaged error) (Chirp, error){
+	chirp := Chirp{}
 
-	currentDB, err := db.loadDB()
+	err := db.Update(func(tx *Tx) error {
+		engagement, exist := tx.data.engagements(table)[engagementKey(chirpID, userID)]
+		if !exist {
+			return notEngaged
+		}
+		err := tx.deleteEngagement(table, engagement)
+		if err != nil {
+			return err
+		}
+		chirp = tx.data.Chirps[chirpID]
+		chirp.addEngagement(table, -1)
+		return tx.putChirp(chirp)
+	})
 	if err != nil {
-		return err
+		return Chirp{}, err
 	}
-	
-	_, exist := currentDB.Chirps[chirpID]
-	if !exist {
-		return errors.New("chirp does not exist")
+	return chirp, nil
+}
+
+// addEngagement changes the like or rechirp counter of a chirp by delta
+func (chirp *Chirp) addEngagement(table string, delta int) {
+	if table == "rechirps" {
+		chirp.RechirpCount += delta
+	} else {
+		chirp.LikeCount += delta
 	}
+}
 
-	delete(currentDB.Chirps, chirpID)
+// visible reports whether a chirp can be read, it is neither deleted, hidden by a moderator nor by a suspended author
+func (chirp Chirp) visible() bool {
+	return !chirp.Deleted && !chirp.Hidden && !chirp.AuthorSuspended
+}
 
-	db.writeDB(currentDB)
-	return nil
+// tombstone blanks a chirp that is only shown to keep a thread connected. A hidden chirp keeps its
+// body in the store so that moderators can review it, here it reads exactly like a deleted one.
+func (chirp Chirp) tombstone() Chirp {
+	if chirp.visible() {
+		return chirp
+	}
+	chirp.Body = ""
+	chirp.Entities = ChirpEntities{Hashtags: []Hashtag{}, Mentions: []Mention{}}
+	chirp.Deleted = true
+	chirp.Hidden = false
+	chirp.AuthorSuspended = false
+	chirp.LikeCount = 0
+	chirp.RechirpCount = 0
+	return chirp
 }
 
-// CreateUsers creates a new User and saves it to disk
-func (db *DB) CreateUsers(email string, hashedPassword []byte) (User, error){
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+// ReadChirpLikes returns a page of the likes of a chirp, newest first
+func (db *DB) ReadChirpLikes(chirpID int, cursor *Cursor, limit int) (EngagementPage, error){
+	return db.readEngagementPage("likes", chirpID, cursor, limit)
+}
+
+// ReadChirpRechirps returns a page of the rechirps of a chirp, newest first
+func (db *DB) ReadChirpRechirps(chirpID int, cursor *Cursor, limit int) (EngagementPage, error){
+	return db.readEngagementPage("rechirps", chirpID, cursor, limit)
+}
+
+// readEngagementPage lists the likes or rechirps of a chirp ordered by time then user ID
+func (db *DB) readEngagementPage(table string, chirpID int, cursor *Cursor, limit int) (EngagementPage, error){
+	engagementPage := EngagementPage{Engagements: []Engagement{}}
+
+	err := db.View(func(tx *Tx) error {
+		chirp, exist := tx.data.Chirps[chirpID]
+		if !exist || !chirp.visible() {
+			return ErrChirpNotExist
+		}
+
+		engagements := []Engagement{}
+		for userID := range tx.data.engagedBy(table)[chirpID] {
+			engagements = append(engagements, tx.data.engagements(table)[engagementKey(chirpID, userID)])
+		}
+		engagementPage.Engagements, engagementPage.HasNext = pageNewestFirst(engagements, func(engagement Engagement) time.Time { return engagement.CreatedAt }, func(engagement Engagement) int { return engagement.UserID }, cursor, limit)
+		return nil
+	})
+	return engagementPage, err
+}
 
+// ReadLikedChirpIDs reports which of chirpIDs userID has liked
+func (db *DB) ReadLikedChirpIDs(userID int, chirpIDs []int) (map[int]bool, error){
+	return db.readEngagedChirpIDs("likes", userID, chirpIDs)
+}
+
+// ReadRechirpedChirpIDs reports which of chirpIDs userID has rechirped
+func (db *DB) ReadRechirpedChirpIDs(userID int, chirpIDs []int) (map[int]bool, error){
+	return db.readEngagedChirpIDs("rechirps", userID, chirpIDs)
+}
+
+// readEngagedChirpIDs looks up a whole page of chirps in one read of the likes or rechirps table
+func (db *DB) readEngagedChirpIDs(table string, userID int, chirpIDs []int) (map[int]bool, error){
+	engaged := map[int]bool{}
+
+	err := db.View(func(tx *Tx) error {
+		for _, chirpID := range chirpIDs {
+			if _, exist := tx.data.engagements(table)[engagementKey(chirpID, userID)]; exist {
+				engaged[chirpID] = true
+			}
+		}
+		return nil
+	})
+	return engaged, err
+}
+
+// CreateUsers creates a new User and saves it to disk
+func (db *DB) CreateUsers(email string, username string, hashedPassword []byte) (User, error){
 	newUser := User{}
 
-	currentDB, err := db.loadDB()
+	err := db.Update(func(tx *Tx) error {
+		err := tx.data.checkUserUnique(0, email, username)
+		if err != nil {
+			return err
+		}
+		userID, err := tx.nextID("users")
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		newUser = User{ID: userID, Email: email, Username: username, HashedPassword: hashedPassword, Role: RoleUser, CreatedAt: now, UpdatedAt: now}
+		return tx.putUser(newUser)
+	})
 	if err != nil {
-		return newUser, err
+		return User{}, err
 	}
+	return newUser, nil
+}
+
+// UpdateUser update a User and saves it to disk, an empty newEmail or newUsername and a nil newHashedPassword
+// keep the current value
+func (db *DB) UpdateUser(newEmail string, newUsername string, newHashedPassword []byte, userID int) (User, error){
+	updatedUser := User{}
 
-	users, err := db.ReadUsers()
+	err := db.Update(func(tx *Tx) error {
+		user, exist := tx.data.Users[userID]
+		if !exist {
+			return ErrUserNotExist
+		}
+		if newEmail == "" {
+			newEmail = user.Email
+		}
+		err := tx.data.checkUserUnique(userID, newEmail, newUsername)
+		if err != nil {
+			return err
+		}
+
+		updatedUser = user
+		if newEmail != user.Email {
+			updatedUser.EmailVerified = false
+		}
+		updatedUser.Email = newEmail
+		if newUsername != "" {
+			updatedUser.Username = newUsername
+		}
+		if newHashedPassword != nil {
+			updatedUser.HashedPassword = newHashedPassword
+		}
+		updatedUser.UpdatedAt = time.Now().UTC()
+		return tx.putUser(updatedUser)
+	})
 	if err != nil {
-		return newUser, err
+		return User{}, err
 	}
+	return updatedUser, nil
+}
+
+// UpdateUserPassword is a compare-and-swap of the password hash: it is only replaced while it still is
+// currentHashedPassword, the hash the caller checked the old password or reset token against. When another
+// change or a rehash got in first it fails with ErrPasswordChanged and the caller has to start over.
+func (db *DB) UpdateUserPassword(userID int, currentHashedPassword []byte, newHashedPassword []byte) (User, error){
+	updatedUser := User{}
 
-	for _, v := range users {
-		if v.Email == newUser.Email {
-			return newUser, errors.New("a user with the input email already exists")
+	err := db.Update(func(tx *Tx) error {
+		user, exist := tx.data.Users[userID]
+		if !exist {
+			return ErrUserNotExist
 		}
+		if !bytes.Equal(user.HashedPassword, currentHashedPassword) {
+			return ErrPasswordChanged
+		}
+
+		updatedUser = user
+		updatedUser.HashedPassword = newHashedPassword
+		updatedUser.UpdatedAt = time.Now().UTC()
+		return tx.putUser(updatedUser)
+	})
+	if err != nil {
+		return User{}, err
 	}
+	return updatedUser, nil
+}
 
-	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+// VerifyUserEmail marks the address of a user as verified. email is the address the link was sent to, if the
+// user changed it since then the link is stale and ErrEmailChanged is returned. Verifying twice is a no-op.
+func (db *DB) VerifyUserEmail(userID int, email string) (User, error){
+	updatedUser := User{}
 
-	if len(users) == 0 {
-		newUser.ID = 1
-	} else {
-		newUser.ID = users[len(users) - 1].ID + 1
+	err := db.Update(func(tx *Tx) error {
+		user, exist := tx.data.Users[userID]
+		if !exist {
+			return ErrUserNotExist
+		}
+		if user.Email != email {
+			return ErrEmailChanged
+		}
+
+		updatedUser = user
+		if updatedUser.EmailVerified {
+			return nil
+		}
+		updatedUser.EmailVerified = true
+		updatedUser.UpdatedAt = time.Now().UTC()
+		return tx.putUser(updatedUser)
+	})
+	if err != nil {
+		return User{}, err
 	}
+	return updatedUser, nil
+}
+
+// ReportChirp files a report against a chirp, a reporter who already has an open report on it gets that one back
+func (db *DB) ReportChirp(chirpID int, reporterID int, reason string, details string) (Report, error){
+	report := Report{}
 
-	newUser.Email = email
-	newUser.HashedPassword = hashedPassword
+	err := db.Update(func(tx *Tx) error {
+		chirp, exist := tx.data.Chirps[chirpID]
+		if !exist || !chirp.visible() {
+			return ErrChirpNotExist
+		}
+		for _, existing := range tx.data.Reports {
+			if existing.ChirpID == chirpID && existing.ReporterID == reporterID && existing.Status == ReportOpen {
+				report = existing
+				return nil
+			}
+		}
+
+		reportID, err := tx.nextID("reports")
+		if err != nil {
+			return err
+		}
+		report = Report{ID: reportID, ChirpID: chirpID, ReporterID: reporterID, Reason: reason, Details: details, Status: ReportOpen, CreatedAt: time.Now().UTC()}
+		return txPut(tx, "reports", tx.data.Reports, reportID, report)
+	})
+	return report, err
+}
 
-	users = append(users, newUser)
+// ReadReports returns a page of the reports with status, or of every report when status is empty, oldest first
+func (db *DB) ReadReports(status string, cursor *Cursor, limit int) (ReportPage, error){
+	reports := []Report{}
 
-	for i, user := range users {
-		currentDB.Users[i + 1] = user
+	err := db.View(func(tx *Tx) error {
+		for _, report := range tx.data.Reports {
+			if (status == "" || report.Status == status) && (cursor == nil || report.ID > cursor.ID) {
+				reports = append(reports, report)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return ReportPage{}, err
 	}
 
-	db.writeDB(currentDB)
-	return newUser, nil
+	slices.SortFunc(reports, func(a, b Report) int { return a.ID - b.ID })
+	if len(reports) > limit {
+		return ReportPage{Reports: reports[:limit], HasNext: true}, nil
+	}
+	return ReportPage{Reports: reports}, nil
 }
 
-// UpdateUser update a User and saves it to disk
-func (db *DB) UpdateUser(newEmail string, newHashedPassword []byte, userID int) (User, error){
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+// ResolveReport closes an open report. Hiding the chirp or suspending its author also resolves every other
+// open report on the same chirp, since they are about the same thing.
+func (db *DB) ResolveReport(reportID int, resolution string) (Report, error){
+	resolved := Report{}
+
+	err := db.Update(func(tx *Tx) error {
+		report, exist := tx.data.Reports[reportID]
+		if !exist {
+			return ErrReportNotExist
+		}
+		if report.Status != ReportOpen {
+			return ErrReportResolved
+		}
+
+		now := time.Now().UTC()
+		chirp, chirpExist := tx.data.Chirps[report.ChirpID]
+		if resolution == ResolutionHideChirp && chirpExist && !chirp.Hidden {
+			chirp.Hidden = true
+			err := tx.putChirp(chirp)
+			if err != nil {
+				return err
+			}
+		}
+		if resolution == ResolutionSuspendAuthor && chirpExist {
+			author, authorExist := tx.data.Users[chirp.AuthorID]
+			if authorExist && !author.Suspended {
+				_, err := tx.setUserSuspended(author, true)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, other := range tx.data.Reports {
+			if other.ID != reportID && (resolution == ResolutionDismiss || other.ChirpID != report.ChirpID || other.Status != ReportOpen) {
+				continue
+			}
+			other.Status = ReportResolved
+			other.Resolution = resolution
+			other.ResolvedAt = &now
+			err := txPut(tx, "reports", tx.data.Reports, other.ID, other)
+			if err != nil {
+				return err
+			}
+			if other.ID == reportID {
+				resolved = other
+			}
+		}
+		return nil
+	})
+	return resolved, err
+}
 
+// UpdateUserSuspended suspends or reinstates a user, a suspended user cannot sign in and their chirps are hidden
+func (db *DB) UpdateUserSuspended(userID int, suspended bool) (User, error){
 	updatedUser := User{}
 
-	currentDB, err := db.loadDB()
+	err := db.Update(func(tx *Tx) error {
+		user, exist := tx.data.Users[userID]
+		if !exist {
+			return ErrUserNotExist
+		}
+		var err error
+		updatedUser, err = tx.setUserSuspended(user, suspended)
+		return err
+	})
 	if err != nil {
-		return updatedUser, err
+		return User{}, err
 	}
-	
-	user, exist := currentDB.Users[userID]
-	if !exist {
-		return updatedUser, errors.New("User does not exist")
+	return updatedUser, nil
+}
+
+// setUserSuspended changes the suspension of a user and copies it onto every chirp they wrote
+func (tx *Tx) setUserSuspended(user User, suspended bool) (User, error){
+	user.Suspended = suspended
+	user.UpdatedAt = time.Now().UTC()
+	err := tx.putUser(user)
+	if err != nil {
+		return User{}, err
 	}
 
-	updatedUser = user
-	updatedUser.Email = newEmail
-	updatedUser.HashedPassword = newHashedPassword
+	for _, chirpID := range tx.data.indexes.chirpsByAuthor[user.ID] {
+		chirp := tx.data.Chirps[chirpID]
+		if chirp.AuthorSuspended != suspended {
+			chirp.AuthorSuspended = suspended
+			err = tx.putChirp(chirp)
+			if err != nil {
+				return User{}, err
+			}
+		}
+	}
+	return user, nil
+}
 
-	currentDB.Users[userID] = updatedUser
+// UpgradeUser upgrade a User to Chripy Red and saves it to disk
+func (db *DB) UpgradeUser(userID int) (User, error){
+	updatedUser := User{}
+
+	err := db.Update(func(tx *Tx) error {
+		user, exist := tx.data.Users[userID]
+		if !exist {
+			return ErrUserNotExist
+		}
 
-	db.writeDB(currentDB)
+		updatedUser = user
+		updatedUser.IsChirpyRed = true
+		updatedUser.UpdatedAt = time.Now().UTC()
+		return tx.putUser(updatedUser)
+	})
+	if err != nil {
+		return User{}, err
+	}
 	return updatedUser, nil
 }
 
-// UpgradeUser upgrade a User to Chripy Red and saves it to disk
-func (db *DB) UpgradeUser(userID int) (User, error){
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+// UpdateUserRole gives a user a new role, demoting the only admin left is refused
+func (db *DB) UpdateUserRole(userID int, role string) (User, error){
+	updatedUser := User{}
+
+	err := db.Update(func(tx *Tx) error {
+		user, exist := tx.data.Users[userID]
+		if !exist {
+			return ErrUserNotExist
+		}
+		if user.Role == RoleAdmin && role != RoleAdmin {
+			admins := 0
+			for _, other := range tx.data.Users {
+				if other.Role == RoleAdmin {
+					admins++
+				}
+			}
+			if admins == 1 {
+				return ErrLastAdmin
+			}
+		}
+
+		updatedUser = user
+		updatedUser.Role = role
+		updatedUser.UpdatedAt = time.Now().UTC()
+		return tx.putUser(updatedUser)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return updatedUser, nil
+}
 
+// UpdateUserTwoFactor replaces the whole two-factor state of a user, TwoFactor{} turns it off
+func (db *DB) UpdateUserTwoFactor(userID int, twoFactor TwoFactor) (User, error){
 	updatedUser := User{}
 
-	currentDB, err := db.loadDB()
+	err := db.Update(func(tx *Tx) error {
+		user, exist := tx.data.Users[userID]
+		if !exist {
+			return ErrUserNotExist
+		}
+
+		updatedUser = user
+		updatedUser.TwoFactor = twoFactor
+		updatedUser.UpdatedAt = time.Now().UTC()
+		return tx.putUser(updatedUser)
+	})
 	if err != nil {
-		return updatedUser, err
+		return User{}, err
 	}
-	
-	user, exist := currentDB.Users[userID]
-	if !exist {
-		return updatedUser, errors.New("user does not exist")
+	return updatedUser, nil
+}
+
+// ConsumeTwoFactorStep accepts a TOTP code for step at most once: it fails with ErrTwoFactorCodeUsed
+// unless step is later than every step accepted before, so a code cannot be replayed, not even an older one
+func (db *DB) ConsumeTwoFactorStep(userID int, step int64) error{
+	return db.Update(func(tx *Tx) error {
+		user, exist := tx.data.Users[userID]
+		if !exist {
+			return ErrUserNotExist
+		}
+		if step <= user.TwoFactor.LastStep {
+			return ErrTwoFactorCodeUsed
+		}
+
+		user.TwoFactor.LastStep = step
+		return tx.putUser(user)
+	})
+}
+
+// ConsumeRecoveryCode removes a recovery code by its hash so it works only once, and returns how many are left
+func (db *DB) ConsumeRecoveryCode(userID int, recoveryCodeHash string) (int, error){
+	left := 0
+
+	err := db.Update(func(tx *Tx) error {
+		user, exist := tx.data.Users[userID]
+		if !exist {
+			return ErrUserNotExist
+		}
+		i := slices.Index(user.TwoFactor.RecoveryCodeHashes, recoveryCodeHash)
+		if i == -1 {
+			return ErrRecoveryCodeNotExist
+		}
+
+		// the slice is shared with the stored user, so build a new one to keep rollback intact
+		user.TwoFactor.RecoveryCodeHashes = slices.Delete(slices.Clone(user.TwoFactor.RecoveryCodeHashes), i, i+1)
+		left = len(user.TwoFactor.RecoveryCodeHashes)
+		return tx.putUser(user)
+	})
+	if err != nil {
+		return 0, err
 	}
+	return left, nil
+}
 
-	updatedUser = user
-	updatedUser.IsChirpyRed = true
+// checkUserUnique fails when a user other than userID already has the email or, ignoring case, the username
+func (dbStructure *DBStructure) checkUserUnique(userID int, email string, username string) error {
+	for _, other := range dbStructure.Users {
+		if other.ID == userID {
+			continue
+		}
+		if other.Email == email {
+			return ErrUserEmailTaken
+		}
+		if username != "" && strings.EqualFold(other.Username, username) {
+			return ErrUsernameTaken
+		}
+	}
+	return nil
+}
 
-	currentDB.Users[userID] = updatedUser
+// chirpEntities extracts the entities of a chirp body and resolves its mentions against the users
+func (dbStructure *DBStructure) chirpEntities(body string) ChirpEntities {
+	entities := extractEntities(body)
+	if len(entities.Mentions) == 0 {
+		return entities
+	}
 
-	db.writeDB(currentDB)
-	return updatedUser, nil
+	users := make([]User, 0, len(dbStructure.Users))
+	for _, user := range dbStructure.Users {
+		users = append(users, user)
+	}
+	entities, _ = resolveMentions(entities, func(handle string) (int, error) {
+		return matchHandle(handle, users), nil
+	})
+	return entities
 }
 
 // ReadUsers returns all users in the database
 func (db *DB) ReadUsers() ([]User, error){
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+	usersSlice := []User{}
 
+	err := db.View(func(tx *Tx) error {
+		for _, user := range tx.data.Users {
+			usersSlice = append(usersSlice, user)
+		}
+		return nil
+	})
+	return usersSlice, err
+}
+
+// ReadUsersByIDs returns the users among userIDs in the order given, missing ones are skipped
+func (db *DB) ReadUsersByIDs(userIDs []int) ([]User, error){
 	usersSlice := []User{}
 
-	currentDB, err := db.loadDB()
-	if err != nil {
-		return usersSlice, err
-	}
+	err := db.View(func(tx *Tx) error {
+		for _, userID := range userIDs {
+			user, exist := tx.data.Users[userID]
+			if exist {
+				usersSlice = append(usersSlice, user)
+			}
+		}
+		return nil
+	})
+	return usersSlice, err
+}
 
-	for _, user := range currentDB.Users {
-		usersSlice = append(usersSlice, user)
-	}
+// ReadSingleUser returns a user in the database using a userID
+func (db *DB) ReadSingleUser(userID int) (User, error){
+	var user User
 
-	return usersSlice, nil
+	err := db.View(func(tx *Tx) error {
+		var exist bool
+		user, exist = tx.data.Users[userID]
+		if !exist {
+			return ErrUserNotExist
+		}
+		return nil
+	})
+	return user, err
 }
 
 // ReadSingleUserbyEmail returns a user in the database
 func (db *DB) ReadSingleUserbyEmail(userEmail string) (User, error){
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+	var found User
+
+	err := db.View(func(tx *Tx) error {
+		for _, user := range tx.data.Users {
+			if user.Email == userEmail {
+				found = user
+				return nil
+			}
+		}
+		return ErrNoUserWithEmail
+	})
+	return found, err
+}
+
+// FollowUser makes followerID follow followeeID, following someone twice keeps the original follow
+func (db *DB) FollowUser(followerID int, followeeID int) (Follow, error){
+	follow := Follow{}
 
-	currentDB, err := db.loadDB()
+	err := db.Update(func(tx *Tx) error {
+		if followerID == followeeID {
+			return ErrCannotFollowSelf
+		}
+		if _, exist := tx.data.Users[followeeID]; !exist {
+			return ErrUserNotExist
+		}
+		existing, exist := tx.data.Follows[followKey(followerID, followeeID)]
+		if exist {
+			follow = existing
+			return nil
+		}
+		follow = Follow{FollowerID: followerID, FolloweeID: followeeID, CreatedAt: time.Now().UTC()}
+		return tx.putFollow(follow)
+	})
 	if err != nil {
-		return User{}, err
+		return Follow{}, err
 	}
+	return follow, nil
+}
 
-	for _, user := range currentDB.Users {
-		if user.Email == userEmail {
-			return user, nil
+// UnfollowUser stops followerID from following followeeID
+func (db *DB) UnfollowUser(followerID int, followeeID int) error{
+	return db.Update(func(tx *Tx) error {
+		follow, exist := tx.data.Follows[followKey(followerID, followeeID)]
+		if !exist {
+			return ErrNotFollowing
 		}
-	}
+		return tx.deleteFollow(follow)
+	})
+}
 
-	return User{}, errors.New("no user with a matching email")
+// ReadFollowers returns a page of the users following userID, newest follow first
+func (db *DB) ReadFollowers(userID int, cursor *Cursor, limit int) (FollowPage, error){
+	return db.readFollowPage(userID, cursor, limit, true)
 }
 
-// CreateRefreshToken creates a refresh token and saves its details to disk
-func (db *DB) CreateRefreshTokenWDetails(userID int, refreshTokenString string, refreshTokenExpiry time.Time) (RefreshToken, error){
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+// ReadFollowing returns a page of the users userID follows, newest follow first
+func (db *DB) ReadFollowing(userID int, cursor *Cursor, limit int) (FollowPage, error){
+	return db.readFollowPage(userID, cursor, limit, false)
+}
 
-	refreshToken := RefreshToken{}
+// readFollowPage lists one side of a user's follow graph, ordered by follow time then the other user's ID
+func (db *DB) readFollowPage(userID int, cursor *Cursor, limit int, followers bool) (FollowPage, error){
+	followPage := FollowPage{Follows: []Follow{}}
 
-	currentDB, err := db.loadDB()
-	if err != nil {
-		return refreshToken, err
-	}
+	err := db.View(func(tx *Tx) error {
+		if _, exist := tx.data.Users[userID]; !exist {
+			return ErrUserNotExist
+		}
 
-	refreshToken.UserID = userID
-	refreshToken.RefreshToken = refreshTokenString
-	refreshToken.ExpiresAt = refreshTokenExpiry
+		follows := []Follow{}
+		if followers {
+			for followerID := range tx.data.indexes.followers[userID] {
+				follows = append(follows, tx.data.Follows[followKey(followerID, userID)])
+			}
+		} else {
+			for followeeID := range tx.data.indexes.following[userID] {
+				follows = append(follows, tx.data.Follows[followKey(userID, followeeID)])
+			}
+		}
+
+		followPage.Follows, followPage.HasNext = pageNewestFirst(follows, func(follow Follow) time.Time { return follow.CreatedAt }, func(follow Follow) int {
+			if followers {
+				return follow.FollowerID
+			}
+			return follow.FolloweeID
+		}, cursor, limit)
+		return nil
+	})
+	return followPage, err
+}
+
+// ReadTimeline returns a page of the chirps and rechirps by userID and everyone they follow, newest first.
+// Entries are merged on read from the per-user indexes, so a page costs the same however much
+// the followed users have posted.
+func (db *DB) ReadTimeline(userID int, cursor *Cursor, limit int) (ChirpPage, error){
+	chirpPage := ChirpPage{Chirps: []Chirp{}}
 
-	currentDB.RefreshTokens[refreshTokenString] = refreshToken
+	err := db.View(func(tx *Tx) error {
+		authorIDs := []int{userID}
+		for followeeID := range tx.data.indexes.following[userID] {
+			authorIDs = append(authorIDs, followeeID)
+		}
+
+		chirps := tx.data.mergeTimeline(authorIDs, cursor, limit+1)
+		chirpPage.HasNext = len(chirps) > limit
+		chirpPage.HasPrev = cursor != nil
+		chirpPage.Chirps = chirps[:min(limit, len(chirps))]
+		return nil
+	})
+	return chirpPage, err
+}
+
+// CreateRefreshTokenWDetails starts a session for session.UserID with its first refresh token and saves both to disk
+func (db *DB) CreateRefreshTokenWDetails(session Session, refreshTokenHash string, refreshTokenExpiry time.Time) (RefreshToken, Session, error){
+	refreshToken := RefreshToken{}
+
+	err := db.Update(func(tx *Tx) error {
+		sessionID, err := tx.nextID("sessions")
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		session.ID, session.Current, session.CreatedAt, session.LastUsedAt = sessionID, false, now, now
+		err = tx.putSession(session)
+		if err != nil {
+			return err
+		}
 
-	db.writeDB(currentDB)
-	return refreshToken, nil
+		refreshToken = RefreshToken{UserID: session.UserID, TokenHash: refreshTokenHash, SessionID: session.ID, ExpiresAt: refreshTokenExpiry}
+		return tx.putRefreshToken(refreshToken)
+	})
+	if err != nil {
+		return RefreshToken{}, Session{}, err
+	}
+	return refreshToken, session, nil
 }
 
-// ReadSingleRefreshTokenWDetails returns a refresh token in the database
-func (db *DB) ReadSingleRefreshTokenWDetails(refreshToken string) (RefreshToken, error){
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+// ReadSingleRefreshTokenWDetails returns a refresh token in the database, a rotated token no longer exists
+func (db *DB) ReadSingleRefreshTokenWDetails(refreshTokenHash string) (RefreshToken, error){
+	var refreshTokenStruct RefreshToken
 
-	currentDB, err := db.loadDB()
+	err := db.View(func(tx *Tx) error {
+		var exist bool
+		refreshTokenStruct, exist = tx.data.RefreshTokens[refreshTokenHash]
+		if !exist || refreshTokenStruct.RotatedAt != nil {
+			return ErrRefreshTokenNotExist
+		}
+		if refreshTokenStruct.ExpiresAt.Before(time.Now()) {
+			return ErrRefreshTokenExpired
+		}
+		return nil
+	})
 	if err != nil {
 		return RefreshToken{}, err
 	}
+	return refreshTokenStruct, nil
+}
+
+// RotateRefreshToken marks a refresh token as rotated, issues the new one in its session and records the use
+func (db *DB) RotateRefreshToken(refreshTokenHash string, newRefreshTokenHash string, newRefreshTokenExpiry time.Time, ip string, userAgent string) (RefreshToken, Session, error){
+	var rotated RefreshToken
+	var session Session
+	reused := false
+
+	err := db.Update(func(tx *Tx) error {
+		old, exist := tx.data.RefreshTokens[refreshTokenHash]
+		if !exist {
+			return ErrRefreshTokenNotExist
+		}
+		if old.RotatedAt != nil {
+			// the revocation has to be committed, so the reuse is reported once the transaction is done
+			reused, rotated = true, old
+			return tx.deleteSession(old.SessionID)
+		}
+		if old.ExpiresAt.Before(time.Now()) {
+			return ErrRefreshTokenExpired
+		}
 
-	refreshTokenStruct, exist := currentDB.RefreshTokens[refreshToken]
-	if !exist {
-		return RefreshToken{}, errors.New("refresh token does not exist")
+		now := time.Now().UTC()
+		old.RotatedAt = &now
+		err := tx.putRefreshToken(old)
+		if err != nil {
+			return err
+		}
+		rotated = RefreshToken{UserID: old.UserID, TokenHash: newRefreshTokenHash, SessionID: old.SessionID, ExpiresAt: newRefreshTokenExpiry}
+		err = tx.putRefreshToken(rotated)
+		if err != nil {
+			return err
+		}
+
+		session, exist = tx.data.Sessions[old.SessionID]
+		if !exist {
+			return ErrSessionNotExist
+		}
+		session.IP, session.UserAgent, session.LastUsedAt = ip, userAgent, now
+		return tx.putSession(session)
+	})
+	if err != nil {
+		return RefreshToken{}, Session{}, err
 	}
-	if refreshTokenStruct.ExpiresAt.Before(time.Now()) {
-		return RefreshToken{}, errors.New("refresh token has expired")
+	if reused {
+		return rotated, Session{}, ErrRefreshTokenReused
 	}
+	return rotated, session, nil
+}
 
-	return refreshTokenStruct, nil
+// DeleteRefreshToken deletes a refresh token, its session and every other token of the session from the database
+func (db *DB) DeleteRefreshToken(refreshTokenHash string) error{
+	return db.Update(func(tx *Tx) error {
+		refreshTokenStruct, exist := tx.data.RefreshTokens[refreshTokenHash]
+		if !exist {
+			return ErrRefreshTokenNotExist
+		}
+		return tx.deleteSession(refreshTokenStruct.SessionID)
+	})
+}
+
+// ReadSessions returns the sessions of a user, most recently used first
+func (db *DB) ReadSessions(userID int) ([]Session, error){
+	sessions := []Session{}
+
+	err := db.View(func(tx *Tx) error {
+		for _, session := range tx.data.Sessions {
+			if session.UserID == userID {
+				sessions = append(sessions, session)
+			}
+		}
+		return nil
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastUsedAt.Equal(sessions[j].LastUsedAt) {
+			return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+		}
+		return sessions[i].ID > sessions[j].ID
+	})
+	return sessions, err
+}
+
+// ReadSingleSession returns a session by its ID
+func (db *DB) ReadSingleSession(sessionID int) (Session, error){
+	var session Session
+
+	err := db.View(func(tx *Tx) error {
+		var exist bool
+		session, exist = tx.data.Sessions[sessionID]
+		if !exist {
+			return ErrSessionNotExist
+		}
+		return nil
+	})
+	return session, err
 }
 
-// DeleteRefreshToken deletes a refresh token from the database
-func (db *DB) DeleteRefreshToken(refreshToken string) error{
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+// DeleteSession revokes one session of a user along with its refresh tokens
+func (db *DB) DeleteSession(userID int, sessionID int) error{
+	return db.Update(func(tx *Tx) error {
+		session, exist := tx.data.Sessions[sessionID]
+		if !exist || session.UserID != userID {
+			return ErrSessionNotExist
+		}
+		return tx.deleteSession(sessionID)
+	})
+}
 
-	currentDB, err := db.loadDB()
+// DeleteUserSessions revokes every session of a user except keepSessionID
+func (db *DB) DeleteUserSessions(userID int, keepSessionID int) (int, error){
+	deleted := 0
+
+	err := db.Update(func(tx *Tx) error {
+		for sessionID, session := range tx.data.Sessions {
+			if session.UserID != userID || sessionID == keepSessionID {
+				continue
+			}
+			err := tx.deleteSession(sessionID)
+			if err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
 	if err != nil {
-		return err
-	}
-	
-	_, exist := currentDB.RefreshTokens[refreshToken]
-	if !exist {
-		return errors.New("refresh token does not exist")
+		return 0, err
 	}
+	return deleted, nil
+}
 
-	delete(currentDB.RefreshTokens, refreshToken)
+// Close folds the write-ahead log into the snapshot and releases the log file
+func (db *DB) Close() error{
+	db.mux.Lock()
+	defer db.mux.Unlock()
 
-	db.writeDB(currentDB)
-	return nil
+	err := db.compact()
+	if err != nil {
+		return err
+	}
+	return db.wal.Close()
 }
 
 // ensureDB creates a new database file if it doesn't exist
 func (db *DB) ensureDB() error{
 	_, exist := os.Stat(db.path)
 	if exist != nil {
-		newDBStructure := DBStructure{Chirps: map[int]Chirp{}, Users: map[int]User{}, RefreshTokens: map[string]RefreshToken{}}
-		dat, err := json.Marshal(newDBStructure)
-		if err != nil {
-			return err
-		}
-		os.WriteFile(db.path, dat, 0644)
+		newDBStructure := DBStructure{Version: dbSchemaVersion}
+		newDBStructure.ensureMaps()
+		return db.writeDB(newDBStructure)
 	}
 	return nil
 }
 
-// loadDB reads the database file into memory
+// loadDB reads the snapshot file into memory
 func (db *DB) loadDB() (DBStructure, error) {
+	return loadDBFile(db.path)
+}
+
+// loadDBFile reads and parses a database file at path
+func loadDBFile(path string) (DBStructure, error) {
 	currentDB := DBStructure{}
-	dat, err := os.ReadFile(db.path)
+	dat, err := os.ReadFile(path)
 	if err != nil {
 		return currentDB, err
 	}
@@ -358,28 +1296,237 @@ func (db *DB) loadDB() (DBStructure, error) {
 	if err != nil {
 		return currentDB, err
 	}
+	currentDB.ensureMaps()
 	return currentDB, nil
 }
 
+// ensureMaps initialises any table missing from an older or hand-edited file
+func (dbStructure *DBStructure) ensureMaps() {
+	if dbStructure.Chirps == nil {
+		dbStructure.Chirps = map[int]Chirp{}
+	}
+	if dbStructure.Users == nil {
+		dbStructure.Users = map[int]User{}
+	}
+	if dbStructure.RefreshTokens == nil {
+		dbStructure.RefreshTokens = map[string]RefreshToken{}
+	}
+	if dbStructure.Sessions == nil {
+		dbStructure.Sessions = map[int]Session{}
+	}
+	if dbStructure.ChirpRevisions == nil {
+		dbStructure.ChirpRevisions = map[int][]ChirpRevision{}
+	}
+	if dbStructure.Follows == nil {
+		dbStructure.Follows = map[string]Follow{}
+	}
+	if dbStructure.Likes == nil {
+		dbStructure.Likes = map[string]Engagement{}
+	}
+	if dbStructure.Rechirps == nil {
+		dbStructure.Rechirps = map[string]Engagement{}
+	}
+	if dbStructure.HeldChirps == nil {
+		dbStructure.HeldChirps = map[int]HeldChirp{}
+	}
+	if dbStructure.Reports == nil {
+		dbStructure.Reports = map[int]Report{}
+	}
+	if dbStructure.Sequences == nil {
+		dbStructure.Sequences = map[string]int{}
+	}
+}
 
-// writeDB writes the database file to disk
+// writeDB writes a snapshot to the database file, the previous file is kept as the newest generation.
+// The snapshot is renamed over the live file, so at every point there is a complete database file.
 func (db *DB) writeDB(dbStructure DBStructure) error {
 	dat, err := json.Marshal(dbStructure)
 	if err != nil {
 		return err
 	}
-	err = os.WriteFile(db.path, dat, 0644)	
+
+	tmpPath := db.path + ".tmp"
+	err = writeFileSync(tmpPath, dat)
 	if err != nil {
+		os.Remove(tmpPath)
 		return err
 	}
-	return nil
+
+	err = db.rotateGenerations()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, db.path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(db.path))
 }
 
-func deleteDB(path string) error{
-	err := os.Remove(path)
+// writeFileSync writes data to path and fsyncs it before returning
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
-	
-	return nil
-}
\ No newline at end of file
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// syncDir fsyncs a directory so that renames inside it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// generationPath returns the path of the n-th previous generation, 1 being the newest
+func (db *DB) generationPath(n int) string {
+	return fmt.Sprintf("%s.%d", db.path, n)
+}
+
+// rotateGenerations shifts every kept generation down by one and links the live file as generation 1.
+// The live file stays in place, so a crash before the new snapshot is renamed over it loses nothing.
+func (db *DB) rotateGenerations() error {
+	os.Remove(db.generationPath(dbGenerations))
+	for n := dbGenerations - 1; n >= 1; n-- {
+		err := os.Rename(db.generationPath(n), db.generationPath(n+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	os.Remove(db.generationPath(1))
+	err := os.Link(db.path, db.generationPath(1))
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	// the filesystem may not support hard links, fall back to a copy
+	data, err := os.ReadFile(db.path)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(db.generationPath(1), data)
+}
+
+// RecoveryReport describes a database file that could not be read and the generation used in its place
+type RecoveryReport struct {
+	Reason string
+	CorruptPath string
+	Generation int
+	GenerationWrittenAt time.Time
+	Chirps int
+	Users int
+	// StaleWALPath is where the write-ahead log was moved, its records were made against the lost file
+	// and replaying them onto an older generation would mix two histories
+	StaleWALPath string
+}
+
+func (r RecoveryReport) String() string {
+	lost := "anything written after " + r.GenerationWrittenAt.Format(time.RFC3339) + " is lost"
+	if r.CorruptPath != "" {
+		lost += ", the unreadable file was kept at " + r.CorruptPath
+	}
+	if r.StaleWALPath != "" {
+		lost += ", the write-ahead log was not replayed and was kept at " + r.StaleWALPath
+	}
+	return fmt.Sprintf("database recovered from generation %d (%d chirps, %d users) because %s: %s", r.Generation, r.Chirps, r.Users, r.Reason, lost)
+}
+
+// recoverDB replaces an unreadable database file with the newest generation that still parses
+func (db *DB) recoverDB() (*RecoveryReport, error) {
+	_, err := db.loadDB()
+	if err == nil {
+		return nil, nil
+	}
+	if errors.Is(err, fs.ErrNotExist) && !db.hasGenerations() {
+		return nil, nil
+	}
+
+	report := RecoveryReport{Reason: err.Error()}
+	if !errors.Is(err, fs.ErrNotExist) {
+		report.CorruptPath = fmt.Sprintf("%s.corrupt-%d", db.path, time.Now().Unix())
+		err = os.Rename(db.path, report.CorruptPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for n := 1; n <= dbGenerations; n++ {
+		genInfo, err := os.Stat(db.generationPath(n))
+		if err != nil {
+			continue
+		}
+		recovered, err := loadDBFile(db.generationPath(n))
+		if err != nil {
+			continue
+		}
+
+		data, err := os.ReadFile(db.generationPath(n))
+		if err != nil {
+			return nil, err
+		}
+		err = writeFileSync(db.path, data)
+		if err != nil {
+			return nil, err
+		}
+
+		walInfo, err := os.Stat(db.walPath())
+		if err == nil && walInfo.Size() > 0 {
+			report.StaleWALPath = fmt.Sprintf("%s.stale-%d", db.walPath(), time.Now().Unix())
+			err = os.Rename(db.walPath(), report.StaleWALPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		report.Generation = n
+		report.GenerationWrittenAt = genInfo.ModTime().UTC()
+		report.Chirps = len(recovered.Chirps)
+		report.Users = len(recovered.Users)
+		return &report, nil
+	}
+
+	return nil, fmt.Errorf("database %s is unreadable (%s) and no previous generation could be loaded", db.path, report.Reason)
+}
+
+// hasGenerations reports whether any previous generation exists on disk
+func (db *DB) hasGenerations() bool {
+	for n := 1; n <= dbGenerations; n++ {
+		_, err := os.Stat(db.generationPath(n))
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteDB removes the database and every file that belongs to it: generations, the temp file, the write-ahead
+// log and SQLite's sidecars. A missing file is skipped, the first other error is returned after trying them all.
+func deleteDB(path string) error{
+	paths := []string{path, path + ".tmp", path + ".wal", path + "-wal", path + "-shm"}
+	for n := 1; n <= dbGenerations; n++ {
+		paths = append(paths, fmt.Sprintf("%s.%d", path, n))
+	}
+
+	var firstErr error
+	for _, p := range paths {
+		err := os.Remove(p)
+		if err != nil && !errors.Is(err, os.ErrNotExist) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
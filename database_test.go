@@ -0,0 +1,394 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// newTestDB opens a JSON database in a fresh temporary directory
+func newTestDB(t testing.TB) (*DB, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, path
+}
+
+// TestConcurrentWrites hammers the DB from many goroutines and checks that no write is lost and no
+// ID is handed out twice, run it with -race to also check the locking
+func TestConcurrentWrites(t *testing.T) {
+	const writers = 20
+	const chirpsPerWriter = 10
+
+	db, path := newTestDB(t)
+	shared, err := db.CreateChirp("", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, writers*chirpsPerWriter*3)
+	for writer := 1; writer <= writers; writer++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < chirpsPerWriter; i++ {
+				_, err := db.CreateChirp("chirp", writer, 0)
+				if err != nil {
+					errs <- err
+				}
+				// read-modify-write of a shared chirp through a raw transaction
+				err = db.Update(func(tx *Tx) error {
+					chirp := tx.data.Chirps[shared.ID]
+					chirp.Body += "x"
+					return tx.putChirp(chirp)
+				})
+				if err != nil {
+					errs <- err
+				}
+				_, err = db.ReadChirps()
+				if err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	check := func(db *DB) {
+		t.Helper()
+		chirps, err := db.ReadChirps()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chirps) != writers*chirpsPerWriter+1 {
+			t.Errorf("got %d chirps, want %d", len(chirps), writers*chirpsPerWriter+1)
+		}
+		ids := map[int]bool{}
+		for _, chirp := range chirps {
+			if ids[chirp.ID] {
+				t.Errorf("chirp ID %d handed out twice", chirp.ID)
+			}
+			ids[chirp.ID] = true
+		}
+
+		shared, err := db.ReadSingleChirp(shared.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shared.Body) != writers*chirpsPerWriter {
+			t.Errorf("shared chirp was updated %d times, want %d", len(shared.Body), writers*chirpsPerWriter)
+		}
+	}
+
+	check(db)
+
+	// everything acknowledged must also survive a restart
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	check(reopened)
+}
+
+// benchmarkSeedChirps is how many chirps the benchmarks start with, so a full rewrite has something to write
+const benchmarkSeedChirps = 2000
+
+// newBenchmarkDB opens a database seeded with benchmarkSeedChirps chirps
+func newBenchmarkDB(b *testing.B) *DB {
+	db, _ := newTestDB(b)
+	for i := 0; i < benchmarkSeedChirps; i++ {
+		_, err := db.CreateChirp("seeded chirp for the benchmark", 1, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.Cleanup(func() { db.Close() })
+	b.ResetTimer()
+	return db
+}
+
+// BenchmarkCreateChirpWAL is the current write path, one appended and fsynced log line per transaction
+func BenchmarkCreateChirpWAL(b *testing.B) {
+	db := newBenchmarkDB(b)
+	for i := 0; i < b.N; i++ {
+		_, err := db.CreateChirp("benchmark chirp", 1, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCreateChirpFullRewrite is the write path before the log, every transaction rewrote the whole file.
+// The log append still happens too, it is small next to the rewrite.
+func BenchmarkCreateChirpFullRewrite(b *testing.B) {
+	db := newBenchmarkDB(b)
+	for i := 0; i < b.N; i++ {
+		err := db.Update(func(tx *Tx) error {
+			_, err := tx.createChirp("benchmark chirp", 1, 0)
+			if err != nil {
+				return err
+			}
+			return db.writeDB(db.data)
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadSingleChirpMemory is the current read path, served from the in-memory state
+func BenchmarkReadSingleChirpMemory(b *testing.B) {
+	db := newBenchmarkDB(b)
+	for i := 0; i < b.N; i++ {
+		_, err := db.ReadSingleChirp(i%benchmarkSeedChirps + 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadSingleChirpFromDisk is the read path before the log, every read loaded and parsed the file
+func BenchmarkReadSingleChirpFromDisk(b *testing.B) {
+	db := newBenchmarkDB(b)
+	err := db.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := db.loadDB()
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, exist := data.Chirps[i%benchmarkSeedChirps + 1]
+		if !exist {
+			b.Fatal(ErrChirpNotExist)
+		}
+	}
+}
+
+// TestDeleteDBRemovesEverything checks that -debug clears leftovers even when the main file is already gone
+func TestDeleteDBRemovesEverything(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	leftovers := []string{path + ".1", path + ".3", path + ".tmp", path + ".wal", path + "-wal", path + "-shm"}
+	for _, p := range leftovers {
+		err := os.WriteFile(p, []byte("{}"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := deleteDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range leftovers {
+		_, err := os.Stat(p)
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s was not removed", filepath.Base(p))
+		}
+	}
+}
+
+// crashDB drops the database without compacting, leaving the snapshot and log as a crash would
+func crashDB(t *testing.T, db *DB) {
+	t.Helper()
+	err := db.wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// chirpBodies returns the bodies of every chirp in the database in ID order
+func chirpBodies(t *testing.T, db *DB) []string {
+	t.Helper()
+	chirps, err := db.ReadChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(chirps, func(i, j int) bool { return chirps[i].ID < chirps[j].ID })
+	bodies := []string{}
+	for _, chirp := range chirps {
+		bodies = append(bodies, chirp.Body)
+	}
+	return bodies
+}
+
+func TestRecoverTornWAL(t *testing.T) {
+	db, path := newTestDB(t)
+	for _, body := range []string{"first", "second"} {
+		_, err := db.CreateChirp(body, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	crashDB(t, db)
+
+	// a crash halfway through appending a third transaction
+	f, err := os.OpenFile(path+".wal", os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString(`{"ops":[{"op":"put","kind":"chirps","id":3,"val`)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	got := fmt.Sprint(chirpBodies(t, reopened))
+	if got != "[first second]" {
+		t.Errorf("recovered %s, want [first second]", got)
+	}
+
+	// the torn tail must be gone, so the next append starts on a fresh line
+	_, err = reopened.CreateChirp("third", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashDB(t, reopened)
+	again, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	got = fmt.Sprint(chirpBodies(t, again))
+	if got != "[first second third]" {
+		t.Errorf("after another crash recovered %s, want [first second third]", got)
+	}
+}
+
+func TestRecoverCorruptSnapshot(t *testing.T) {
+	db, path := newTestDB(t)
+	for _, body := range []string{"first", "second"} {
+		_, err := db.CreateChirp(body, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// every close compacts, so each chirp lands in its own snapshot generation
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDB(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := db.CreateChirp("only in the log", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashDB(t, db)
+
+	err = os.WriteFile(path, []byte(`{"chirps": {"1": {"id": 1, "bo`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := (&DB{path: path}).recoverDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report == nil || report.Generation != 1 {
+		t.Fatalf("got report %v, want a recovery from generation 1", report)
+	}
+	if report.CorruptPath == "" || report.StaleWALPath == "" {
+		t.Errorf("report should name the kept corrupt file and log: %v", report)
+	}
+	_, err = os.Stat(report.StaleWALPath)
+	if err != nil {
+		t.Errorf("log was not kept: %v", err)
+	}
+
+	// generation 1 is the snapshot before the last compaction, and the log written on top of the lost
+	// snapshot must not be replayed onto it
+	reopened, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	got := fmt.Sprint(chirpBodies(t, reopened))
+	if got != "[first]" {
+		t.Errorf("recovered %s, want [first]", got)
+	}
+}
+
+// TestQueryRepliesIndex checks that reply lookups through the parent index match what was written,
+// including after a rolled back transaction and after the index is rebuilt on reopen
+func TestQueryRepliesIndex(t *testing.T) {
+	db, path := newTestDB(t)
+	root, err := db.CreateChirp("root", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := db.CreateChirp("other root", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, parentID := range []int{root.ID, other.ID, root.ID} {
+		_, err = db.CreateChirp("reply", 2, parentID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	errRollback := errors.New("rollback")
+	err = db.Update(func(tx *Tx) error {
+		_, err := tx.createChirp("rolled back reply", 1, root.ID)
+		if err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("got %v, want the rollback error", err)
+	}
+
+	check := func(db *DB) {
+		t.Helper()
+		page, err := db.QueryChirps(ChirpQuery{InReplyTo: root.ID, IncludeDeleted: true, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []int{}
+		for _, chirp := range page.Chirps {
+			ids = append(ids, chirp.ID)
+		}
+		if fmt.Sprint(ids) != "[3 5]" {
+			t.Errorf("replies to the root are %v, want [3 5]", ids)
+		}
+	}
+	check(db)
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	check(reopened)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	errInvalidUsername = errors.New("username must be 1 to 15 letters, digits or underscores")
+	errInvalidEmail = errors.New("email must be a plain address such as name@example.com")
+)
+
+var (
+	usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,15}$`)
+	// a hashtag needs at least one letter so that "#1" stays plain text
+	hashtagPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_&])(#[\p{L}\p{N}_]*\p{L}[\p{L}\p{N}_]*)`)
+	// a mention is @ and a username, extractEntities skips one that runs on into an email domain or other letters
+	mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_])(@[A-Za-z0-9_]+)`)
+)
+
+// validateUsername checks a username picked by a user, the empty username is allowed and means none
+func validateUsername(username string) error {
+	if username != "" && !usernamePattern.MatchString(username) {
+		return errInvalidUsername
+	}
+	return nil
+}
+
+// validateEmail checks that email is a bare address with a domain, the longest an SMTP server accepts
+func validateEmail(email string) error {
+	if len(email) > 254 {
+		return errInvalidEmail
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Name != "" || address.Address != email || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+		return errInvalidEmail
+	}
+	return nil
+}
+
+// extractEntities finds the hashtags and mentions in a chirp body. Offsets count characters (runes), not bytes,
+// and cover the leading # or @. Mentions come back unresolved with a zero UserID.
+func extractEntities(body string) ChirpEntities {
+	entities := ChirpEntities{Hashtags: []Hashtag{}, Mentions: []Mention{}}
+
+	for _, match := range hashtagPattern.FindAllStringSubmatchIndex(body, -1) {
+		start, end := runeOffset(body, match[2]), runeOffset(body, match[3])
+		entities.Hashtags = append(entities.Hashtags, Hashtag{Tag: strings.ToLower(body[match[2]+1 : match[3]]), Start: start, End: end})
+	}
+	for _, match := range mentionPattern.FindAllStringSubmatchIndex(body, -1) {
+		// "@name@example.com" is an email address and "@zoë" is not a username, neither mentions a shorter name
+		next, _ := utf8.DecodeRuneInString(body[match[3]:])
+		if next == '@' || unicode.IsLetter(next) || unicode.IsDigit(next) {
+			continue
+		}
+		start, end := runeOffset(body, match[2]), runeOffset(body, match[3])
+		entities.Mentions = append(entities.Mentions, Mention{Handle: body[match[2]+1 : match[3]], Start: start, End: end})
+	}
+	return entities
+}
+
+// runeOffset converts a byte offset into body to a character offset
+func runeOffset(body string, byteOffset int) int {
+	return utf8.RuneCountInString(body[:byteOffset])
+}
+
+// resolveMentions looks up the user behind every mention and drops the ones that match nobody
+func resolveMentions(entities ChirpEntities, lookup func(handle string) (int, error)) (ChirpEntities, error) {
+	resolved := []Mention{}
+	for _, mention := range entities.Mentions {
+		userID, err := lookup(mention.Handle)
+		if err != nil {
+			return entities, err
+		}
+		if userID != 0 {
+			mention.UserID = userID
+			resolved = append(resolved, mention)
+		}
+	}
+	entities.Mentions = resolved
+	return entities, nil
+}
+
+// matchHandle picks the user whose username is handle among candidates, ignoring case, 0 when there is none.
+// Email addresses are never matched, a mention must not reveal or guess at one.
+func matchHandle(handle string, candidates []User) int {
+	for _, user := range candidates {
+		if user.Username != "" && strings.EqualFold(user.Username, handle) {
+			return user.ID
+		}
+	}
+	return 0
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestExtractMentions(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"hi @alice", "[alice@3-9]"},
+		{"@alice and @Bob_2!", "[alice@0-6 Bob_2@11-17]"},
+		{"end of sentence @alice.", "[alice@16-22]"},
+		{"mail me at alice@example.com", "[]"},
+		{"or @alice@example.com", "[]"},
+		{"no@mention", "[]"},
+		{"héllo @zoë", "[]"},
+		{"héllo @zoe", "[zoe@6-10]"},
+	}
+	for _, tt := range tests {
+		mentions := []string{}
+		for _, mention := range extractEntities(tt.body).Mentions {
+			mentions = append(mentions, fmt.Sprintf("%s@%d-%d", mention.Handle, mention.Start, mention.End))
+		}
+		got := fmt.Sprint(mentions)
+		if got != tt.want {
+			t.Errorf("extractEntities(%q) mentions = %s, want %s", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestMatchHandle(t *testing.T) {
+	users := []User{
+		{ID: 1, Email: "alice@example.com", Username: "alice"},
+		{ID: 2, Email: "bob@example.com"},
+		{ID: 3, Email: "carol@example.com", Username: "Carol"},
+	}
+	tests := []struct {
+		handle string
+		want int
+	}{
+		{"alice", 1},
+		{"ALICE", 1},
+		{"carol", 3},
+		// bob has no username, an email address must not stand in for one
+		{"bob", 0},
+		{"bob@example.com", 0},
+		{"alice@example.com", 0},
+		{"", 0},
+		{"dave", 0},
+	}
+	for _, tt := range tests {
+		got := matchHandle(tt.handle, users)
+		if got != tt.want {
+			t.Errorf("matchHandle(%q) = %d, want %d", tt.handle, got, tt.want)
+		}
+	}
+}
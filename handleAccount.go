@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	errEmailAlreadyVerified = errors.New("email address is already verified")
+	errEmailNotVerified = errors.New("verify your email address before posting")
+	errTooManyPasswordResets = errors.New("too many password reset requests, try again later")
+)
+
+// sendEmailVerification emails user a link that verifies their current address
+func (cfg *apiConfig)sendEmailVerification(user User) error{
+	token, err := cfg.mintEmailVerificationToken(user)
+	if err != nil {
+		return err
+	}
+
+	link := cfg.publicURL + "/api/email/verify?token=" + url.QueryEscape(token)
+	cfg.sendMail(Email{
+		To: user.Email,
+		Subject: "Verify your email address for Chirpy",
+		Body: fmt.Sprintf("Open this link to confirm that %s is your email address:\n\n%s\n\nThe link expires in %v. If you did not sign up for Chirpy, ignore this email.\n", user.Email, link, emailVerificationLife),
+		Secret: url.QueryEscape(token),
+	})
+	return nil
+}
+
+// handlerVerifyEmail is the target of the link sent by sendEmailVerification
+func (cfg *apiConfig)handlerVerifyEmail(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	claims, err := cfg.parseToken(r.URL.Query().Get("token"), TokenUseEmailVerification)
+	if err != nil {
+		cfg.handlerTokenErrors(w, err, respBody)
+		return
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		cfg.handlerTokenErrors(w, err, respBody)
+		return
+	}
+
+	user, err := cfg.DB.VerifyUserEmail(userID, claims.Email)
+	if errors.Is(err, ErrUserNotExist) {
+		cfg.handlerErrors(w, err, respBody, 404)
+		return
+	}
+	// the address was changed after the link was sent, only a link to the new address verifies it
+	if errors.Is(err, ErrEmailChanged) {
+		cfg.handlerErrors(w, err, respBody, 409)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	respBody.ID = user.ID
+	respBody.Email = user.Email
+	respBody.EmailVerified = user.EmailVerified
+
+	dat, err := json.Marshal(respBody)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig)handlerResendEmailVerification(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	user := requestPrincipal(r).User
+	if user.EmailVerified {
+		cfg.handlerErrors(w, errEmailAlreadyVerified, respBody, 409)
+		return
+	}
+
+	err := cfg.sendEmailVerification(user)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(202)
+}
+
+// handlerForgotPassword emails a password reset link. It answers the same whether or not the email belongs
+// to an account, so it cannot be used to find out who has signed up. Requests are limited per email and
+// per IP whether or not the email is signed up, so nobody can flood an inbox with reset emails.
+func (cfg *apiConfig)handlerForgotPassword(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	type reqParams struct {
+		Email string `json:"email"`
+	}
+	reqBody := reqParams{}
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&reqBody)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	wait, _ := cfg.passwordResetThrottle.Attempt(reqBody.Email, clientIP(r), time.Now())
+	if wait > 0 {
+		respBody.ErrorCode = "password_reset_throttled"
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+		cfg.handlerErrors(w, errTooManyPasswordResets, respBody, 429)
+
+		dat, err := json.Marshal(respBody)
+		if err != nil {
+			return
+		}
+		w.Write(dat)
+		return
+	}
+
+	user, err := cfg.DB.ReadSingleUserbyEmail(reqBody.Email)
+	if err != nil && !errors.Is(err, ErrNoUserWithEmail) {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+	if err == nil && !user.Suspended {
+		token, err := cfg.mintPasswordResetToken(user)
+		if err != nil {
+			cfg.handlerErrors(w, err, respBody, 500)
+			return
+		}
+		cfg.sendMail(Email{
+			To: user.Email,
+			Subject: "Reset your Chirpy password",
+			Body: fmt.Sprintf("Someone asked to reset the password of your Chirpy account. To choose a new password, send this token to POST %s/api/password/reset within %v:\n\n%s\n\nThe token works once. If you did not ask for a reset, ignore this email and your password stays the same.\n", cfg.publicURL, passwordResetLife, token),
+			Secret: token,
+		})
+	}
+
+	w.WriteHeader(202)
+}
+
+// handlerResetPassword sets a new password with a token from handlerForgotPassword and signs the account
+// out everywhere, since whoever knew the old password may still hold a session
+func (cfg *apiConfig)handlerResetPassword(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	type reqParams struct {
+		Token string `json:"token"`
+		Password string `json:"password"`
+	}
+	reqBody := reqParams{}
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&reqBody)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	claims, err := cfg.parseToken(reqBody.Token, TokenUsePasswordReset)
+	if err != nil {
+		cfg.handlerTokenErrors(w, err, respBody)
+		return
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		cfg.handlerTokenErrors(w, err, respBody)
+		return
+	}
+
+	user, err := cfg.DB.ReadSingleUser(userID)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 401)
+		return
+	}
+	if claims.PasswordFingerprint != passwordFingerprint(user.HashedPassword) {
+		cfg.handlerErrors(w, ErrPasswordChanged, respBody, 401)
+		return
+	}
+
+	hashedPassword, err := cfg.hashNewPassword(reqBody.Password)
+	if errors.Is(err, errWeakPassword) {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	// two requests racing with the same token both passed the fingerprint check, only one may win
+	_, err = cfg.DB.UpdateUserPassword(userID, user.HashedPassword, hashedPassword)
+	if errors.Is(err, ErrPasswordChanged) {
+		cfg.handlerErrors(w, err, respBody, 401)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	revoked, err := cfg.DB.DeleteUserSessions(userID, 0)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+	log.Printf("security: password of user %d was reset, revoked %d sessions", userID, revoked)
+	// whoever can read the account's email may log in again right away
+	cfg.loginThrottle.Unlock(user.Email)
+
+	w.WriteHeader(204)
+}
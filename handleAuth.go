@@ -4,18 +4,26 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
-	"strconv"
+	"slices"
 	"strings"
 	"time"
-
-	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const MAXDURATION = 1 * time.Hour
 
+var (
+	errInvalidCredentials = errors.New("incorrect email or password")
+	errTooManyLoginFailures = errors.New("too many failed logins, try again later")
+)
+
+// refreshTokenLife is how long a refresh token stays valid, every rotation starts it again
+const refreshTokenLife = 60 * time.Hour
+
 func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	respBody := &RespBody{}
@@ -24,6 +32,8 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		Password string `json:"password"`
 		Email string `json:"email"`
 		Expires_in_seconds int `json:"expires_in_seconds"`
+		DeviceName string `json:"device_name"`
+		Audience string `json:"audience"`
 	}
 	reqBody := reqParams{}
 
@@ -34,70 +44,119 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	if cfg.handlerLoginThrottled(w, respBody, reqBody.Email, clientIP(r)) {
+		return
+	}
+
 	user, err := cfg.DB.ReadSingleUserbyEmail(reqBody.Email)
+	if errors.Is(err, ErrNoUserWithEmail) {
+		// spend as long as a wrong password would, so that timing does not tell which emails have an account
+		checkPassword(cfg.dummyPasswordHash, reqBody.Password)
+		cfg.handlerErrors(w, errInvalidCredentials, respBody, 401)
+		return
+	}
 	if err != nil {
-		cfg.handlerErrors(w, err, respBody, 401)
+		cfg.handlerErrors(w, err, respBody, 500)
 		return
 	}
 	
-	err = bcrypt.CompareHashAndPassword(user.HashedPassword, []byte(reqBody.Password))
+	match, err := checkPassword(user.HashedPassword, reqBody.Password)
 	if err != nil {
-		cfg.handlerErrors(w, err, respBody, 401)
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+	if !match {
+		cfg.handlerErrors(w, errInvalidCredentials, respBody, 401)
 		return
 	}
+	cfg.loginThrottle.Refund(reqBody.Email, clientIP(r))
+	user = cfg.rehashPassword(user, reqBody.Password)
 
-	var tokenLife int
+	if user.Suspended {
+		cfg.handlerErrors(w, errAccountSuspended, respBody, 403)
+		return
+	}
 
-	if reqBody.Expires_in_seconds == 0 || reqBody.Expires_in_seconds > int(MAXDURATION.Seconds()) {
-		tokenLife = int(MAXDURATION.Seconds())
-	} else {
-		tokenLife = reqBody.Expires_in_seconds
+	if len(reqBody.DeviceName) > maxDeviceName {
+		cfg.handlerErrors(w, errDeviceNameTooLong, respBody, 400)
+		return
+	}
+	if reqBody.Audience == "" {
+		reqBody.Audience = cfg.audiences[0]
+	}
+	if !slices.Contains(cfg.audiences, reqBody.Audience) {
+		cfg.handlerErrors(w, fmt.Errorf("unknown audience %q", reqBody.Audience), respBody, 400)
+		return
 	}
 
-	expirationTime := time.Now().UTC().Add(time.Duration(tokenLife) * time.Second)
+	if user.TwoFactor.Enabled {
+		challengeToken, err := cfg.mintChallengeToken(user, reqBody.Audience)
+		if err != nil {
+			cfg.handlerErrors(w, err, respBody, 500)
+			return
+		}
 
-	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-			Issuer:    "chirpy",
-			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			Subject:   fmt.Sprint(user.ID),
-	})
+		respBody.Status = "2fa_required"
+		respBody.ChallengeToken = challengeToken
 
-	signedJwtToken, err := jwtToken.SignedString([]byte(cfg.jwtSecret))
-	if err != nil {
-		cfg.handlerErrors(w, err, respBody, 500)
+		dat, err := json.Marshal(respBody)
+		if err != nil {
+			cfg.handlerErrors(w, err, respBody, 500)
+			return
+		}
+
+		w.WriteHeader(200)
+		w.Write(dat)
 		return
 	}
-	
-	random32Bytes := make([]byte, 32)
-	
-	_, err = rand.Read([]byte(random32Bytes))
+
+	cfg.handlerStartSession(w, r, respBody, user, reqBody.DeviceName, reqBody.Audience, reqBody.Expires_in_seconds)
+}
+
+// handlerStartSession finishes a login once every factor was checked: it opens a session for user and
+// answers with an access token and the session's first refresh token
+func (cfg *apiConfig)handlerStartSession(w http.ResponseWriter, r *http.Request, respBody *RespBody, user User, deviceName string, audience string, expiresInSeconds int){
+	cfg.loginThrottle.Succeed(user.Email)
+
+	refreshTokenString, err := randomToken()
 	if err != nil {
 		cfg.handlerErrors(w, err, respBody, 500)
 		return
 	}
+	refreshTokenExpiry := time.Now().UTC().Add(refreshTokenLife)
 
-	refreshTokenString := hex.EncodeToString(random32Bytes)
-	refreshTokenExpiry := time.Now().UTC().Add(60 * time.Hour)
-
-	refreshToken, err := cfg.DB.CreateRefreshTokenWDetails(user.ID, refreshTokenString, refreshTokenExpiry)
+	session := Session{UserID: user.ID, DeviceName: deviceName, UserAgent: r.UserAgent(), IP: clientIP(r), Audience: audience}
+	refreshToken, session, err := cfg.DB.CreateRefreshTokenWDetails(session, hashRefreshToken(refreshTokenString), refreshTokenExpiry)
 	if err != nil {
 		cfg.handlerErrors(w, err, respBody, 500)
 		return
 	}
 
-	updatedUser, err := cfg.DB.UpdateUser(user.Email, user.HashedPassword, user.ID)
+	var tokenLife int
+
+	if expiresInSeconds == 0 || expiresInSeconds > int(MAXDURATION.Seconds()) {
+		tokenLife = int(MAXDURATION.Seconds())
+	} else {
+		tokenLife = expiresInSeconds
+	}
+
+	expirationTime := time.Now().UTC().Add(time.Duration(tokenLife) * time.Second)
+
+	signedJwtToken, err := cfg.mintAccessToken(user, session, expirationTime)
 	if err != nil {
-		cfg.DB.DeleteRefreshToken(refreshTokenString)
+		cfg.DB.DeleteRefreshToken(refreshToken.TokenHash)
 		cfg.handlerErrors(w, err, respBody, 500)
 		return
 	}
 	
-	respBody.ID = updatedUser.ID
-	respBody.Email = updatedUser.Email
+	respBody.ID = user.ID
+	respBody.Email = user.Email
+	respBody.EmailVerified = user.EmailVerified
+	respBody.Username = user.Username
 	respBody.Token = signedJwtToken
-	respBody.RefreshToken = refreshToken.RefreshToken
-	respBody.IsChirpyRed = updatedUser.IsChirpyRed
+	respBody.RefreshToken = refreshTokenString
+	respBody.IsChirpyRed = user.IsChirpyRed
+	respBody.Role = user.Role
 	
 	dat, err := json.Marshal(respBody)
 	if err != nil {
@@ -115,37 +174,49 @@ w.Header().Set("Content-Type", "application/json")
 
 	refreshToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
 
-	refreshTokenStruct, err := cfg.DB.ReadSingleRefreshTokenWDetails(refreshToken)
+	newRefreshTokenString, err := randomToken()
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	refreshTokenStruct, session, err := cfg.DB.RotateRefreshToken(hashRefreshToken(refreshToken), hashRefreshToken(newRefreshTokenString), time.Now().UTC().Add(refreshTokenLife), clientIP(r), r.UserAgent())
+	if errors.Is(err, ErrRefreshTokenReused) {
+		// either the client or whoever stole the token refreshed already, neither can be trusted any more
+		log.Printf("security: reuse of a rotated refresh token for user %d from %s, revoked session %d", refreshTokenStruct.UserID, clientIP(r), refreshTokenStruct.SessionID)
+		cfg.handlerErrors(w, err, respBody, 401)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 401)
+		return
+	}
+
+	// a refresh token issued before the suspension must not keep the account signed in
+	user, err := cfg.DB.ReadSingleUser(refreshTokenStruct.UserID)
 	if err != nil {
+		cfg.DB.DeleteRefreshToken(refreshTokenStruct.TokenHash)
 		cfg.handlerErrors(w, err, respBody, 401)
 		return
 	}
+	if user.Suspended {
+		cfg.DB.DeleteRefreshToken(refreshTokenStruct.TokenHash)
+		cfg.handlerErrors(w, errAccountSuspended, respBody, 403)
+		return
+	}
 
 	tokenLife := int(MAXDURATION.Seconds())
 	expirationTime := time.Now().UTC().Add(time.Duration(tokenLife) * time.Second)
 
-	newJwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-			Issuer:    "chirpy",
-			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			Subject:   fmt.Sprint(refreshTokenStruct.UserID),
-	})
-
-	signedJwtToken, err := newJwtToken.SignedString([]byte(cfg.jwtSecret))
+	// the role is read again so that a promotion or demotion reaches the next access token
+	signedJwtToken, err := cfg.mintAccessToken(user, session, expirationTime)
 	if err != nil {
 		cfg.handlerErrors(w, err, respBody, 500)
 		return
 	}
 	
-	random32Bytes := make([]byte, 32)
-	
-	_, err = rand.Read([]byte(random32Bytes))
-	if err != nil {
-		cfg.handlerErrors(w, err, respBody, 500)
-		return
-	}
-
 	respBody.Token = signedJwtToken
+	respBody.RefreshToken = newRefreshTokenString
 
 	dat, err := json.Marshal(respBody)
 	if err != nil {
@@ -163,7 +234,7 @@ w.Header().Set("Content-Type", "application/json")
 
 	refreshToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
 
-	err := cfg.DB.DeleteRefreshToken(refreshToken)
+	err := cfg.DB.DeleteRefreshToken(hashRefreshToken(refreshToken))
 	if err != nil {
 		cfg.handlerErrors(w, err, respBody, 401)
 		return
@@ -179,23 +250,80 @@ w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(204)
 }
 
-func (cfg *apiConfig)handlerAuthenticateWJwt(r *http.Request)(int, error){
-	var userID int
+// randomToken returns 32 random bytes, hex encoded
+func randomToken() (string, error) {
+	random32Bytes := make([]byte, 32)
+
+	_, err := rand.Read(random32Bytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random32Bytes), nil
+}
+
+func (cfg *apiConfig)handlerReadJWKS(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	type jwksBody struct {
+		Keys []JWK `json:"keys"`
+	}
+
+	dat, err := json.Marshal(jwksBody{Keys: cfg.keys.JWKS()})
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	// a new key is published jwksMaxAge before it signs, so a cached set never misses a key in use
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+// handlerLoginThrottled answers with 429 and reports true when too many logins for email or from ip failed.
+// Otherwise the attempt is charged as a failure, the caller refunds it once the credentials are right.
+func (cfg *apiConfig)handlerLoginThrottled(w http.ResponseWriter, respBody *RespBody, email string, ip string) bool {
+	wait, locked := cfg.loginThrottle.Attempt(email, ip, time.Now())
+	if wait == 0 {
+		return false
+	}
 
-	jwtTokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-	jwtToken, err := jwt.ParseWithClaims(jwtTokenString, jwt.MapClaims{}, func(t *jwt.Token) (interface{}, error) {return []byte(cfg.jwtSecret), nil})
+	respBody.ErrorCode = "login_throttled"
+	if locked {
+		respBody.ErrorCode = "login_locked"
+	}
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+	cfg.handlerErrors(w, errTooManyLoginFailures, respBody, 429)
 
+	dat, err := json.Marshal(respBody)
 	if err != nil {
-		return userID, err
+		return true
+	}
+	w.Write(dat)
+	return true
+}
+
+// rehashPassword upgrades the password hash of user to the current algorithm and parameters once the
+// password was checked, the only time the plain password is at hand. It returns user with the new hash,
+// or unchanged when there was nothing to do or the upgrade failed, which is left for the next login.
+func (cfg *apiConfig)rehashPassword(user User, password string) User {
+	if !cfg.passwordHasher.NeedsRehash(user.HashedPassword) {
+		return user
 	}
 
-	idString, err := jwtToken.Claims.GetSubject()
+	hashedPassword, err := cfg.passwordHasher.Hash(password)
 	if err != nil {
-		return userID, err
+		log.Printf("could not rehash the password of user %d: %v", user.ID, err)
+		return user
 	}
-	userID, err = strconv.Atoi(idString)
+	// the password was changed since it was read, the new hash is the newer one already
+	updatedUser, err := cfg.DB.UpdateUserPassword(user.ID, user.HashedPassword, hashedPassword)
 	if err != nil {
-		return userID, err
+		if !errors.Is(err, ErrPasswordChanged) {
+			log.Printf("could not rehash the password of user %d: %v", user.ID, err)
+		}
+		return user
 	}
-	return userID, nil
-}
\ No newline at end of file
+	return updatedUser
+}
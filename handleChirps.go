@@ -3,50 +3,58 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
-	"slices"
-	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func (cfg *apiConfig) handlerCreateChirps(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	respBody := &RespBody{}
 
-	authorID, err := cfg.handlerAuthenticateWJwt(r)
-	if err != nil {
-		cfg.handlerErrors(w, err, respBody, 401)
+	author := requestPrincipal(r).User
+	authorID := author.ID
+	if cfg.requireVerifiedEmail && !author.EmailVerified {
+		cfg.handlerErrors(w, errEmailNotVerified, respBody, 403)
 		return
 	}
 
 	type reqParams struct {
 		Body string `json:"body"`
+		InReplyTo int `json:"in_reply_to"`
 	}
 	reqBody := reqParams{}
 
 	decoder := json.NewDecoder(r.Body)
-	err = decoder.Decode(&reqBody)
+	err := decoder.Decode(&reqBody)
 	if err != nil {
 		cfg.handlerErrors(w, err, respBody, 500)
 		return
 	} 
 	
-	if len(reqBody.Body) > 140 {
-		respBody.Error = "Chirp is too long"
-		w.WriteHeader(400)
-		return 
+	verdict, err := cfg.moderateChirpBody(reqBody.Body)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
 	}
-	
-	bannedWords := []string{"kerfuffle","sharbert","fornax"}
-	words := strings.Split(reqBody.Body, " ")
-	for i, word := range words {
-		if slices.Contains(bannedWords, strings.ToLower(word)) {
-			words[i] = "****"
-		}
+	if verdict.Action == ModerationReject {
+		cfg.handlerRejectChirp(w, respBody, verdict)
+		return
+	}
+	if verdict.Action == ModerationHold {
+		cfg.handlerHoldChirp(w, respBody, verdict, authorID, reqBody.InReplyTo)
+		return
+	}
+	respBody.Body = verdict.Body
+	respBody.Reasons = verdict.Reasons
+
+	chirp, err := cfg.DB.CreateChirp(respBody.Body, authorID, reqBody.InReplyTo)
+	if errors.Is(err, ErrParentChirpNotExist) {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
 	}
-	respBody.Body = strings.Join(words, " ")
-	chirp, err := cfg.DB.CreateChirp(respBody.Body, authorID)
 	if err != nil {
 		cfg.handlerErrors(w, err, respBody, 500)
 		return
@@ -54,6 +62,10 @@ func (cfg *apiConfig) handlerCreateChirps(w http.ResponseWriter, r *http.Request
 	
 	respBody.ID = chirp.ID
 	respBody.AuthorID = chirp.AuthorID
+	respBody.InReplyTo = chirp.InReplyTo
+	respBody.Entities = &chirp.Entities
+	respBody.CreatedAt = &chirp.CreatedAt
+	respBody.UpdatedAt = &chirp.UpdatedAt
 	
 	dat, err := json.Marshal(respBody)
 	if err != nil {
@@ -69,49 +81,97 @@ func (cfg *apiConfig)handlerReadChirps(w http.ResponseWriter, r *http.Request){
 	w.Header().Set("Content-Type", "application/json")
 	respBody := &RespBody{}
 
-	chirps, err := cfg.DB.ReadChirps()
-		if err != nil {
-			cfg.handlerErrors(w, err, respBody, 500)
-			return
-		}
+	query, err := parseChirpQuery(r)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
 
-	authorID := r.URL.Query().Get("author_id")
+	cfg.serveChirpPage(w, r, respBody, query)
+}
 
-	if authorID != "" {
-		authorID, err := strconv.Atoi(authorID)
-		if err != nil {
-			cfg.handlerErrors(w, err, respBody, 500)
-			return
-		}
-		for i, chirp := range chirps {
-			if chirp.AuthorID != authorID {
-				chirps = append(chirps[:i], chirps[i+1:]...)
-			}	
-		}
+// serveChirpPage writes one page of chirps matching query, with viewer flags and paging headers
+func (cfg *apiConfig) serveChirpPage(w http.ResponseWriter, r *http.Request, respBody *RespBody, query ChirpQuery) {
+	chirpPage, err := cfg.DB.QueryChirps(query)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
 	}
 
-	sortCommand := r.URL.Query().Get("sort")
-
-	if sortCommand == "desc" {
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].ID > chirps[j].ID 
-		})
-	} else {
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].ID < chirps[j].ID 
-		})
+	err = cfg.setViewerFlags(viewerID(r), chirpPointers(chirpPage.Chirps)...)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
 	}
 
-	dat, err := json.Marshal(chirps)
+	dat, err := json.Marshal(chirpPage.Chirps)
 	if err != nil {
 		cfg.handlerErrors(w, err, respBody, 500)
 		return
 	}
 
+	nextCursor, prevCursor := chirpPage.cursors(query)
+	writePageHeaders(w, r, nextCursor, prevCursor)
 	w.WriteHeader(200)
 	w.Write(dat)
 }
 
+// parseChirpQuery reads the filter, sort and paging parameters of GET /api/chirps
+func parseChirpQuery(r *http.Request) (ChirpQuery, error){
+	params := r.URL.Query()
+	query := ChirpQuery{}
+
+	switch sortParam := params.Get("sort"); sortParam {
+	case "", "asc", "id":
+	case "desc", "-id":
+		query.Desc = true
+	case "created_at", "-created_at", "updated_at", "-updated_at":
+		query.SortBy = strings.TrimPrefix(sortParam, "-")
+		query.Desc = strings.HasPrefix(sortParam, "-")
+	default:
+		return query, fmt.Errorf("cannot sort by %q, use asc, desc, created_at, updated_at or prefix a key with - for descending", sortParam)
+	}
+
+	limit, err := parseLimit(r)
+	if err != nil {
+		return query, err
+	}
+	query.Limit = limit
+	query.Hashtag = strings.ToLower(strings.TrimPrefix(params.Get("tag"), "#"))
+
+	for name, target := range map[string]*int{"author_id": &query.AuthorID, "since_id": &query.SinceID, "max_id": &query.MaxID} {
+		if params.Get(name) == "" {
+			continue
+		}
+		*target, err = strconv.Atoi(params.Get(name))
+		if err != nil {
+			return query, fmt.Errorf("%s must be a number", name)
+		}
+	}
+
+	for name, target := range map[string]*time.Time{"created_after": &query.CreatedFrom, "created_before": &query.CreatedTo} {
+		if params.Get(name) == "" {
+			continue
+		}
+		*target, err = time.Parse(time.RFC3339, params.Get(name))
+		if err != nil {
+			return query, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+		}
+	}
+
+	query.Contains = params.Get("contains")
+
+	if params.Get("cursor") != "" {
+		cursor, err := decodeCursor(params.Get("cursor"))
+		if err != nil {
+			return query, err
+		}
+		query.Cursor = &cursor
+	}
+
+	return query, nil
+}
+
 func (cfg *apiConfig)handlerReadSingleChirp(w http.ResponseWriter, r *http.Request){
 	w.Header().Set("Content-Type", "application/json")
 	respBody := &RespBody{}
@@ -128,6 +188,12 @@ func (cfg *apiConfig)handlerReadSingleChirp(w http.ResponseWriter, r *http.Reque
 		cfg.handlerErrors(w, err, respBody, 404)
 		return
 	}
+
+	err = cfg.setViewerFlags(viewerID(r), &chirp)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
 	
 	dat, err := json.Marshal(chirp)
 	if err != nil {
@@ -139,15 +205,119 @@ func (cfg *apiConfig)handlerReadSingleChirp(w http.ResponseWriter, r *http.Reque
 	w.Write(dat)
 }
 
-func (cfg *apiConfig)handlerDeleteSingleChirp(w http.ResponseWriter, r *http.Request){
+func (cfg *apiConfig)handlerUpdateChirp(w http.ResponseWriter, r *http.Request){
 	w.Header().Set("Content-Type", "application/json")
 	respBody := &RespBody{}
 
-	userID, err := cfg.handlerAuthenticateWJwt(r)
+	userID := requestPrincipal(r).User.ID
+
+	chirpIDPath := r.PathValue("chirpID")
+	chirpID, err := strconv.Atoi(chirpIDPath)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	type reqParams struct {
+		Body string `json:"body"`
+	}
+	reqBody := reqParams{}
+
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&reqBody)
 	if err != nil {
-		cfg.handlerErrors(w, err, respBody, 401)
+		cfg.handlerErrors(w, err, respBody, 400)
 		return
 	}
+
+	verdict, err := cfg.moderateChirpBody(reqBody.Body)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+	// a published chirp cannot go back into the review queue, so edits that would be held are refused
+	if verdict.Action == ModerationReject || verdict.Action == ModerationHold {
+		cfg.handlerRejectChirp(w, respBody, verdict)
+		return
+	}
+	body := verdict.Body
+
+	chirp, err := cfg.DB.ReadSingleChirp(chirpID)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 404)
+		return
+	}
+
+	if chirp.AuthorID != userID {
+		cfg.handlerErrors(w, errors.New("not authorized to edit this chirp"), respBody, 403)
+		return
+	}
+
+	if time.Since(chirp.CreatedAt) > cfg.chirpEditWindow {
+		cfg.handlerErrors(w, fmt.Errorf("chirps can only be edited within %v of posting", cfg.chirpEditWindow), respBody, 403)
+		return
+	}
+
+	chirp, err = cfg.DB.UpdateChirp(chirpID, body)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	err = cfg.setViewerFlags(userID, &chirp)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	dat, err := json.Marshal(chirp)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig)handlerReadChirpHistory(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	chirpIDPath := r.PathValue("chirpID")
+	chirpID, err := strconv.Atoi(chirpIDPath)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	_, err = cfg.DB.ReadSingleChirp(chirpID)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 404)
+		return
+	}
+
+	revisions, err := cfg.DB.ReadChirpHistory(chirpID)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	dat, err := json.Marshal(revisions)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig)handlerDeleteSingleChirp(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	userID := requestPrincipal(r).User.ID
 	
 	chirpIDPath := r.PathValue("chirpID")
 	chirpID, err := strconv.Atoi(chirpIDPath)
@@ -174,4 +344,12 @@ func (cfg *apiConfig)handlerDeleteSingleChirp(w http.ResponseWriter, r *http.Req
 	}
 	
 	w.WriteHeader(204)
-}
\ No newline at end of file
+}
+
+// moderateChirpBody enforces the length limit and runs the moderation rules over body
+func (cfg *apiConfig) moderateChirpBody(body string) (ModerationVerdict, error){
+	if len(body) > 140 {
+		return ModerationVerdict{}, errors.New("Chirp is too long")
+	}
+	return cfg.moderator.Moderate(body), nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+func (cfg *apiConfig)handlerLikeChirp(w http.ResponseWriter, r *http.Request){
+	cfg.handlerEngageChirp(w, r, cfg.DB.LikeChirp)
+}
+
+func (cfg *apiConfig)handlerUnlikeChirp(w http.ResponseWriter, r *http.Request){
+	cfg.handlerEngageChirp(w, r, cfg.DB.UnlikeChirp)
+}
+
+func (cfg *apiConfig)handlerRechirpChirp(w http.ResponseWriter, r *http.Request){
+	cfg.handlerEngageChirp(w, r, cfg.DB.RechirpChirp)
+}
+
+func (cfg *apiConfig)handlerUnrechirpChirp(w http.ResponseWriter, r *http.Request){
+	cfg.handlerEngageChirp(w, r, cfg.DB.UnrechirpChirp)
+}
+
+// handlerEngageChirp applies a like, rechirp or their undo for the authenticated user and returns the updated chirp
+func (cfg *apiConfig)handlerEngageChirp(w http.ResponseWriter, r *http.Request, engage func(userID int, chirpID int) (Chirp, error)){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	userID := requestPrincipal(r).User.ID
+
+	chirpIDPath := r.PathValue("chirpID")
+	chirpID, err := strconv.Atoi(chirpIDPath)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	chirp, err := engage(userID, chirpID)
+	if errors.Is(err, ErrChirpNotExist) || errors.Is(err, ErrNotLiked) || errors.Is(err, ErrNotRechirped) {
+		cfg.handlerErrors(w, err, respBody, 404)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	err = cfg.setViewerFlags(userID, &chirp)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	dat, err := json.Marshal(chirp)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig)handlerReadChirpLikes(w http.ResponseWriter, r *http.Request){
+	cfg.handlerReadEngagementPage(w, r, cfg.DB.ReadChirpLikes)
+}
+
+func (cfg *apiConfig)handlerReadChirpRechirps(w http.ResponseWriter, r *http.Request){
+	cfg.handlerReadEngagementPage(w, r, cfg.DB.ReadChirpRechirps)
+}
+
+// handlerReadEngagementPage serves one page of the users who liked or rechirped a chirp
+func (cfg *apiConfig)handlerReadEngagementPage(w http.ResponseWriter, r *http.Request, read func(chirpID int, cursor *Cursor, limit int) (EngagementPage, error)){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	chirpIDPath := r.PathValue("chirpID")
+	chirpID, err := strconv.Atoi(chirpIDPath)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	cursor, limit, err := parsePageParams(r)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	engagementPage, err := read(chirpID, cursor, limit)
+	if errors.Is(err, ErrChirpNotExist) {
+		cfg.handlerErrors(w, err, respBody, 404)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	dat, err := json.Marshal(engagementPage.Engagements)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	nextCursor := ""
+	if engagementPage.HasNext {
+		last := engagementPage.Engagements[len(engagementPage.Engagements)-1]
+		nextCursor = encodeCursor(Cursor{ID: last.UserID, At: last.CreatedAt})
+	}
+	writePageHeaders(w, r, nextCursor, "")
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+// setViewerFlags fills in liked_by_me and rechirped_by_me for userID with one lookup per flag for all chirps
+func (cfg *apiConfig) setViewerFlags(userID int, chirps ...*Chirp) error {
+	if userID == 0 || len(chirps) == 0 {
+		return nil
+	}
+
+	chirpIDs := make([]int, 0, len(chirps))
+	for _, chirp := range chirps {
+		chirpIDs = append(chirpIDs, chirp.ID)
+	}
+	liked, err := cfg.DB.ReadLikedChirpIDs(userID, chirpIDs)
+	if err != nil {
+		return err
+	}
+	rechirped, err := cfg.DB.ReadRechirpedChirpIDs(userID, chirpIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, chirp := range chirps {
+		chirp.LikedByMe = liked[chirp.ID]
+		chirp.RechirpedByMe = rechirped[chirp.ID]
+	}
+	return nil
+}
+
+// chirpPointers returns a pointer to every chirp in chirps so their viewer flags can be set in place
+func chirpPointers(chirps []Chirp) []*Chirp {
+	pointers := make([]*Chirp, 0, len(chirps))
+	for i := range chirps {
+		pointers = append(pointers, &chirps[i])
+	}
+	return pointers
+}
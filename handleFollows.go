@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+func (cfg *apiConfig)handlerFollowUser(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	followerID := requestPrincipal(r).User.ID
+
+	userIDPath := r.PathValue("userID")
+	followeeID, err := strconv.Atoi(userIDPath)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	follow, err := cfg.DB.FollowUser(followerID, followeeID)
+	if errors.Is(err, ErrCannotFollowSelf) {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+	if errors.Is(err, ErrUserNotExist) {
+		cfg.handlerErrors(w, err, respBody, 404)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	dat, err := json.Marshal(follow)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig)handlerUnfollowUser(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	followerID := requestPrincipal(r).User.ID
+
+	userIDPath := r.PathValue("userID")
+	followeeID, err := strconv.Atoi(userIDPath)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	err = cfg.DB.UnfollowUser(followerID, followeeID)
+	if errors.Is(err, ErrNotFollowing) {
+		cfg.handlerErrors(w, err, respBody, 404)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (cfg *apiConfig)handlerReadFollowers(w http.ResponseWriter, r *http.Request){
+	cfg.handlerReadFollowPage(w, r, cfg.DB.ReadFollowers, func(follow Follow) int { return follow.FollowerID })
+}
+
+func (cfg *apiConfig)handlerReadFollowing(w http.ResponseWriter, r *http.Request){
+	cfg.handlerReadFollowPage(w, r, cfg.DB.ReadFollowing, func(follow Follow) int { return follow.FolloweeID })
+}
+
+// handlerReadFollowPage serves one page of a follow list, otherID picks the user the cursor is positioned on
+func (cfg *apiConfig)handlerReadFollowPage(w http.ResponseWriter, r *http.Request, read func(userID int, cursor *Cursor, limit int) (FollowPage, error), otherID func(follow Follow) int){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	userIDPath := r.PathValue("userID")
+	userID, err := strconv.Atoi(userIDPath)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	cursor, limit, err := parsePageParams(r)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	followPage, err := read(userID, cursor, limit)
+	if errors.Is(err, ErrUserNotExist) {
+		cfg.handlerErrors(w, err, respBody, 404)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	dat, err := json.Marshal(followPage.Follows)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	nextCursor := ""
+	if followPage.HasNext {
+		last := followPage.Follows[len(followPage.Follows)-1]
+		nextCursor = encodeCursor(Cursor{ID: otherID(last), At: last.CreatedAt})
+	}
+	writePageHeaders(w, r, nextCursor, "")
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig)handlerReadTimeline(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	userID := requestPrincipal(r).User.ID
+
+	cursor, limit, err := parsePageParams(r)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	chirpPage, err := cfg.DB.ReadTimeline(userID, cursor, limit)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	err = cfg.setViewerFlags(userID, chirpPointers(chirpPage.Chirps)...)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	dat, err := json.Marshal(chirpPage.Chirps)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	// the timeline only pages forward, new chirps are picked up by reading it again from the top
+	nextCursor := ""
+	if chirpPage.HasNext {
+		last := chirpPage.Chirps[len(chirpPage.Chirps)-1]
+		at := last.CreatedAt
+		if last.RechirpedAt != nil {
+			at = *last.RechirpedAt
+		}
+		nextCursor = encodeCursor(Cursor{ID: last.ID, At: at})
+	}
+	writePageHeaders(w, r, nextCursor, "")
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+// parsePageParams reads the cursor and limit query parameters of a forward-only list
+func parsePageParams(r *http.Request) (*Cursor, int, error) {
+	limit, err := parseLimit(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.URL.Query().Get("cursor") == "" {
+		return nil, limit, nil
+	}
+	cursor, err := decodeCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		return nil, 0, err
+	}
+	return &cursor, limit, nil
+}
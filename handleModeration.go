@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// handlerRejectChirp refuses a chirp body with the reason codes of the rules it broke
+func (cfg *apiConfig)handlerRejectChirp(w http.ResponseWriter, respBody *RespBody, verdict ModerationVerdict){
+	respBody.Status = "rejected"
+	respBody.Reasons = verdict.Reasons
+	cfg.handlerErrors(w, errChirpRejected, respBody, 400)
+
+	dat, err := json.Marshal(respBody)
+	if err != nil {
+		return
+	}
+	w.Write(dat)
+}
+
+// handlerHoldChirp queues a chirp for review instead of publishing it and answers 202 Accepted
+func (cfg *apiConfig)handlerHoldChirp(w http.ResponseWriter, respBody *RespBody, verdict ModerationVerdict, authorID int, inReplyTo int){
+	held, err := cfg.DB.HoldChirp(verdict.Body, authorID, inReplyTo, verdict.Reasons)
+	if errors.Is(err, ErrParentChirpNotExist) {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	respBody.ID = held.ID
+	respBody.AuthorID = held.AuthorID
+	respBody.Body = held.Body
+	respBody.InReplyTo = held.InReplyTo
+	respBody.Status = "held"
+	respBody.Reasons = held.Reasons
+	respBody.CreatedAt = &held.CreatedAt
+
+	dat, err := json.Marshal(respBody)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(202)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig)handlerReadModerationRules(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	dat, err := json.Marshal(cfg.moderator.Rules())
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig)handlerReplaceModerationRules(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	rules := []ModerationRule{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rules)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	err = cfg.moderator.SetRules(rules)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	dat, err := json.Marshal(cfg.moderator.Rules())
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig)handlerPutModerationRule(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	rule := ModerationRule{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rule)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+	rule.ID = r.PathValue("ruleID")
+
+	err = cfg.moderator.PutRule(rule)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	dat, err := json.Marshal(rule)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig)handlerDeleteModerationRule(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	existed, err := cfg.moderator.DeleteRule(r.PathValue("ruleID"))
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+	if !existed {
+		cfg.handlerErrors(w, errors.New("moderation rule does not exist"), respBody, 404)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (cfg *apiConfig)handlerReadHeldChirps(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	heldChirps, err := cfg.DB.ReadHeldChirps()
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	dat, err := json.Marshal(heldChirps)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig)handlerApproveHeldChirp(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	heldIDPath := r.PathValue("heldID")
+	heldID, err := strconv.Atoi(heldIDPath)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	chirp, err := cfg.DB.ApproveHeldChirp(heldID)
+	if errors.Is(err, ErrHeldChirpNotExist) {
+		cfg.handlerErrors(w, err, respBody, 404)
+		return
+	}
+	// the chirp it replied to may have been deleted while it waited
+	if errors.Is(err, ErrParentChirpNotExist) {
+		cfg.handlerErrors(w, err, respBody, 409)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	dat, err := json.Marshal(chirp)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(201)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig)handlerDiscardHeldChirp(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	heldIDPath := r.PathValue("heldID")
+	heldID, err := strconv.Atoi(heldIDPath)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	err = cfg.DB.DiscardHeldChirp(heldID)
+	if errors.Is(err, ErrHeldChirpNotExist) {
+		cfg.handlerErrors(w, err, respBody, 404)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(204)
+}
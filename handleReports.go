@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// maxReportDetails caps the free text a reporter can add to a report
+const maxReportDetails = 500
+
+var (
+	reportReasons = []string{"spam", "abuse", "harassment", "hate", "misinformation", "other"}
+	reportResolutions = []string{ResolutionDismiss, ResolutionHideChirp, ResolutionSuspendAuthor}
+)
+
+var errAccountSuspended = errors.New("account is suspended")
+
+func (cfg *apiConfig)handlerReportChirp(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	reporterID := requestPrincipal(r).User.ID
+
+	chirpIDPath := r.PathValue("chirpID")
+	chirpID, err := strconv.Atoi(chirpIDPath)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	type reqParams struct {
+		Reason string `json:"reason"`
+		Details string `json:"details"`
+	}
+	reqBody := reqParams{}
+
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&reqBody)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+	if !slices.Contains(reportReasons, reqBody.Reason) {
+		cfg.handlerErrors(w, fmt.Errorf("reason must be one of %v", reportReasons), respBody, 400)
+		return
+	}
+	if len(reqBody.Details) > maxReportDetails {
+		cfg.handlerErrors(w, fmt.Errorf("details can be at most %d bytes", maxReportDetails), respBody, 400)
+		return
+	}
+
+	report, err := cfg.DB.ReportChirp(chirpID, reporterID, reqBody.Reason, reqBody.Details)
+	if errors.Is(err, ErrChirpNotExist) {
+		cfg.handlerErrors(w, err, respBody, 404)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	dat, err := json.Marshal(report)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(201)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig)handlerReadReports(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	// the queue shows open reports unless asked for resolved ones or all of them
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = ReportOpen
+	case "all":
+		status = ""
+	case ReportOpen, ReportResolved:
+	default:
+		cfg.handlerErrors(w, fmt.Errorf("status must be %s, %s or all", ReportOpen, ReportResolved), respBody, 400)
+		return
+	}
+
+	cursor, limit, err := parsePageParams(r)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	reportPage, err := cfg.DB.ReadReports(status, cursor, limit)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	dat, err := json.Marshal(reportPage.Reports)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	nextCursor := ""
+	if reportPage.HasNext {
+		nextCursor = encodeCursor(Cursor{ID: reportPage.Reports[len(reportPage.Reports)-1].ID})
+	}
+	writePageHeaders(w, r, nextCursor, "")
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig)handlerResolveReport(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	reportIDPath := r.PathValue("reportID")
+	reportID, err := strconv.Atoi(reportIDPath)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	type reqParams struct {
+		Action string `json:"action"`
+	}
+	reqBody := reqParams{}
+
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&reqBody)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+	if !slices.Contains(reportResolutions, reqBody.Action) {
+		cfg.handlerErrors(w, fmt.Errorf("action must be one of %v", reportResolutions), respBody, 400)
+		return
+	}
+
+	report, err := cfg.DB.ResolveReport(reportID, reqBody.Action)
+	if errors.Is(err, ErrReportNotExist) {
+		cfg.handlerErrors(w, err, respBody, 404)
+		return
+	}
+	if errors.Is(err, ErrReportResolved) {
+		cfg.handlerErrors(w, err, respBody, 409)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	dat, err := json.Marshal(report)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(dat)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func (cfg *apiConfig)handlerSearchChirps(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+	params := r.URL.Query()
+
+	clauses, err := ParseSearchQuery(params.Get("q"))
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+	query := SearchQuery{Clauses: clauses}
+
+	switch params.Get("sort") {
+	case "", "relevance":
+	case "recent":
+		query.Recent = true
+	default:
+		cfg.handlerErrors(w, fmt.Errorf("cannot sort by %q, use relevance or recent", params.Get("sort")), respBody, 400)
+		return
+	}
+
+	if params.Get("author_id") != "" {
+		query.AuthorID, err = strconv.Atoi(params.Get("author_id"))
+		if err != nil {
+			cfg.handlerErrors(w, fmt.Errorf("author_id must be a number"), respBody, 400)
+			return
+		}
+	}
+
+	query.Cursor, query.Limit, err = parsePageParams(r)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	hits, hasNext := cfg.search.SearchChirps(query)
+	chirpIDs := []int{}
+	for _, hit := range hits {
+		chirpIDs = append(chirpIDs, hit.ChirpID)
+	}
+	chirps, err := cfg.DB.ReadChirpsByIDs(chirpIDs)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	err = cfg.setViewerFlags(viewerID(r), chirpPointers(chirps)...)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	dat, err := json.Marshal(chirps)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	// the cursor is taken from the hits rather than the chirps so that paging survives a chirp deleted meanwhile
+	nextCursor := ""
+	if hasNext {
+		last := hits[len(hits)-1]
+		nextCursor = encodeCursor(Cursor{ID: last.ChirpID, Score: last.Score})
+	}
+	writePageHeaders(w, r, nextCursor, "")
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig)handlerSearchUsers(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	prefix := strings.TrimPrefix(strings.TrimSpace(r.URL.Query().Get("q")), "@")
+	if prefix == "" {
+		cfg.handlerErrors(w, errEmptySearch, respBody, 400)
+		return
+	}
+
+	limit, err := parseLimit(r)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	users, err := cfg.DB.ReadUsersByIDs(cfg.search.SearchUsers(prefix, limit))
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	profiles := []UserProfile{}
+	for _, user := range users {
+		profiles = append(profiles, UserProfile{ID: user.ID, Username: user.Username})
+	}
+
+	dat, err := json.Marshal(profiles)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(dat)
+}
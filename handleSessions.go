@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// maxDeviceName caps the device name a client can give its session at login
+const maxDeviceName = 100
+
+var errDeviceNameTooLong = fmt.Errorf("device_name is longer than %d characters", maxDeviceName)
+
+func (cfg *apiConfig)handlerReadSessions(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	principal := requestPrincipal(r)
+
+	sessions, err := cfg.DB.ReadSessions(principal.User.ID)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == principal.Claims.SessionID
+	}
+
+	dat, err := json.Marshal(sessions)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig)handlerDeleteSession(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	userID := requestPrincipal(r).User.ID
+
+	sessionIDPath := r.PathValue("sessionID")
+	sessionID, err := strconv.Atoi(sessionIDPath)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	err = cfg.DB.DeleteSession(userID, sessionID)
+	if errors.Is(err, ErrSessionNotExist) {
+		cfg.handlerErrors(w, err, respBody, 404)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// handlerDeleteAllSessions logs the user out everywhere, access tokens already issued are refused from now on
+func (cfg *apiConfig)handlerDeleteAllSessions(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	userID := requestPrincipal(r).User.ID
+
+	_, err := cfg.DB.DeleteUserSessions(userID, 0)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// clientIP returns the address a request came from, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+func (cfg *apiConfig)handlerReadTagChirps(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	query, err := parseChirpQuery(r)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+	// a tag page reads like a feed, newest first unless asked otherwise
+	if r.URL.Query().Get("sort") == "" {
+		query.Desc = true
+	}
+	query.Hashtag = strings.ToLower(strings.TrimPrefix(r.PathValue("tag"), "#"))
+
+	cfg.serveChirpPage(w, r, respBody, query)
+}
+
+func (cfg *apiConfig)handlerReadMentions(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	userID := requestPrincipal(r).User.ID
+
+	query, err := parseChirpQuery(r)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+	// newest first by default, clients poll with since_id to notify about new mentions
+	if r.URL.Query().Get("sort") == "" {
+		query.Desc = true
+	}
+	query.MentionedUserID = userID
+
+	cfg.serveChirpPage(w, r, respBody, query)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+const (
+	defaultThreadDepth = 3
+	maxThreadDepth = 10
+	nestedReplyLimit = 10
+)
+
+func (cfg *apiConfig)handlerReadChirpThread(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	chirpIDPath := r.PathValue("chirpID")
+	chirpID, err := strconv.Atoi(chirpIDPath)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	query := ChirpQuery{InReplyTo: chirpID, IncludeDeleted: true}
+	query.Limit, err = parseLimit(r)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+	if r.URL.Query().Get("cursor") != "" {
+		cursor, err := decodeCursor(r.URL.Query().Get("cursor"))
+		if err != nil {
+			cfg.handlerErrors(w, err, respBody, 400)
+			return
+		}
+		query.Cursor = &cursor
+	}
+
+	depth := defaultThreadDepth
+	if r.URL.Query().Get("depth") != "" {
+		depth, err = strconv.Atoi(r.URL.Query().Get("depth"))
+		if err != nil || depth < 1 || depth > maxThreadDepth {
+			cfg.handlerErrors(w, fmt.Errorf("depth must be between 1 and %d", maxThreadDepth), respBody, 400)
+			return
+		}
+	}
+
+	lineage, err := cfg.DB.ReadChirpLineage(chirpID)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 404)
+		return
+	}
+
+	thread := ChirpThread{Chirp: lineage[0], Ancestors: lineage[1:]}
+	slices.Reverse(thread.Ancestors)
+
+	replyPage, err := cfg.DB.QueryChirps(query)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	thread.Replies, err = cfg.loadReplyTree(replyPage.Chirps, depth-1)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	err = cfg.setViewerFlags(viewerID(r), thread.chirps()...)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	dat, err := json.Marshal(thread)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	nextCursor, prevCursor := replyPage.cursors(query)
+	writePageHeaders(w, r, nextCursor, prevCursor)
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+// loadReplyTree wraps chirps into thread nodes and loads up to depth more levels of replies beneath them.
+// Each nested level holds at most nestedReplyLimit replies, the rest are left to a thread request on that reply.
+func (cfg *apiConfig) loadReplyTree(chirps []Chirp, depth int) ([]ChirpThreadNode, error){
+	nodes := []ChirpThreadNode{}
+
+	for _, chirp := range chirps {
+		node := ChirpThreadNode{Chirp: chirp, MoreReplies: chirp.ReplyCount > 0}
+		if depth > 0 && chirp.ReplyCount > 0 {
+			replyPage, err := cfg.DB.QueryChirps(ChirpQuery{InReplyTo: chirp.ID, IncludeDeleted: true, Limit: nestedReplyLimit})
+			if err != nil {
+				return nodes, err
+			}
+			node.Replies, err = cfg.loadReplyTree(replyPage.Chirps, depth-1)
+			if err != nil {
+				return nodes, err
+			}
+			node.MoreReplies = replyPage.HasNext
+		}
+		nodes = append(nodes, node)
+	}
+
+	return nodes, nil
+}
+
+// chirps returns a pointer to every chirp in the thread, ancestors and nested replies included
+func (thread *ChirpThread) chirps() []*Chirp {
+	chirps := append(chirpPointers(thread.Ancestors), &thread.Chirp)
+	var walk func(nodes []ChirpThreadNode)
+	walk = func(nodes []ChirpThreadNode) {
+		for i := range nodes {
+			chirps = append(chirps, &nodes[i].Chirp)
+			walk(nodes[i].Replies)
+		}
+	}
+	walk(thread.Replies)
+	return chirps
+}
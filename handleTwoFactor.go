@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	errInvalidTwoFactorCode = errors.New("invalid two-factor code")
+	errTwoFactorEnabled = errors.New("two-factor authentication is already enabled")
+	errTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+	errNoTwoFactorEnrollment = errors.New("no two-factor enrollment in progress, start one with POST /api/users/me/2fa")
+	errCurrentPasswordRequiredForTwoFactor = errors.New("current_password is required to turn off two-factor authentication")
+)
+
+// handlerStartTwoFactor creates a new TOTP secret for the user, it only takes effect once a first code
+// from it is verified, so calling it again simply restarts the enrollment
+func (cfg *apiConfig)handlerStartTwoFactor(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	user := requestPrincipal(r).User
+	if user.TwoFactor.Enabled {
+		cfg.handlerErrors(w, errTwoFactorEnabled, respBody, 409)
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+	_, err = cfg.DB.UpdateUserTwoFactor(user.ID, TwoFactor{Secret: secret})
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	type enrollment struct {
+		Secret string `json:"secret"`
+		ProvisioningURI string `json:"provisioning_uri"`
+	}
+	dat, err := json.Marshal(enrollment{Secret: secret, ProvisioningURI: totpProvisioningURI(secret, user.Email)})
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(201)
+	w.Write(dat)
+}
+
+// handlerVerifyTwoFactor enables 2FA once the user proves their authenticator app produces codes for the
+// new secret, and answers with the recovery codes, which are never shown again
+func (cfg *apiConfig)handlerVerifyTwoFactor(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	type reqParams struct {
+		Code string `json:"code"`
+	}
+	reqBody := reqParams{}
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&reqBody)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	user := requestPrincipal(r).User
+	if user.TwoFactor.Enabled {
+		cfg.handlerErrors(w, errTwoFactorEnabled, respBody, 409)
+		return
+	}
+	if user.TwoFactor.Secret == "" {
+		cfg.handlerErrors(w, errNoTwoFactorEnrollment, respBody, 409)
+		return
+	}
+
+	step, ok := verifyTOTP(user.TwoFactor.Secret, reqBody.Code, time.Now())
+	if !ok {
+		cfg.handlerErrors(w, errInvalidTwoFactorCode, respBody, 400)
+		return
+	}
+
+	recoveryCodes, recoveryCodeHashes, err := newRecoveryCodes()
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+	_, err = cfg.DB.UpdateUserTwoFactor(user.ID, TwoFactor{Secret: user.TwoFactor.Secret, Enabled: true, RecoveryCodeHashes: recoveryCodeHashes, LastStep: step})
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	type enabled struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	dat, err := json.Marshal(enabled{RecoveryCodes: recoveryCodes})
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+// handlerDisableTwoFactor turns 2FA off, it takes the current password and a current code or a recovery
+// code so that neither a stolen access token nor a stolen phone alone can remove the second factor
+func (cfg *apiConfig)handlerDisableTwoFactor(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	type reqParams struct {
+		CurrentPassword string `json:"current_password"`
+		Code string `json:"code"`
+	}
+	reqBody := reqParams{}
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&reqBody)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	user := requestPrincipal(r).User
+	if !user.TwoFactor.Enabled {
+		cfg.handlerErrors(w, errTwoFactorNotEnabled, respBody, 409)
+		return
+	}
+	if reqBody.CurrentPassword == "" {
+		cfg.handlerErrors(w, errCurrentPasswordRequiredForTwoFactor, respBody, 400)
+		return
+	}
+
+	// one attempt covers both checks, and guessing either counts against the account like a login
+	if cfg.handlerLoginThrottled(w, respBody, user.Email, clientIP(r)) {
+		return
+	}
+	match, err := checkPassword(user.HashedPassword, reqBody.CurrentPassword)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+	if !match {
+		cfg.handlerErrors(w, errWrongCurrentPassword, respBody, 403)
+		return
+	}
+	err = cfg.checkTwoFactorCode(user, reqBody.Code)
+	if errors.Is(err, errInvalidTwoFactorCode) || errors.Is(err, ErrTwoFactorCodeUsed) {
+		cfg.handlerErrors(w, err, respBody, 401)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+	cfg.loginThrottle.Refund(user.Email, clientIP(r))
+
+	_, err = cfg.DB.UpdateUserTwoFactor(user.ID, TwoFactor{})
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// handlerLoginTwoFactor is the second step of a login with 2FA, it trades the challenge token from
+// POST /api/login and a code for the same tokens a login without 2FA returns
+func (cfg *apiConfig)handlerLoginTwoFactor(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	type reqParams struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code string `json:"code"`
+		Expires_in_seconds int `json:"expires_in_seconds"`
+		DeviceName string `json:"device_name"`
+	}
+	reqBody := reqParams{}
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&reqBody)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+	if len(reqBody.DeviceName) > maxDeviceName {
+		cfg.handlerErrors(w, errDeviceNameTooLong, respBody, 400)
+		return
+	}
+
+	claims, err := cfg.parseToken(reqBody.ChallengeToken, TokenUseTwoFactorChallenge)
+	if err != nil {
+		cfg.handlerTokenErrors(w, err, respBody)
+		return
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		cfg.handlerTokenErrors(w, err, respBody)
+		return
+	}
+
+	user, err := cfg.DB.ReadSingleUser(userID)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 401)
+		return
+	}
+	if user.Suspended {
+		cfg.handlerErrors(w, errAccountSuspended, respBody, 403)
+		return
+	}
+	// 2FA was reset while the challenge was pending, the client has to log in again
+	if !user.TwoFactor.Enabled {
+		cfg.handlerErrors(w, errTwoFactorNotEnabled, respBody, 401)
+		return
+	}
+
+	// guessing codes counts against the account like guessing passwords, or six digits would not last long
+	if cfg.handlerLoginThrottled(w, respBody, user.Email, clientIP(r)) {
+		return
+	}
+	err = cfg.checkTwoFactorCode(user, reqBody.Code)
+	if errors.Is(err, errInvalidTwoFactorCode) || errors.Is(err, ErrTwoFactorCodeUsed) {
+		cfg.handlerErrors(w, err, respBody, 401)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+	cfg.loginThrottle.Refund(user.Email, clientIP(r))
+
+	cfg.handlerStartSession(w, r, respBody, user, reqBody.DeviceName, claims.Audience[0], reqBody.Expires_in_seconds)
+}
+
+// handlerResetTwoFactor lets an admin turn off 2FA for a user who lost their authenticator and recovery codes
+func (cfg *apiConfig)handlerResetTwoFactor(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	userIDPath := r.PathValue("userID")
+	userID, err := strconv.Atoi(userIDPath)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	_, err = cfg.DB.UpdateUserTwoFactor(userID, TwoFactor{})
+	if errors.Is(err, ErrUserNotExist) {
+		cfg.handlerErrors(w, err, respBody, 404)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+	log.Printf("security: admin %d reset two-factor authentication of user %d", requestPrincipal(r).User.ID, userID)
+
+	w.WriteHeader(204)
+}
+
+// checkTwoFactorCode accepts a TOTP code or one of the user's recovery codes and uses it up
+func (cfg *apiConfig)checkTwoFactorCode(user User, code string) error{
+	if isTOTPCode(code) {
+		step, ok := verifyTOTP(user.TwoFactor.Secret, code, time.Now())
+		if !ok {
+			return errInvalidTwoFactorCode
+		}
+		return cfg.DB.ConsumeTwoFactorStep(user.ID, step)
+	}
+
+	_, err := cfg.DB.ConsumeRecoveryCode(user.ID, hashRecoveryCode(code))
+	if errors.Is(err, ErrRecoveryCodeNotExist) {
+		return errInvalidTwoFactorCode
+	}
+	return err
+}
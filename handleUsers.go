@@ -2,10 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 func (cfg *apiConfig) handlerCreateUsers(w http.ResponseWriter, r *http.Request) {
@@ -14,6 +15,7 @@ func (cfg *apiConfig) handlerCreateUsers(w http.ResponseWriter, r *http.Request)
 
 	type reqParams struct {
 		Email string `json:"email"`
+		Username string `json:"username"`
 		Password string `json:"password"`
 	}
 	reqBody := reqParams{}
@@ -25,21 +27,49 @@ func (cfg *apiConfig) handlerCreateUsers(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(reqBody.Password), 1)
+	err = validateEmail(reqBody.Email)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+	err = validateUsername(reqBody.Username)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	hashedPassword, err := cfg.hashNewPassword(reqBody.Password)
+	if errors.Is(err, errWeakPassword) {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
 	if err != nil {
 		cfg.handlerErrors(w, err, respBody, 500)
 		return
 	}
 
-	user, err := cfg.DB.CreateUsers(reqBody.Email, hashedPassword)
+	user, err := cfg.DB.CreateUsers(reqBody.Email, reqBody.Username, hashedPassword)
+	if errors.Is(err, ErrUserEmailTaken) || errors.Is(err, ErrUsernameTaken) {
+		cfg.handlerErrors(w, err, respBody, 409)
+		return
+	}
 	if err != nil {
 		cfg.handlerErrors(w, err, respBody, 500)
 		return
 	}
 	
+	err = cfg.sendEmailVerification(user)
+	if err != nil {
+		log.Printf("could not send the email verification of user %d: %v", user.ID, err)
+	}
+	
 	respBody.ID = user.ID
 	respBody.Email = user.Email
+	respBody.EmailVerified = user.EmailVerified
+	respBody.Username = user.Username
 	respBody.IsChirpyRed = false
+	respBody.CreatedAt = &user.CreatedAt
+	respBody.UpdatedAt = &user.UpdatedAt
 	
 	dat, err := json.Marshal(respBody)
 	if err != nil {
@@ -51,43 +81,54 @@ func (cfg *apiConfig) handlerCreateUsers(w http.ResponseWriter, r *http.Request)
 	w.Write(dat)
 }
 
+// handlerModifyUsers replaces the email and password of the signed-in user. It is deprecated in favour of
+// PATCH /api/users/me and kept working for older clients, which do not send current_password: it is only
+// checked when present. A new password still signs out every other session.
 func (cfg *apiConfig) handlerModifyUsers(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", `</api/users/me>; rel="successor-version"`)
 	respBody := &RespBody{}
 
-	userID, err := cfg.handlerAuthenticateWJwt(r)
-	if err != nil {
-		cfg.handlerErrors(w, err, respBody, 401)
-		return
-	}
-
 	type reqParams struct {
 		Email string `json:"email"`
+		Username string `json:"username"`
 		Password string `json:"password"`
+		CurrentPassword string `json:"current_password"`
 	}
 	reqBody := reqParams{}
 
 	decoder := json.NewDecoder(r.Body)
-	err = decoder.Decode(&reqBody)
-	if err != nil {
-		cfg.handlerErrors(w, err, respBody, 500)
-		return
-	}
-	
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(reqBody.Password), 1)
+	err := decoder.Decode(&reqBody)
 	if err != nil {
 		cfg.handlerErrors(w, err, respBody, 500)
 		return
 	}
 
-	user, err := cfg.DB.UpdateUser(reqBody.Email, hashedPassword, userID)
-	if err != nil {
-		cfg.handlerErrors(w, err, respBody, 500)
+	// empty fields keep their current value, as they always did for the username
+	var username, password *string
+	if reqBody.Username != "" {
+		username = &reqBody.Username
+	}
+	if reqBody.Password != "" {
+		password = &reqBody.Password
+	}
+	var currentPassword *string
+	if reqBody.CurrentPassword != "" {
+		currentPassword = &reqBody.CurrentPassword
+	}
+	user, ok := cfg.handlerUpdateAccount(w, r, respBody, &reqBody.Email, username, password, currentPassword)
+	if !ok {
 		return
 	}
 	
 	respBody.ID = user.ID
 	respBody.Email = user.Email
+	respBody.EmailVerified = user.EmailVerified
+	respBody.Username = user.Username
+	respBody.IsChirpyRed = user.IsChirpyRed
+	respBody.CreatedAt = &user.CreatedAt
+	respBody.UpdatedAt = &user.UpdatedAt
 	
 	dat, err := json.Marshal(respBody)
 	if err != nil {
@@ -127,8 +168,9 @@ func (cfg *apiConfig) handlerPolkaUserUpgrade(w http.ResponseWriter, r *http.Req
 	if reqBody.Event == "user.upgraded" {
 		_, err := cfg.DB.UpgradeUser(reqBody.Data.UserID)
 		if err != nil {
-			if err.Error() == "User does not exist"{
+			if errors.Is(err, ErrUserNotExist) {
 				cfg.handlerErrors(w, err, respBody, 404)
+				return
 			}
 			cfg.handlerErrors(w, err, respBody, 500)
 			return
@@ -143,4 +185,266 @@ func (cfg *apiConfig) handlerPolkaUserUpgrade(w http.ResponseWriter, r *http.Req
 	
 	w.WriteHeader(204)
 	w.Write(dat)
-}
\ No newline at end of file
+}
+func (cfg *apiConfig)handlerUpdateUserRole(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	userIDPath := r.PathValue("userID")
+	userID, err := strconv.Atoi(userIDPath)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	type reqParams struct {
+		Role string `json:"role"`
+	}
+	reqBody := reqParams{}
+
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&reqBody)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+	err = validateRole(reqBody.Role)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	user, err := cfg.DB.UpdateUserRole(userID, reqBody.Role)
+	if errors.Is(err, ErrUserNotExist) {
+		cfg.handlerErrors(w, err, respBody, 404)
+		return
+	}
+	if errors.Is(err, ErrLastAdmin) {
+		cfg.handlerErrors(w, err, respBody, 409)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	dat, err := json.Marshal(UserProfile{ID: user.ID, Email: user.Email, Username: user.Username, Role: user.Role})
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+// handlerUnlockUser lets an admin lift a login lockout of a user before it runs out
+func (cfg *apiConfig)handlerUnlockUser(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	userIDPath := r.PathValue("userID")
+	userID, err := strconv.Atoi(userIDPath)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	user, err := cfg.DB.ReadSingleUser(userID)
+	if errors.Is(err, ErrUserNotExist) {
+		cfg.handlerErrors(w, err, respBody, 404)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	if cfg.loginThrottle.Unlock(user.Email) {
+		log.Printf("security: admin %d unlocked logins for user %d", requestPrincipal(r).User.ID, userID)
+	}
+
+	w.WriteHeader(204)
+}
+
+// handlerUnsuspendUser lets an admin lift the suspension of a user, their chirps become readable again
+func (cfg *apiConfig)handlerUnsuspendUser(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	userIDPath := r.PathValue("userID")
+	userID, err := strconv.Atoi(userIDPath)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	_, err = cfg.DB.UpdateUserSuspended(userID, false)
+	if errors.Is(err, ErrUserNotExist) {
+		cfg.handlerErrors(w, err, respBody, 404)
+		return
+	}
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+	log.Printf("security: admin %d lifted the suspension of user %d", requestPrincipal(r).User.ID, userID)
+
+	w.WriteHeader(204)
+}
+
+var (
+	errCurrentPasswordRequired = errors.New("current_password is required to change the email or password")
+	errWrongCurrentPassword = errors.New("current_password is incorrect")
+	errUsernameRequired = errors.New("username cannot be removed")
+)
+
+// handlerPatchMe updates the fields of the signed-in user that the request names and leaves the rest alone
+func (cfg *apiConfig)handlerPatchMe(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "application/json")
+	respBody := &RespBody{}
+
+	type reqParams struct {
+		Email *string `json:"email"`
+		Username *string `json:"username"`
+		Password *string `json:"password"`
+		CurrentPassword string `json:"current_password"`
+	}
+	reqBody := reqParams{}
+
+	decoder := json.NewDecoder(r.Body)
+	// a misspelt field would otherwise be a silent no-op
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&reqBody)
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 400)
+		return
+	}
+
+	user, ok := cfg.handlerUpdateAccount(w, r, respBody, reqBody.Email, reqBody.Username, reqBody.Password, &reqBody.CurrentPassword)
+	if !ok {
+		return
+	}
+
+	dat, err := json.Marshal(UserAccount{
+		ID: user.ID,
+		Email: user.Email,
+		EmailVerified: user.EmailVerified,
+		Username: user.Username,
+		IsChirpyRed: user.IsChirpyRed,
+		Role: user.Role,
+		TwoFactorEnabled: user.TwoFactor.Enabled,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+	})
+	if err != nil {
+		cfg.handlerErrors(w, err, respBody, 500)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+// handlerUpdateAccount changes the fields of the signed-in user that are not nil and returns the updated
+// user, or answers with an error and reports false. Changing the email or password takes the current
+// password, so that a stolen access token is not enough to take the account over, unless currentPassword
+// is nil, which only the deprecated PUT /api/users passes. A new password signs out every other session.
+func (cfg *apiConfig)handlerUpdateAccount(w http.ResponseWriter, r *http.Request, respBody *RespBody, email *string, username *string, password *string, currentPassword *string) (User, bool){
+	principal := requestPrincipal(r)
+	user := principal.User
+
+	newEmail, newUsername := "", ""
+	if email != nil && *email != user.Email {
+		err := validateEmail(*email)
+		if err != nil {
+			cfg.handlerErrors(w, err, respBody, 400)
+			return user, false
+		}
+		newEmail = *email
+	}
+	if username != nil {
+		if *username == "" {
+			cfg.handlerErrors(w, errUsernameRequired, respBody, 400)
+			return user, false
+		}
+		err := validateUsername(*username)
+		if err != nil {
+			cfg.handlerErrors(w, err, respBody, 400)
+			return user, false
+		}
+		newUsername = *username
+	}
+	if password != nil {
+		err := cfg.passwordPolicy.Check(*password)
+		if err != nil {
+			cfg.handlerErrors(w, err, respBody, 400)
+			return user, false
+		}
+	}
+
+	if (newEmail != "" || password != nil) && currentPassword != nil {
+		if *currentPassword == "" {
+			cfg.handlerErrors(w, errCurrentPasswordRequired, respBody, 400)
+			return user, false
+		}
+		// guessing the current password counts against the account like guessing it at login
+		if cfg.handlerLoginThrottled(w, respBody, user.Email, clientIP(r)) {
+			return user, false
+		}
+		match, err := checkPassword(user.HashedPassword, *currentPassword)
+		if err != nil {
+			cfg.handlerErrors(w, err, respBody, 500)
+			return user, false
+		}
+		if !match {
+			cfg.handlerErrors(w, errWrongCurrentPassword, respBody, 403)
+			return user, false
+		}
+		cfg.loginThrottle.Refund(user.Email, clientIP(r))
+	}
+
+	// hashed only once the current password checked out, hashing is the expensive part
+	var newHashedPassword []byte
+	if password != nil {
+		var err error
+		newHashedPassword, err = cfg.hashNewPassword(*password)
+		if errors.Is(err, errWeakPassword) {
+			cfg.handlerErrors(w, err, respBody, 400)
+			return user, false
+		}
+		if err != nil {
+			cfg.handlerErrors(w, err, respBody, 500)
+			return user, false
+		}
+	}
+
+	if newEmail != "" || newUsername != "" || newHashedPassword != nil {
+		var err error
+		user, err = cfg.DB.UpdateUser(newEmail, newUsername, newHashedPassword, user.ID)
+		if errors.Is(err, ErrUserEmailTaken) || errors.Is(err, ErrUsernameTaken) {
+			cfg.handlerErrors(w, err, respBody, 409)
+			return user, false
+		}
+		if err != nil {
+			cfg.handlerErrors(w, err, respBody, 500)
+			return user, false
+		}
+	}
+
+	if newHashedPassword != nil {
+		revoked, err := cfg.DB.DeleteUserSessions(user.ID, principal.Claims.SessionID)
+		if err != nil {
+			cfg.handlerErrors(w, err, respBody, 500)
+			return user, false
+		}
+		log.Printf("security: user %d changed their password, revoked %d other sessions", user.ID, revoked)
+	}
+	if newEmail != "" {
+		err := cfg.sendEmailVerification(user)
+		if err != nil {
+			log.Printf("could not send the email verification of user %d: %v", user.ID, err)
+		}
+	}
+	return user, true
+}
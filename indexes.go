@@ -0,0 +1,250 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+// followKey is the key of a follow in DBStructure.Follows
+func followKey(followerID int, followeeID int) string {
+	return fmt.Sprintf("%d:%d", followerID, followeeID)
+}
+
+// engagementKey is the key of a like or rechirp in DBStructure.Likes and DBStructure.Rechirps
+func engagementKey(chirpID int, userID int) string {
+	return fmt.Sprintf("%d:%d", chirpID, userID)
+}
+
+// engagements returns the table of likes or rechirps
+func (dbStructure *DBStructure) engagements(table string) map[string]Engagement {
+	if table == "rechirps" {
+		return dbStructure.Rechirps
+	}
+	return dbStructure.Likes
+}
+
+// engagedBy returns the index from a chirp to the users who liked or rechirped it
+func (dbStructure *DBStructure) engagedBy(table string) map[int]map[int]bool {
+	if table == "rechirps" {
+		return dbStructure.indexes.rechirpers
+	}
+	return dbStructure.indexes.likers
+}
+
+// rebuildIndexes derives every index from the tables, used after loading or replaying the log
+func (dbStructure *DBStructure) rebuildIndexes() {
+	dbStructure.indexes = dbIndexes{
+		chirpsByAuthor: map[int][]int{},
+		repliesByParent: map[int][]int{},
+		following: map[int]map[int]bool{},
+		followers: map[int]map[int]bool{},
+		likers: map[int]map[int]bool{},
+		rechirpers: map[int]map[int]bool{},
+		rechirpsByUser: map[int][]Engagement{},
+	}
+	for _, chirp := range dbStructure.Chirps {
+		dbStructure.indexes.chirpsByAuthor[chirp.AuthorID] = append(dbStructure.indexes.chirpsByAuthor[chirp.AuthorID], chirp.ID)
+		if chirp.InReplyTo != 0 {
+			dbStructure.indexes.repliesByParent[chirp.InReplyTo] = append(dbStructure.indexes.repliesByParent[chirp.InReplyTo], chirp.ID)
+		}
+	}
+	for _, chirpIDs := range dbStructure.indexes.chirpsByAuthor {
+		slices.Sort(chirpIDs)
+	}
+	for _, chirpIDs := range dbStructure.indexes.repliesByParent {
+		slices.Sort(chirpIDs)
+	}
+	for _, follow := range dbStructure.Follows {
+		dbStructure.indexFollow(follow)
+	}
+	for _, like := range dbStructure.Likes {
+		dbStructure.indexEngagement("likes", like)
+	}
+	for _, rechirp := range dbStructure.Rechirps {
+		dbStructure.indexEngagement("rechirps", rechirp)
+	}
+}
+
+// indexChirp adds a new chirp to its author's sorted list and to its parent's replies
+func (dbStructure *DBStructure) indexChirp(chirp Chirp) {
+	dbStructure.indexes.chirpsByAuthor[chirp.AuthorID] = insertSortedID(dbStructure.indexes.chirpsByAuthor[chirp.AuthorID], chirp.ID)
+	if chirp.InReplyTo != 0 {
+		dbStructure.indexes.repliesByParent[chirp.InReplyTo] = insertSortedID(dbStructure.indexes.repliesByParent[chirp.InReplyTo], chirp.ID)
+	}
+}
+
+// unindexChirp reverses indexChirp
+func (dbStructure *DBStructure) unindexChirp(chirp Chirp) {
+	dbStructure.indexes.chirpsByAuthor[chirp.AuthorID] = deleteSortedID(dbStructure.indexes.chirpsByAuthor[chirp.AuthorID], chirp.ID)
+	if chirp.InReplyTo != 0 {
+		dbStructure.indexes.repliesByParent[chirp.InReplyTo] = deleteSortedID(dbStructure.indexes.repliesByParent[chirp.InReplyTo], chirp.ID)
+	}
+}
+
+// insertSortedID adds id to a sorted list of IDs unless it is already there
+func insertSortedID(ids []int, id int) []int {
+	i, found := slices.BinarySearch(ids, id)
+	if found {
+		return ids
+	}
+	return slices.Insert(ids, i, id)
+}
+
+// deleteSortedID removes id from a sorted list of IDs
+func deleteSortedID(ids []int, id int) []int {
+	i, found := slices.BinarySearch(ids, id)
+	if !found {
+		return ids
+	}
+	return slices.Delete(ids, i, i+1)
+}
+
+// queryCandidates returns the IDs of the chirps a query can match when an index narrows them down,
+// ok is false when every chirp has to be scanned
+func (dbStructure *DBStructure) queryCandidates(query ChirpQuery) (chirpIDs []int, ok bool) {
+	if query.InReplyTo != 0 {
+		return dbStructure.indexes.repliesByParent[query.InReplyTo], true
+	}
+	if query.AuthorID != 0 {
+		return dbStructure.indexes.chirpsByAuthor[query.AuthorID], true
+	}
+	return nil, false
+}
+
+// indexFollow records a follow in both directions
+func (dbStructure *DBStructure) indexFollow(follow Follow) {
+	if dbStructure.indexes.following[follow.FollowerID] == nil {
+		dbStructure.indexes.following[follow.FollowerID] = map[int]bool{}
+	}
+	if dbStructure.indexes.followers[follow.FolloweeID] == nil {
+		dbStructure.indexes.followers[follow.FolloweeID] = map[int]bool{}
+	}
+	dbStructure.indexes.following[follow.FollowerID][follow.FolloweeID] = true
+	dbStructure.indexes.followers[follow.FolloweeID][follow.FollowerID] = true
+}
+
+// unindexFollow forgets a follow in both directions
+func (dbStructure *DBStructure) unindexFollow(follow Follow) {
+	delete(dbStructure.indexes.following[follow.FollowerID], follow.FolloweeID)
+	delete(dbStructure.indexes.followers[follow.FolloweeID], follow.FollowerID)
+}
+
+// indexEngagement records who liked or rechirped a chirp, and adds rechirps to the user's sorted list
+func (dbStructure *DBStructure) indexEngagement(table string, engagement Engagement) {
+	engagedBy := dbStructure.engagedBy(table)
+	if engagedBy[engagement.ChirpID] == nil {
+		engagedBy[engagement.ChirpID] = map[int]bool{}
+	}
+	engagedBy[engagement.ChirpID][engagement.UserID] = true
+
+	if table == "rechirps" {
+		rechirps := dbStructure.indexes.rechirpsByUser[engagement.UserID]
+		i := sort.Search(len(rechirps), func(i int) bool { return !entryBefore(rechirps[i].CreatedAt, rechirps[i].ChirpID, engagement.CreatedAt, engagement.ChirpID) })
+		dbStructure.indexes.rechirpsByUser[engagement.UserID] = slices.Insert(rechirps, i, engagement)
+	}
+}
+
+// unindexEngagement reverses indexEngagement
+func (dbStructure *DBStructure) unindexEngagement(table string, engagement Engagement) {
+	delete(dbStructure.engagedBy(table)[engagement.ChirpID], engagement.UserID)
+
+	if table == "rechirps" {
+		dbStructure.indexes.rechirpsByUser[engagement.UserID] = slices.DeleteFunc(dbStructure.indexes.rechirpsByUser[engagement.UserID], func(rechirp Engagement) bool {
+			return rechirp.ChirpID == engagement.ChirpID
+		})
+	}
+}
+
+// entryBefore reports whether the timeline position (atA, idA) is older than (atB, idB)
+func entryBefore(atA time.Time, idA int, atB time.Time, idB int) bool {
+	if !atA.Equal(atB) {
+		return atA.Before(atB)
+	}
+	return idA < idB
+}
+
+// timelineEntry is a chirp as it appears on a timeline, posted at at by its author or rechirped at at by rechirpedBy
+type timelineEntry struct {
+	at time.Time
+	chirpID int
+	rechirpedBy int
+}
+
+// timelineStream walks one user's chirps or rechirps from newest to oldest
+type timelineStream struct {
+	entry func(i int) timelineEntry
+	next int
+}
+
+// timelineHeap is a max-heap of timeline streams ordered by their next entry
+type timelineHeap []*timelineStream
+
+func (h timelineHeap) Len() int { return len(h) }
+func (h timelineHeap) Less(i, j int) bool {
+	a, b := h[i].entry(h[i].next), h[j].entry(h[j].next)
+	return entryBefore(b.at, b.chirpID, a.at, a.chirpID)
+}
+func (h timelineHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *timelineHeap) Push(x any) { *h = append(*h, x.(*timelineStream)) }
+func (h *timelineHeap) Pop() any {
+	old := *h
+	stream := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return stream
+}
+
+// mergeTimeline merges the chirps and rechirps of several users newest first, starting below cursor when it
+// is not nil, and stops after limit live chirps. Chirp IDs are handed out in creation order so each user's
+// lists are already sorted; finding the cursor costs one binary search per list, so the work grows with the
+// page size and the log of the user count rather than with everything they posted.
+func (dbStructure *DBStructure) mergeTimeline(userIDs []int, cursor *Cursor, limit int) []Chirp {
+	streams := timelineHeap{}
+	addStream := func(size int, entry func(i int) timelineEntry) {
+		next := size - 1
+		if cursor != nil {
+			next = sort.Search(size, func(i int) bool {
+				e := entry(i)
+				return !entryBefore(e.at, e.chirpID, cursor.At, cursor.ID)
+			}) - 1
+		}
+		if next >= 0 {
+			streams = append(streams, &timelineStream{entry: entry, next: next})
+		}
+	}
+	for _, userID := range userIDs {
+		chirpIDs := dbStructure.indexes.chirpsByAuthor[userID]
+		addStream(len(chirpIDs), func(i int) timelineEntry {
+			return timelineEntry{at: dbStructure.Chirps[chirpIDs[i]].CreatedAt, chirpID: chirpIDs[i]}
+		})
+		rechirps := dbStructure.indexes.rechirpsByUser[userID]
+		addStream(len(rechirps), func(i int) timelineEntry {
+			return timelineEntry{at: rechirps[i].CreatedAt, chirpID: rechirps[i].ChirpID, rechirpedBy: rechirps[i].UserID}
+		})
+	}
+	heap.Init(&streams)
+
+	merged := []Chirp{}
+	for streams.Len() > 0 && len(merged) < limit {
+		stream := streams[0]
+		entry := stream.entry(stream.next)
+		chirp, exist := dbStructure.Chirps[entry.chirpID]
+		if exist && chirp.visible() {
+			if entry.rechirpedBy != 0 {
+				chirp.RechirpedBy = entry.rechirpedBy
+				chirp.RechirpedAt = &entry.at
+			}
+			merged = append(merged, chirp)
+		}
+
+		stream.next--
+		if stream.next < 0 {
+			heap.Pop(&streams)
+		} else {
+			heap.Fix(&streams, 0)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Signing algorithms an access token can be signed with
+const (
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmRS256 = "RS256"
+)
+
+// kidTimeLayout starts every key ID, so key IDs sort by creation time
+const kidTimeLayout = "20060102T150405Z"
+
+// keyRetention is how long a key keeps verifying tokens after a newer key took over signing. It outlives
+// the longest lived token the keys sign, email verification links included, plus the publish lead time.
+const keyRetention = max(MAXDURATION, twoFactorChallengeLife, emailVerificationLife, passwordResetLife) + jwksMaxAge
+
+// jwksMaxAge is how long verifiers may cache the published keys, a new key is published for that long before
+// it signs anything
+const jwksMaxAge = 5 * time.Minute
+
+// keyCheckInterval is how often the key directory is reloaded and the signing key checked for rotation
+const keyCheckInterval = time.Minute
+
+var (
+	errUnknownKey = errors.New("token was signed with an unknown key")
+	errKeyAlgorithmMismatch = errors.New("token algorithm does not match its signing key")
+)
+
+// signingKey is a private key from the key directory together with what tokens it signs carry
+type signingKey struct {
+	kid string
+	algorithm string
+	createdAt time.Time
+	private crypto.Signer
+}
+
+// KeyRing holds the keys access tokens are signed and verified with. Every key is a PKCS #8 PEM file named
+// <kid>.pem in the key directory; the newest key published for at least jwksMaxAge signs, and every key that
+// is still retained verifies. Several servers can share the directory, each picks up the keys the others write.
+type KeyRing struct {
+	mux *sync.RWMutex
+	dir string
+	algorithm string
+	rotateEvery time.Duration
+	keys map[string]*signingKey
+}
+
+// NewKeyRing loads the keys in dir, creating the directory and a first key of algorithm when there is none.
+// With rotateEvery above zero a new signing key is generated once the current one is that old.
+func NewKeyRing(dir string, algorithm string, rotateEvery time.Duration) (*KeyRing, error) {
+	if signingMethod(algorithm) == nil {
+		return nil, fmt.Errorf("unsupported token signing algorithm %q, expected %s or %s", algorithm, AlgorithmEdDSA, AlgorithmRS256)
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	keyRing := &KeyRing{mux: &sync.RWMutex{}, dir: dir, algorithm: algorithm, rotateEvery: rotateEvery}
+	err = keyRing.Reload()
+	if err != nil {
+		return nil, err
+	}
+	err = keyRing.rotateIfDue(time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	return keyRing, nil
+}
+
+// Reload reads the key directory again, picking up keys written by other servers
+func (keyRing *KeyRing) Reload() error {
+	paths, err := filepath.Glob(filepath.Join(keyRing.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+
+	keys := map[string]*signingKey{}
+	for _, path := range paths {
+		key, err := loadSigningKey(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		keys[key.kid] = key
+	}
+
+	keyRing.mux.Lock()
+	defer keyRing.mux.Unlock()
+
+	if len(keys) == 0 && len(keyRing.keys) > 0 {
+		return fmt.Errorf("no keys left in %s, keeping the keys loaded before", keyRing.dir)
+	}
+	keyRing.keys = keys
+	return nil
+}
+
+// Rotate generates a new signing key, which takes over once it has been published for jwksMaxAge, and drops
+// keys retired for longer than keyRetention
+func (keyRing *KeyRing) Rotate() error {
+	now := time.Now().UTC()
+	key, err := generateSigningKey(keyRing.algorithm, now)
+	if err != nil {
+		return err
+	}
+	err = writeSigningKey(filepath.Join(keyRing.dir, key.kid+".pem"), key)
+	if err != nil {
+		return err
+	}
+
+	keyRing.mux.Lock()
+	keyRing.keys[key.kid] = key
+	keyRing.mux.Unlock()
+
+	return keyRing.prune(now)
+}
+
+// StartRotation reloads the key directory and rotates the signing key when it is due, until the process exits
+func (keyRing *KeyRing) StartRotation() {
+	go func() {
+		for range time.Tick(keyCheckInterval) {
+			err := keyRing.Reload()
+			if err == nil {
+				err = keyRing.rotateIfDue(time.Now().UTC())
+			}
+			if err != nil {
+				log.Printf("token signing keys: %v", err)
+			}
+		}
+	}()
+}
+
+// rotateIfDue rotates when there is no key yet or the newest key is older than rotateEvery
+func (keyRing *KeyRing) rotateIfDue(now time.Time) error {
+	kids := keyRing.kids()
+	if len(kids) > 0 {
+		keyRing.mux.RLock()
+		newest := keyRing.keys[kids[len(kids)-1]]
+		keyRing.mux.RUnlock()
+
+		if keyRing.rotateEvery <= 0 || now.Sub(newest.createdAt) < keyRing.rotateEvery {
+			return nil
+		}
+	}
+
+	err := keyRing.Rotate()
+	if err != nil {
+		return err
+	}
+	if len(kids) > 0 {
+		log.Printf("token signing key rotated, the new key signs from %s", now.Add(jwksMaxAge).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// kids returns the IDs of every key, oldest first
+func (keyRing *KeyRing) kids() []string {
+	keyRing.mux.RLock()
+	defer keyRing.mux.RUnlock()
+
+	kids := []string{}
+	for kid := range keyRing.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	return kids
+}
+
+// prune deletes the files of keys that stopped signing more than keyRetention ago
+func (keyRing *KeyRing) prune(now time.Time) error {
+	kids := keyRing.kids()
+
+	keyRing.mux.Lock()
+	defer keyRing.mux.Unlock()
+
+	// a key retires when the key after it takes over signing
+	for i := 0; i+1 < len(kids); i++ {
+		retiredAt := keyRing.keys[kids[i+1]].createdAt.Add(jwksMaxAge)
+		if now.Sub(retiredAt) < keyRetention {
+			continue
+		}
+		err := os.Remove(filepath.Join(keyRing.dir, kids[i]+".pem"))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		delete(keyRing.keys, kids[i])
+	}
+	return nil
+}
+
+// signer returns the newest key published for at least jwksMaxAge, or the oldest key when none is that old yet
+func (keyRing *KeyRing) signer(now time.Time) *signingKey {
+	kids := keyRing.kids()
+
+	keyRing.mux.RLock()
+	defer keyRing.mux.RUnlock()
+
+	for i := len(kids) - 1; i >= 0; i-- {
+		if now.Sub(keyRing.keys[kids[i]].createdAt) >= jwksMaxAge {
+			return keyRing.keys[kids[i]]
+		}
+	}
+	return keyRing.keys[kids[0]]
+}
+
+// Sign signs claims with the current signing key, naming the key in the kid header
+func (keyRing *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	key := keyRing.signer(time.Now().UTC())
+
+	token := jwt.NewWithClaims(signingMethod(key.algorithm), claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// Algorithms lists the signing algorithms of the keys in the ring, the only ones a token may claim
+func (keyRing *KeyRing) Algorithms() []string {
+	keyRing.mux.RLock()
+	defer keyRing.mux.RUnlock()
+
+	algorithms := []string{}
+	for _, key := range keyRing.keys {
+		if !slices.Contains(algorithms, key.algorithm) {
+			algorithms = append(algorithms, key.algorithm)
+		}
+	}
+	return algorithms
+}
+
+// VerificationKey is a jwt.Keyfunc, it looks up the key named by the kid header and pins the token's
+// algorithm to that key's
+func (keyRing *KeyRing) VerificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	keyRing.mux.RLock()
+	key, exist := keyRing.keys[kid]
+	keyRing.mux.RUnlock()
+
+	if !exist {
+		return nil, errUnknownKey
+	}
+	if token.Method.Alg() != key.algorithm {
+		return nil, errKeyAlgorithmMismatch
+	}
+	return key.private.Public(), nil
+}
+
+// JWK is a public key in JSON Web Key form
+type JWK struct {
+	KeyType string `json:"kty"`
+	KeyID string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use string `json:"use"`
+	Curve string `json:"crv,omitempty"`
+	X string `json:"x,omitempty"`
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+}
+
+// JWKS returns the public half of every verification key, newest first
+func (keyRing *KeyRing) JWKS() []JWK {
+	keyRing.mux.RLock()
+	defer keyRing.mux.RUnlock()
+
+	jwks := []JWK{}
+	for _, key := range keyRing.keys {
+		jwk := JWK{KeyID: key.kid, Algorithm: key.algorithm, Use: "sig"}
+		switch public := key.private.Public().(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType, jwk.Curve, jwk.X = "OKP", "Ed25519", base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		}
+		jwks = append(jwks, jwk)
+	}
+	sort.Slice(jwks, func(i, j int) bool { return jwks[i].KeyID > jwks[j].KeyID })
+	return jwks
+}
+
+// signingMethod maps an algorithm name to its jwt signing method, nil when it is not supported
+func signingMethod(algorithm string) jwt.SigningMethod {
+	switch algorithm {
+	case AlgorithmEdDSA:
+		return jwt.SigningMethodEdDSA
+	case AlgorithmRS256:
+		return jwt.SigningMethodRS256
+	}
+	return nil
+}
+
+// generateSigningKey creates a key for algorithm, its kid starts with the creation time
+func generateSigningKey(algorithm string, now time.Time) (*signingKey, error) {
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return nil, err
+	}
+	key := &signingKey{kid: now.Format(kidTimeLayout) + "-" + hex.EncodeToString(suffix), algorithm: algorithm, createdAt: now.Truncate(time.Second)}
+
+	switch algorithm {
+	case AlgorithmEdDSA:
+		_, key.private, err = ed25519.GenerateKey(rand.Reader)
+	case AlgorithmRS256:
+		key.private, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		err = fmt.Errorf("unsupported token signing algorithm %q", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// loadSigningKey reads a key file, the algorithm follows from the key type and the kid from the file name
+func loadSigningKey(path string) (*signingKey, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(dat)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+	createdAt, err := time.Parse(kidTimeLayout, strings.SplitN(kid, "-", 2)[0])
+	if err != nil {
+		return nil, fmt.Errorf("key file name must start with its creation time as %s", kidTimeLayout)
+	}
+
+	key := &signingKey{kid: kid, createdAt: createdAt}
+	switch private := private.(type) {
+	case ed25519.PrivateKey:
+		key.algorithm, key.private = AlgorithmEdDSA, private
+	case *rsa.PrivateKey:
+		key.algorithm, key.private = AlgorithmRS256, private
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, expected Ed25519 or RSA", private)
+	}
+	return key, nil
+}
+
+// writeSigningKey saves a key as PKCS #8 PEM, readable by the owner only
+func writeSigningKey(path string, key *signingKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.private)
+	if err != nil {
+		return err
+	}
+	dat := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	// written under another name first so that a concurrent Reload never sees half a key
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, dat, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
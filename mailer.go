@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Email is a plain text message to a single recipient
+type Email struct {
+	To string
+	Subject string
+	Body string
+	// Secret is the token or link in Body that grants access to the account, it is never logged
+	Secret string
+}
+
+// Mailer delivers the emails chirpy sends, implemented by SMTPMailer, FileMailer and LogMailer
+type Mailer interface {
+	Send(email Email) error
+}
+
+// NewMailer returns the mailer selected by kind: "smtp" sends through smtpAddr, "file" writes every email
+// to a .eml file in dir and "log", the default, prints them to the server log with their secrets redacted.
+// File and log are only meant for development, so both warn when they are picked.
+func NewMailer(kind string, from string, dir string, smtpAddr string, smtpUsername string, smtpPassword string) (Mailer, error){
+	_, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %w", from, err)
+	}
+
+	switch kind {
+	case "smtp":
+		host, _, err := net.SplitHostPort(smtpAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SMTP address %q: %w", smtpAddr, err)
+		}
+		mailer := &SMTPMailer{addr: smtpAddr, from: from}
+		if smtpUsername != "" {
+			mailer.auth = smtp.PlainAuth("", smtpUsername, smtpPassword, host)
+		}
+		return mailer, nil
+	case "file":
+		err := os.MkdirAll(dir, 0o700)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("WARNING: emails are written to %s, including password reset tokens, only use -mailer file for development", dir)
+		return &FileMailer{dir: dir, from: from}, nil
+	case "log", "":
+		log.Printf("WARNING: emails are only printed to the log with their links redacted, users cannot verify their email or reset their password, use -mailer smtp with SMTP_ADDR set in production")
+		return &LogMailer{from: from}, nil
+	}
+	return nil, fmt.Errorf("unknown mailer %q, expected smtp, file or log", kind)
+}
+
+// SMTPMailer sends emails through an SMTP server, authenticating with PLAIN when credentials are set
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m *SMTPMailer) Send(email Email) error{
+	sender, err := mail.ParseAddress(m.from)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, sender.Address, []string{email.To}, formatEmail(m.from, email))
+}
+
+// FileMailer writes every email to its own file, for development without a mail server
+type FileMailer struct {
+	dir string
+	from string
+}
+
+func (m *FileMailer) Send(email Email) error{
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000Z"), strings.NewReplacer("/", "_", "@", "_at_").Replace(email.To))
+	return os.WriteFile(filepath.Join(m.dir, name), formatEmail(m.from, email), 0o600)
+}
+
+// LogMailer prints every email to the server log with its secret redacted, since logs are read by more
+// people than the mailbox of each user
+type LogMailer struct {
+	from string
+}
+
+func (m *LogMailer) Send(email Email) error{
+	body := email.Body
+	if email.Secret != "" {
+		body = strings.ReplaceAll(body, email.Secret, "[redacted]")
+	}
+	log.Printf("mail to %s: %s\n%s", email.To, email.Subject, body)
+	return nil
+}
+
+// formatEmail renders email as an RFC 5322 message
+func formatEmail(from string, email Email) []byte {
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", from)
+	fmt.Fprintf(msg, "To: %s\r\n", email.To)
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", email.Subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(email.Body, "\n", "\r\n"))
+	return msg.Bytes()
+}
+
+// sendMail delivers email in the background so that a slow mail server does not hold up the request,
+// and so that how long a request takes does not reveal whether an email was sent
+func (cfg *apiConfig)sendMail(email Email){
+	go func() {
+		err := cfg.mailer.Send(email)
+		if err != nil {
+			log.Printf("sending %q to %s failed: %v", email.Subject, email.To, err)
+		}
+	}()
+}
@@ -5,35 +5,166 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type apiConfig struct {
 	FileserverHits int
-	DB *DB
-	jwtSecret string
+	DB Store
+	keys *KeyRing
+	audiences []string
+	tokenLeeway time.Duration
 	polkaWebhookApiKey string
+	chirpEditWindow time.Duration
+	search *SearchIndex
+	moderator *Moderator
+	mailer Mailer
+	publicURL string
+	requireVerifiedEmail bool
+	loginThrottle *LoginThrottle
+	passwordResetThrottle *LoginThrottle
+	passwordHasher PasswordHasher
+	passwordPolicy *PasswordPolicy
+	// dummyPasswordHash is checked against when a login names an unknown email, see handlerLogin
+	dummyPasswordHash []byte
 }
 
 func main(){
 	godotenv.Load()
 	dbg := flag.Bool("debug", false, "Enable debug mode")
+	storeKind := flag.String("store", "json", "Storage backend to use: json or sqlite")
+	dbPath := flag.String("db", "", "Path to the database file, defaults to ./database.json or ./database.db")
+	moderationRulesPath := flag.String("moderation-rules", "moderation.json", "Path to the JSON file of chirp moderation rules")
+	bootstrapAdminEmail := flag.String("bootstrap-admin", "", "Make the user with this email the first admin and exit")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "Report pending database migrations and exit without applying them")
+	jwtKeysDir := flag.String("jwt-keys", "jwt-keys", "Directory of the private keys access tokens are signed with, shared by every server")
+	jwtAlgorithm := flag.String("jwt-algorithm", AlgorithmEdDSA, "Algorithm of newly generated token signing keys: EdDSA or RS256")
+	jwtAudiences := flag.String("jwt-audiences", "chirpy", "Comma-separated clients access tokens can be issued to, the first is the default")
+	jwtLeeway := flag.Duration("jwt-leeway", 30*time.Second, "Clock skew allowed when checking token expiry and issue times")
+	jwtKeyRotation := flag.Duration("jwt-key-rotation", 30*24*time.Hour, "Generate a new token signing key once the current one is this old, 0 disables rotation")
+	mailerKind := flag.String("mailer", "log", "How to deliver emails: smtp, or file or log for development only")
+	mailDir := flag.String("mail-dir", "mail", "Directory the file mailer writes emails to")
+	publicURL := flag.String("public-url", "http://localhost:8080", "Base URL of the server used in links sent by email")
+	requireVerifiedEmail := flag.Bool("require-verified-email", false, "Only let users with a verified email address post chirps")
+	loginMaxFailures := flag.Int("login-max-failures", 5, "Failed logins after which an account is locked out, 0 disables the limit")
+	loginMaxIPFailures := flag.Int("login-max-ip-failures", 20, "Failed logins after which a client IP is locked out, 0 disables the limit")
+	loginLockout := flag.Duration("login-lockout", 15*time.Minute, "How long an account or client IP stays locked out")
+	resetMaxRequests := flag.Int("password-reset-max-requests", 3, "Password reset emails an address can be sent per password-reset-window, 0 disables the limit")
+	resetMaxIPRequests := flag.Int("password-reset-max-ip-requests", 10, "Password reset requests a client IP can make per password-reset-window, 0 disables the limit")
+	resetWindow := flag.Duration("password-reset-window", time.Hour, "How long the password reset limits stay in force once reached")
+	passwordHash := flag.String("password-hash", PasswordHashArgon2id, "Algorithm new password hashes are made with: argon2id or bcrypt, older hashes are upgraded at login")
+	bcryptCost := flag.Int("bcrypt-cost", 12, "Cost of bcrypt password hashes")
+	argon2Memory := flag.Uint("argon2-memory", 19*1024, "Memory in KiB used by one argon2id password hash")
+	argon2Iterations := flag.Uint("argon2-iterations", 2, "Passes over the memory of an argon2id password hash")
+	argon2Parallelism := flag.Uint("argon2-parallelism", 1, "Threads used by one argon2id password hash")
+	passwordMinLength := flag.Int("password-min-length", 8, "Shortest password users can pick")
+	breachedPasswordsPath := flag.String("breached-passwords", "", "File of breached passwords, or their SHA-1 hashes, users may not pick")
 	flag.Parse()
 
+	if *dbPath == "" {
+		*dbPath = defaultStorePath(*storeKind)
+	}
+
 	if *dbg {
-			deleteDB("./database.json")
+		err := deleteDB(*dbPath)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	const filepathRoot = "."
 	const port = "8080"
 
-	db, err := NewDB("./database.json")
+	db, err := NewStore(*storeKind, *dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	migrations, err := db.Migrate(*migrateDryRun)
 	if err != nil {
 		log.Fatal(err)
 	}
+	for _, m := range migrations {
+		if *migrateDryRun {
+			log.Printf("database migration (dry run): %v", m)
+		} else {
+			log.Printf("database migration: %v", m)
+		}
+	}
+	if *migrateDryRun {
+		return
+	}
+
+	if *bootstrapAdminEmail != "" {
+		admin, err := bootstrapAdmin(db, *bootstrapAdminEmail)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("user %d (%s) is now an admin", admin.ID, admin.Email)
+		return
+	}
 	
-	apiConfig := apiConfig{FileserverHits: 0, DB: db, jwtSecret: os.Getenv("JWT_SECRET"), polkaWebhookApiKey: os.Getenv("POLKA_WEBHOOK_API_KEY")}
+	search := NewSearchIndex()
+	err = search.Rebuild(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	moderator, err := NewModerator(*moderationRulesPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	keys, err := NewKeyRing(*jwtKeysDir, *jwtAlgorithm, *jwtKeyRotation)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keys.StartRotation()
+
+	audiences := []string{}
+	for _, audience := range strings.Split(*jwtAudiences, ",") {
+		if strings.TrimSpace(audience) != "" {
+			audiences = append(audiences, strings.TrimSpace(audience))
+		}
+	}
+	if len(audiences) == 0 {
+		log.Fatal("-jwt-audiences needs at least one audience")
+	}
+
+	mailFrom := os.Getenv("MAIL_FROM")
+	if mailFrom == "" {
+		mailFrom = "Chirpy <no-reply@localhost>"
+	}
+	mailer, err := NewMailer(*mailerKind, mailFrom, *mailDir, os.Getenv("SMTP_ADDR"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	passwordHasher, err := NewPasswordHasher(*passwordHash, *bcryptCost, uint32(*argon2Memory), uint32(*argon2Iterations), uint8(*argon2Parallelism))
+	if err != nil {
+		log.Fatal(err)
+	}
+	passwordPolicy, err := NewPasswordPolicy(*passwordMinLength, *breachedPasswordsPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dummyPasswordHash, err := passwordHasher.Hash("no such user")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	chirpEditWindow := 15 * time.Minute
+	if os.Getenv("CHIRP_EDIT_WINDOW") != "" {
+		chirpEditWindow, err = time.ParseDuration(os.Getenv("CHIRP_EDIT_WINDOW"))
+		if err != nil {
+			log.Fatalf("invalid CHIRP_EDIT_WINDOW: %v", err)
+		}
+	}
+
+	apiConfig := apiConfig{FileserverHits: 0, DB: &indexedStore{Store: db, search: search}, keys: keys, audiences: audiences, tokenLeeway: *jwtLeeway, polkaWebhookApiKey: os.Getenv("POLKA_WEBHOOK_API_KEY"), chirpEditWindow: chirpEditWindow, search: search, moderator: moderator, mailer: mailer, publicURL: strings.TrimSuffix(*publicURL, "/"), requireVerifiedEmail: *requireVerifiedEmail, loginThrottle: NewLoginThrottle(*loginMaxFailures, *loginMaxIPFailures, *loginLockout), passwordResetThrottle: NewPasswordResetThrottle(*resetMaxRequests, *resetMaxIPRequests, *resetWindow), passwordHasher: passwordHasher, passwordPolicy: passwordPolicy, dummyPasswordHash: dummyPasswordHash}
 
 	sMux := http.NewServeMux()
 
@@ -46,28 +177,118 @@ func main(){
 
 	sMux.HandleFunc("GET /api/healthz", handlerReadiness)
 
-	sMux.HandleFunc("GET /admin/metrics", apiConfig.handlerMetrics)
+	sMux.HandleFunc("GET /.well-known/jwks.json", apiConfig.handlerReadJWKS)
+
+	sMux.HandleFunc("GET /admin/metrics", apiConfig.middlewareRequirePermission(PermissionViewMetrics, apiConfig.handlerMetrics))
+
+	sMux.HandleFunc("GET /api/reset", apiConfig.middlewareRequirePermission(PermissionResetMetrics, apiConfig.handlerReset))
 
-	sMux.HandleFunc("GET /api/reset", apiConfig.handlerReset)
+	sMux.HandleFunc("PUT /admin/users/{userID}/role", apiConfig.middlewareRequirePermission(PermissionManageRoles, apiConfig.handlerUpdateUserRole))
 
-	sMux.HandleFunc("POST /api/chirps", apiConfig.handlerCreateChirps)
+	sMux.HandleFunc("DELETE /admin/users/{userID}/lockout", apiConfig.middlewareRequirePermission(PermissionUnlockUsers, apiConfig.handlerUnlockUser))
 
-	sMux.HandleFunc("GET /api/chirps", apiConfig.handlerReadChirps)
+	sMux.HandleFunc("DELETE /admin/users/{userID}/suspension", apiConfig.middlewareRequirePermission(PermissionUnsuspendUsers, apiConfig.handlerUnsuspendUser))
 
-	sMux.HandleFunc("GET /api/chirps/{chirpID}", apiConfig.handlerReadSingleChirp)
+	sMux.HandleFunc("DELETE /admin/users/{userID}/2fa", apiConfig.middlewareRequirePermission(PermissionResetTwoFactor, apiConfig.handlerResetTwoFactor))
 
-	sMux.HandleFunc("DELETE /api/chirps/{chirpID}", apiConfig.handlerDeleteSingleChirp)
+	sMux.HandleFunc("GET /admin/reports", apiConfig.middlewareRequirePermission(PermissionReviewReports, apiConfig.handlerReadReports))
+
+	sMux.HandleFunc("POST /admin/reports/{reportID}/resolve", apiConfig.middlewareRequirePermission(PermissionReviewReports, apiConfig.handlerResolveReport))
+
+	sMux.HandleFunc("GET /admin/moderation/rules", apiConfig.middlewareRequirePermission(PermissionManageModerationRules, apiConfig.handlerReadModerationRules))
+
+	sMux.HandleFunc("PUT /admin/moderation/rules", apiConfig.middlewareRequirePermission(PermissionManageModerationRules, apiConfig.handlerReplaceModerationRules))
+
+	sMux.HandleFunc("PUT /admin/moderation/rules/{ruleID}", apiConfig.middlewareRequirePermission(PermissionManageModerationRules, apiConfig.handlerPutModerationRule))
+
+	sMux.HandleFunc("DELETE /admin/moderation/rules/{ruleID}", apiConfig.middlewareRequirePermission(PermissionManageModerationRules, apiConfig.handlerDeleteModerationRule))
+
+	sMux.HandleFunc("GET /admin/moderation/held", apiConfig.middlewareRequirePermission(PermissionReviewHeldChirps, apiConfig.handlerReadHeldChirps))
+
+	sMux.HandleFunc("POST /admin/moderation/held/{heldID}/approve", apiConfig.middlewareRequirePermission(PermissionReviewHeldChirps, apiConfig.handlerApproveHeldChirp))
+
+	sMux.HandleFunc("DELETE /admin/moderation/held/{heldID}", apiConfig.middlewareRequirePermission(PermissionReviewHeldChirps, apiConfig.handlerDiscardHeldChirp))
+
+	sMux.HandleFunc("POST /api/chirps", apiConfig.middlewareAuthRequired(apiConfig.handlerCreateChirps))
+
+	sMux.HandleFunc("GET /api/chirps", apiConfig.middlewareAuthOptional(apiConfig.handlerReadChirps))
+
+	sMux.HandleFunc("GET /api/chirps/{chirpID}", apiConfig.middlewareAuthOptional(apiConfig.handlerReadSingleChirp))
+
+	sMux.HandleFunc("PUT /api/chirps/{chirpID}", apiConfig.middlewareAuthRequired(apiConfig.handlerUpdateChirp))
+
+	sMux.HandleFunc("GET /api/chirps/{chirpID}/history", apiConfig.handlerReadChirpHistory)
+
+	sMux.HandleFunc("GET /api/chirps/{chirpID}/thread", apiConfig.middlewareAuthOptional(apiConfig.handlerReadChirpThread))
+
+	sMux.HandleFunc("DELETE /api/chirps/{chirpID}", apiConfig.middlewareAuthRequired(apiConfig.handlerDeleteSingleChirp))
+
+	sMux.HandleFunc("POST /api/chirps/{chirpID}/like", apiConfig.middlewareAuthRequired(apiConfig.handlerLikeChirp))
+
+	sMux.HandleFunc("DELETE /api/chirps/{chirpID}/like", apiConfig.middlewareAuthRequired(apiConfig.handlerUnlikeChirp))
+
+	sMux.HandleFunc("GET /api/chirps/{chirpID}/likes", apiConfig.handlerReadChirpLikes)
+
+	sMux.HandleFunc("POST /api/chirps/{chirpID}/rechirp", apiConfig.middlewareAuthRequired(apiConfig.handlerRechirpChirp))
+
+	sMux.HandleFunc("DELETE /api/chirps/{chirpID}/rechirp", apiConfig.middlewareAuthRequired(apiConfig.handlerUnrechirpChirp))
+
+	sMux.HandleFunc("GET /api/chirps/{chirpID}/rechirps", apiConfig.handlerReadChirpRechirps)
+
+	sMux.HandleFunc("POST /api/chirps/{chirpID}/report", apiConfig.middlewareAuthRequired(apiConfig.handlerReportChirp))
+
+	sMux.HandleFunc("GET /api/tags/{tag}", apiConfig.middlewareAuthOptional(apiConfig.handlerReadTagChirps))
+
+	sMux.HandleFunc("GET /api/mentions", apiConfig.middlewareAuthRequired(apiConfig.handlerReadMentions))
+
+	sMux.HandleFunc("GET /api/search", apiConfig.middlewareAuthOptional(apiConfig.handlerSearchChirps))
+
+	sMux.HandleFunc("GET /api/search/users", apiConfig.handlerSearchUsers)
 
 	sMux.HandleFunc("POST /api/users", apiConfig.handlerCreateUsers)
 
-	sMux.HandleFunc("PUT /api/users", apiConfig.handlerModifyUsers)
+	sMux.HandleFunc("PUT /api/users", apiConfig.middlewareAuthRequired(apiConfig.handlerModifyUsers))
+
+	sMux.HandleFunc("PATCH /api/users/me", apiConfig.middlewareAuthRequired(apiConfig.handlerPatchMe))
+
+	sMux.HandleFunc("POST /api/users/me/2fa", apiConfig.middlewareAuthRequired(apiConfig.handlerStartTwoFactor))
+
+	sMux.HandleFunc("POST /api/users/me/2fa/verify", apiConfig.middlewareAuthRequired(apiConfig.handlerVerifyTwoFactor))
+
+	sMux.HandleFunc("DELETE /api/users/me/2fa", apiConfig.middlewareAuthRequired(apiConfig.handlerDisableTwoFactor))
+
+	sMux.HandleFunc("POST /api/users/{userID}/follow", apiConfig.middlewareAuthRequired(apiConfig.handlerFollowUser))
+
+	sMux.HandleFunc("DELETE /api/users/{userID}/follow", apiConfig.middlewareAuthRequired(apiConfig.handlerUnfollowUser))
+
+	sMux.HandleFunc("GET /api/users/{userID}/followers", apiConfig.handlerReadFollowers)
+
+	sMux.HandleFunc("GET /api/users/{userID}/following", apiConfig.handlerReadFollowing)
+
+	sMux.HandleFunc("GET /api/timeline", apiConfig.middlewareAuthRequired(apiConfig.handlerReadTimeline))
 
 	sMux.HandleFunc("POST /api/login", apiConfig.handlerLogin)
 
+	sMux.HandleFunc("POST /api/login/2fa", apiConfig.handlerLoginTwoFactor)
+
 	sMux.HandleFunc("POST /api/refresh", apiConfig.handlerRefreshAuth)
 
 	sMux.HandleFunc("POST /api/revoke", apiConfig.handlerRevokeAuth)
 
+	sMux.HandleFunc("GET /api/sessions", apiConfig.middlewareAuthRequired(apiConfig.handlerReadSessions))
+
+	sMux.HandleFunc("DELETE /api/sessions", apiConfig.middlewareAuthRequired(apiConfig.handlerDeleteAllSessions))
+
+	sMux.HandleFunc("DELETE /api/sessions/{sessionID}", apiConfig.middlewareAuthRequired(apiConfig.handlerDeleteSession))
+
+	sMux.HandleFunc("GET /api/email/verify", apiConfig.handlerVerifyEmail)
+
+	sMux.HandleFunc("POST /api/email/verify/resend", apiConfig.middlewareAuthRequired(apiConfig.handlerResendEmailVerification))
+
+	sMux.HandleFunc("POST /api/password/forgot", apiConfig.handlerForgotPassword)
+
+	sMux.HandleFunc("POST /api/password/reset", apiConfig.handlerResetPassword)
+
 	sMux.HandleFunc("POST /api/polka/webhooks", apiConfig.handlerPolkaUserUpgrade)
 
 	log.Printf("Serving files from %v on port: %v", filepathRoot, port)
@@ -1,6 +1,15 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// principalContextKey is the request context key of the Principal
+type principalContextKey struct{}
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -8,4 +17,101 @@ func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 		cfg.FileserverHits++
 		next.ServeHTTP(w, r)
 	})
-}
\ No newline at end of file
+}
+
+// middlewareAuthRequired rejects requests without a valid access token for an active user and passes the
+// Principal on to next through the request context
+func (cfg *apiConfig) middlewareAuthRequired(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respBody := &RespBody{}
+
+		principal, err := cfg.authenticate(r)
+		if err != nil {
+			cfg.handlerTokenErrors(w, err, respBody)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), principalContextKey{}, principal)))
+	}
+}
+
+// middlewareAuthOptional lets every request through, with a Principal in the context when it carries a valid
+// access token for an active user. A missing, invalid or expired token reads as an anonymous request.
+func (cfg *apiConfig) middlewareAuthOptional(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next(w, r)
+			return
+		}
+		principal, err := cfg.authenticate(r)
+		if err != nil {
+			next(w, r)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), principalContextKey{}, principal)))
+	}
+}
+
+// middlewareRequirePermission only lets signed-in users through whose role grants permission
+func (cfg *apiConfig) middlewareRequirePermission(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return cfg.middlewareAuthRequired(func(w http.ResponseWriter, r *http.Request) {
+		respBody := &RespBody{}
+
+		if !roleHasPermission(requestPrincipal(r).User.Role, permission) {
+			cfg.handlerErrors(w, fmt.Errorf("the %s permission is required", permission), respBody, 403)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// authenticate validates the access token of a request and loads the user it was issued to. A token whose
+// session was signed out or revoked is refused even before it expires.
+func (cfg *apiConfig) authenticate(r *http.Request) (Principal, error) {
+	claims, err := cfg.parseAccessToken(r)
+	if err != nil {
+		return Principal{}, err
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	session, err := cfg.DB.ReadSingleSession(claims.SessionID)
+	if errors.Is(err, ErrSessionNotExist) || (err == nil && session.UserID != userID) {
+		return Principal{}, errSessionRevoked
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+
+	user, err := cfg.DB.ReadSingleUser(userID)
+	if err != nil {
+		return Principal{}, err
+	}
+	if user.Suspended {
+		return Principal{}, errAccountSuspended
+	}
+	return Principal{User: user, Claims: claims}, nil
+}
+
+// principalFromRequest returns the Principal of a request, ok is false for an anonymous request
+func principalFromRequest(r *http.Request) (principal Principal, ok bool) {
+	principal, ok = r.Context().Value(principalContextKey{}).(Principal)
+	return principal, ok
+}
+
+// requestPrincipal returns the Principal of a request on a route wrapped with middlewareAuthRequired,
+// it panics when the route was registered without it
+func requestPrincipal(r *http.Request) Principal {
+	principal, ok := principalFromRequest(r)
+	if !ok {
+		panic("requestPrincipal used on a route without middlewareAuthRequired: " + r.URL.Path)
+	}
+	return principal
+}
+
+// viewerID returns the user making the request, or 0 for an anonymous request
+func viewerID(r *http.Request) int {
+	principal, _ := principalFromRequest(r)
+	return principal.User.ID
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// migration upgrades a JSON database from version-1 to version
+type migration struct {
+	version int
+	description string
+	migrate func(dbStructure *DBStructure) error
+}
+
+// dbMigrations is the ordered list of JSON database upgrades, append new ones at the end and never change
+// one that has shipped. An SQLite schema change only needs a JSON migration when existing records need
+// values other than the zero value, so SQLite 2, 3, 7 (entities), 10, 11, 12, 16 and 17 match JSON 2, 3, 4,
+// 5, 6, 7, 9 and 10, and JSON 8 only clears what JSON 6 left behind. The others need none: SQLite 4 (no replies or tombstones yet), 5 (follows start empty), 6 (zero
+// like and rechirp counters), 7 (usernames are empty until set), 8 (held chirps start empty), 9 (nothing
+// hidden or suspended yet), 13 (an empty session audience means the default one), 14 (two-factor off)
+// and 15 (email not verified).
+var dbMigrations = []migration{
+	{version: 1, description: "persist ID sequences derived from existing chirps and users", migrate: func(dbStructure *DBStructure) error {
+		for id := range dbStructure.Chirps {
+			dbStructure.Sequences["chirps"] = max(dbStructure.Sequences["chirps"], id)
+		}
+		for id := range dbStructure.Users {
+			dbStructure.Sequences["users"] = max(dbStructure.Sequences["users"], id)
+		}
+		return nil
+	}},
+	{version: 2, description: "backfill created_at on chirps with the migration time", migrate: func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		for id, chirp := range dbStructure.Chirps {
+			if chirp.CreatedAt.IsZero() {
+				chirp.CreatedAt = now
+				dbStructure.Chirps[id] = chirp
+			}
+		}
+		return nil
+	}},
+	{version: 3, description: "backfill updated_at on chirps and created_at/updated_at on users", migrate: func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		for id, chirp := range dbStructure.Chirps {
+			if chirp.UpdatedAt.IsZero() {
+				chirp.UpdatedAt = chirp.CreatedAt
+				dbStructure.Chirps[id] = chirp
+			}
+		}
+		for id, user := range dbStructure.Users {
+			if user.CreatedAt.IsZero() {
+				user.CreatedAt = now
+				user.UpdatedAt = now
+				dbStructure.Users[id] = user
+			}
+		}
+		return nil
+	}},
+	{version: 4, description: "extract hashtags and mentions from existing chirps", migrate: func(dbStructure *DBStructure) error {
+		for id, chirp := range dbStructure.Chirps {
+			chirp.Entities = dbStructure.chirpEntities(chirp.Body)
+			dbStructure.Chirps[id] = chirp
+		}
+		return nil
+	}},
+	{version: 5, description: "give every existing user the user role", migrate: func(dbStructure *DBStructure) error {
+		for id, user := range dbStructure.Users {
+			if user.Role == "" {
+				user.Role = RoleUser
+				dbStructure.Users[id] = user
+			}
+		}
+		return nil
+	}},
+	{version: 6, description: "start a refresh token family for every existing refresh token", migrate: func(dbStructure *DBStructure) error {
+		for token, refreshToken := range dbStructure.RefreshTokens {
+			if refreshToken.FamilyID == "" {
+				refreshToken.FamilyID = token
+				dbStructure.RefreshTokens[token] = refreshToken
+			}
+		}
+		return nil
+	}},
+	{version: 7, description: "store refresh tokens by their SHA-256 hash, start a session for every live token and drop rotated ones", migrate: func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		refreshTokens := map[string]RefreshToken{}
+		for token, refreshToken := range dbStructure.RefreshTokens {
+			if refreshToken.RotatedAt != nil {
+				continue
+			}
+			dbStructure.Sequences["sessions"]++
+			session := Session{ID: dbStructure.Sequences["sessions"], UserID: refreshToken.UserID, CreatedAt: now, LastUsedAt: now}
+			dbStructure.Sessions[session.ID] = session
+
+			refreshToken.TokenHash = hashRefreshToken(token)
+			refreshToken.SessionID = session.ID
+			refreshTokens[refreshToken.TokenHash] = refreshToken
+		}
+		dbStructure.RefreshTokens = refreshTokens
+		return nil
+	}},
+	{version: 8, description: "drop the refresh token families left by version 6, they hold the raw token", migrate: func(dbStructure *DBStructure) error {
+		for tokenHash, refreshToken := range dbStructure.RefreshTokens {
+			if refreshToken.FamilyID != "" {
+				refreshToken.FamilyID = ""
+				dbStructure.RefreshTokens[tokenHash] = refreshToken
+			}
+		}
+		return nil
+	}},
+	{version: 9, description: "resolve mentions by username only, dropping those matched by email address", migrate: func(dbStructure *DBStructure) error {
+		for id, chirp := range dbStructure.Chirps {
+			chirp.Entities = dbStructure.chirpEntities(chirp.Body)
+			dbStructure.Chirps[id] = chirp
+		}
+		return nil
+	}},
+	{version: 10, description: "hide the chirps of suspended users", migrate: func(dbStructure *DBStructure) error {
+		for id, chirp := range dbStructure.Chirps {
+			if dbStructure.Users[chirp.AuthorID].Suspended {
+				chirp.AuthorSuspended = true
+				dbStructure.Chirps[id] = chirp
+			}
+		}
+		return nil
+	}},
+}
+
+// dbSchemaVersion is the version a JSON database has once every migration has run
+var dbSchemaVersion = len(dbMigrations)
+
+// sqliteMigration upgrades an SQLite database from version-1 to version, tracked in PRAGMA user_version
+type sqliteMigration struct {
+	version int
+	description string
+	sql string
+	// backfill optionally runs after sql, for data changes that need Go code
+	backfill func(tx *sql.Tx) error
+}
+
+// sqliteMigrations is the ordered list of SQLite schema upgrades, append new ones at the end
+var sqliteMigrations = []sqliteMigration{
+	{version: 1, description: "create users, chirps and refresh_tokens", sql: `
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT NOT NULL,
+	hashed_password BLOB NOT NULL,
+	is_chirpy_red INTEGER NOT NULL DEFAULT 0
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON users(email);
+
+CREATE TABLE IF NOT EXISTS chirps (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	author_id INTEGER NOT NULL,
+	body TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_chirps_author_id ON chirps(author_id);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	token TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id);
+`},
+	{version: 2, description: "add created_at to chirps, backfilled with the migration time", sql: `
+ALTER TABLE chirps ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+UPDATE chirps SET created_at = CAST(strftime('%s', 'now') AS INTEGER) * 1000000000;
+CREATE INDEX IF NOT EXISTS idx_chirps_created_at ON chirps(created_at);
+`},
+	{version: 3, description: "add updated_at to chirps, created_at/updated_at to users, and chirp_revisions", sql: `
+ALTER TABLE chirps ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+UPDATE chirps SET updated_at = created_at;
+CREATE INDEX IF NOT EXISTS idx_chirps_updated_at ON chirps(updated_at);
+
+ALTER TABLE users ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+UPDATE users SET created_at = CAST(strftime('%s', 'now') AS INTEGER) * 1000000000, updated_at = CAST(strftime('%s', 'now') AS INTEGER) * 1000000000;
+
+CREATE TABLE IF NOT EXISTS chirp_revisions (
+	chirp_id INTEGER NOT NULL,
+	revision INTEGER NOT NULL,
+	body TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	replaced_at INTEGER NOT NULL,
+	PRIMARY KEY (chirp_id, revision)
+);
+`},
+	{version: 4, description: "add reply threads and tombstones to chirps", sql: `
+ALTER TABLE chirps ADD COLUMN in_reply_to INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chirps ADD COLUMN reply_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chirps ADD COLUMN deleted INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS idx_chirps_in_reply_to ON chirps(in_reply_to);
+`},
+	{version: 5, description: "add follows", sql: `
+CREATE TABLE IF NOT EXISTS follows (
+	follower_id INTEGER NOT NULL,
+	followee_id INTEGER NOT NULL,
+	created_at INTEGER NOT NULL,
+	PRIMARY KEY (follower_id, followee_id)
+);
+CREATE INDEX IF NOT EXISTS idx_follows_followee ON follows(followee_id, created_at);
+`},
+	{version: 6, description: "add likes and rechirps with counters on chirps", sql: `
+ALTER TABLE chirps ADD COLUMN like_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chirps ADD COLUMN rechirp_count INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS likes (
+	chirp_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	created_at INTEGER NOT NULL,
+	PRIMARY KEY (chirp_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS idx_likes_user ON likes(user_id, chirp_id);
+
+CREATE TABLE IF NOT EXISTS rechirps (
+	chirp_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	created_at INTEGER NOT NULL,
+	PRIMARY KEY (chirp_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS idx_rechirps_user ON rechirps(user_id, created_at);
+`},
+	{version: 7, description: "add usernames, and hashtags and mentions extracted from chirps", sql: `
+ALTER TABLE users ADD COLUMN username TEXT NOT NULL DEFAULT '';
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username ON users(username COLLATE NOCASE) WHERE username != '';
+
+ALTER TABLE chirps ADD COLUMN entities TEXT NOT NULL DEFAULT '{"hashtags":[],"mentions":[]}';
+
+CREATE TABLE IF NOT EXISTS chirp_tags (
+	tag TEXT NOT NULL,
+	chirp_id INTEGER NOT NULL,
+	PRIMARY KEY (tag, chirp_id)
+);
+CREATE INDEX IF NOT EXISTS idx_chirp_tags_chirp ON chirp_tags(chirp_id);
+
+CREATE TABLE IF NOT EXISTS chirp_mentions (
+	user_id INTEGER NOT NULL,
+	chirp_id INTEGER NOT NULL,
+	PRIMARY KEY (user_id, chirp_id)
+);
+CREATE INDEX IF NOT EXISTS idx_chirp_mentions_chirp ON chirp_mentions(chirp_id);
+`, backfill: backfillChirpEntities},
+	{version: 8, description: "add the queue of chirps held for moderation review", sql: `
+CREATE TABLE IF NOT EXISTS held_chirps (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	author_id INTEGER NOT NULL,
+	body TEXT NOT NULL,
+	in_reply_to INTEGER NOT NULL DEFAULT 0,
+	reasons TEXT NOT NULL DEFAULT '[]',
+	created_at INTEGER NOT NULL
+);
+`},
+	{version: 9, description: "add chirp reports, hidden chirps and suspended users", sql: `
+ALTER TABLE chirps ADD COLUMN hidden INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN suspended INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS reports (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	chirp_id INTEGER NOT NULL,
+	reporter_id INTEGER NOT NULL,
+	reason TEXT NOT NULL,
+	details TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL,
+	resolution TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL,
+	resolved_at INTEGER
+);
+CREATE INDEX IF NOT EXISTS idx_reports_status ON reports(status, id);
+CREATE INDEX IF NOT EXISTS idx_reports_chirp ON reports(chirp_id, status);
+`},
+	{version: 10, description: "add user roles", sql: `
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';
+`},
+	{version: 11, description: "add refresh token families and rotation", sql: `
+ALTER TABLE refresh_tokens ADD COLUMN family_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE refresh_tokens ADD COLUMN rotated_at INTEGER;
+UPDATE refresh_tokens SET family_id = token;
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+`},
+	{version: 12, description: "store refresh tokens by their SHA-256 hash, start a session for every live token and drop rotated ones", sql: `
+CREATE TABLE IF NOT EXISTS sessions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	device_name TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL,
+	last_used_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id, last_used_at);
+
+DELETE FROM refresh_tokens WHERE rotated_at IS NOT NULL;
+DROP INDEX IF EXISTS idx_refresh_tokens_family_id;
+ALTER TABLE refresh_tokens DROP COLUMN family_id;
+ALTER TABLE refresh_tokens RENAME COLUMN token TO token_hash;
+ALTER TABLE refresh_tokens ADD COLUMN session_id INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session_id ON refresh_tokens(session_id);
+`, backfill: func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT token_hash, user_id FROM refresh_tokens`)
+		if err != nil {
+			return err
+		}
+		userIDs := map[string]int{}
+		for rows.Next() {
+			var token string
+			var userID int
+			err = rows.Scan(&token, &userID)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			userIDs[token] = userID
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		now := time.Now().UTC().UnixNano()
+		for token, userID := range userIDs {
+			res, err := tx.Exec(`INSERT INTO sessions (user_id, created_at, last_used_at) VALUES (?, ?, ?)`, userID, now, now)
+			if err != nil {
+				return err
+			}
+			sessionID, err := res.LastInsertId()
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`UPDATE refresh_tokens SET token_hash = ?, session_id = ? WHERE token_hash = ?`, hashRefreshToken(token), sessionID, token)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{version: 13, description: "record the client audience of each session", sql: `
+ALTER TABLE sessions ADD COLUMN audience TEXT NOT NULL DEFAULT '';
+`},
+	{version: 14, description: "add TOTP two-factor authentication to users", sql: `
+ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN recovery_codes TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+`},
+	{version: 15, description: "track whether users verified their email address", sql: `
+ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0;
+`},
+	{version: 16, description: "resolve mentions by username only, dropping those matched by email address", sql: ``, backfill: backfillChirpEntities},
+	{version: 17, description: "hide the chirps of suspended users", sql: `
+ALTER TABLE chirps ADD COLUMN author_suspended INTEGER NOT NULL DEFAULT 0;
+UPDATE chirps SET author_suspended = 1 WHERE author_id IN (SELECT id FROM users WHERE suspended = 1);
+`},
+}
+
+// backfillChirpEntities extracts the entities of every chirp that is not deleted again and resolves their
+// mentions. It runs as SQLite migrations 7 and 16, so it only reads columns that exist at version 7.
+func backfillChirpEntities(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, username FROM users`)
+	if err != nil {
+		return err
+	}
+	users := []User{}
+	for rows.Next() {
+		user := User{}
+		err = rows.Scan(&user.ID, &user.Username)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	rows, err = tx.Query(`SELECT id, body FROM chirps WHERE deleted = 0`)
+	if err != nil {
+		return err
+	}
+	bodies := map[int]string{}
+	for rows.Next() {
+		var id int
+		var body string
+		err = rows.Scan(&id, &body)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		bodies[id] = body
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	for id, body := range bodies {
+		entities, _ := resolveMentions(extractEntities(body), func(handle string) (int, error) {
+			return matchHandle(handle, users), nil
+		})
+		err = writeChirpEntities(tx, id, entities)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteSchemaVersion is the version an SQLite database has once every migration has run
+var sqliteSchemaVersion = len(sqliteMigrations)
+
+// Migrate upgrades the JSON database to dbSchemaVersion. The current state is backed up next to the
+// database file first. With dryRun the migrations run against a copy and nothing is written.
+// It returns a line per migration that ran or would run.
+func (db *DB) Migrate(dryRun bool) ([]string, error){
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	applied := []string{}
+	if db.data.Version == dbSchemaVersion {
+		return applied, nil
+	}
+
+	target := &db.data
+	if dryRun {
+		dat, err := json.Marshal(db.data)
+		if err != nil {
+			return applied, err
+		}
+		scratch := DBStructure{}
+		err = json.Unmarshal(dat, &scratch)
+		if err != nil {
+			return applied, err
+		}
+		scratch.ensureMaps()
+		target = &scratch
+	} else {
+		dat, err := json.Marshal(db.data)
+		if err != nil {
+			return applied, err
+		}
+		backupPath := fmt.Sprintf("%s.v%d-backup-%d", db.path, db.data.Version, time.Now().Unix())
+		err = writeFileSync(backupPath, dat)
+		if err != nil {
+			return applied, err
+		}
+		applied = append(applied, "backed up version "+fmt.Sprint(db.data.Version)+" to "+backupPath)
+	}
+
+	for _, m := range dbMigrations {
+		if m.version <= target.Version {
+			continue
+		}
+		err := m.migrate(target)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+		target.Version = m.version
+		applied = append(applied, fmt.Sprintf("%d: %s", m.version, m.description))
+	}
+
+	if dryRun {
+		return applied, nil
+	}
+	db.data.rebuildIndexes()
+	return applied, db.compact()
+}
+
+// Migrate upgrades the SQLite database to sqliteSchemaVersion inside a single transaction.
+// The database is backed up with VACUUM INTO first. With dryRun every migration is rolled back.
+// It returns a line per migration that ran or would run.
+func (db *SQLiteDB) Migrate(dryRun bool) ([]string, error){
+	applied := []string{}
+
+	version, err := db.schemaVersion()
+	if err != nil {
+		return applied, err
+	}
+	if version == sqliteSchemaVersion {
+		return applied, nil
+	}
+
+	// a database from before versioning is at version 0 but already holds data
+	var tables int
+	err = db.conn.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'`).Scan(&tables)
+	if err != nil {
+		return applied, err
+	}
+	if !dryRun && tables > 0 {
+		backupPath := fmt.Sprintf("%s.v%d-backup-%d", db.path, version, time.Now().Unix())
+		_, err = db.conn.Exec(`VACUUM INTO ?`, backupPath)
+		if err != nil {
+			return applied, err
+		}
+		applied = append(applied, "backed up version "+fmt.Sprint(version)+" to "+backupPath)
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return applied, err
+	}
+	defer tx.Rollback()
+
+	for _, m := range sqliteMigrations {
+		if m.version <= version {
+			continue
+		}
+		_, err = tx.Exec(m.sql)
+		if err == nil && m.backfill != nil {
+			err = m.backfill(tx)
+		}
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+		_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, m.version))
+		if err != nil {
+			return applied, err
+		}
+		applied = append(applied, fmt.Sprintf("%d: %s", m.version, m.description))
+	}
+
+	if dryRun {
+		return applied, nil
+	}
+	return applied, tx.Commit()
+}
+
+// schemaVersion reads the version stamped into the SQLite database
+func (db *SQLiteDB) schemaVersion() (int, error){
+	var version int
+	err := db.conn.QueryRow(`PRAGMA user_version`).Scan(&version)
+	return version, err
+}
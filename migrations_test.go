@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// baselineExpiry is when the refresh token in the baseline fixtures expires
+var baselineExpiry = time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newBaselineJSON copies testdata/baseline-database.json, a file written before the schema was versioned
+func newBaselineJSON(t *testing.T) string {
+	t.Helper()
+	dat, err := os.ReadFile(filepath.Join("testdata", "baseline-database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "database.json")
+	err = os.WriteFile(path, dat, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newBaselineSQLite creates the same data in the unversioned schema the SQLite store started with
+func newBaselineSQLite(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "database.db")
+	conn, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Exec(sqliteMigrations[0].sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashedPassword := []byte("$2a$10$baseline-hash-not-real")
+	statements := []struct {
+		query string
+		args []any
+	}{
+		{`INSERT INTO users (id, email, hashed_password, is_chirpy_red) VALUES (1, 'alice@example.com', ?, 1)`, []any{hashedPassword}},
+		{`INSERT INTO users (id, email, hashed_password, is_chirpy_red) VALUES (2, 'bob@example.com', ?, 0)`, []any{hashedPassword}},
+		{`INSERT INTO chirps (id, author_id, body) VALUES (1, 1, 'hello #Go from the baseline')`, nil},
+		{`INSERT INTO chirps (id, author_id, body) VALUES (2, 2, 'a second chirp for @alice')`, nil},
+		{`INSERT INTO refresh_tokens (token, user_id, expires_at) VALUES ('baseline-refresh-token', 1, ?)`, []any{baselineExpiry.UnixNano()}},
+	}
+	for _, statement := range statements {
+		_, err = conn.Exec(statement.query, statement.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+// checkBaselineMigrated checks that the baseline fixture survived every migration with its records backfilled
+func checkBaselineMigrated(t *testing.T, db Store) {
+	t.Helper()
+	chirp, err := db.ReadSingleChirp(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.Body != "hello #Go from the baseline" || chirp.AuthorID != 1 {
+		t.Errorf("chirp 1 changed: %+v", chirp)
+	}
+	if chirp.CreatedAt.IsZero() || !chirp.UpdatedAt.Equal(chirp.CreatedAt) {
+		t.Errorf("chirp 1 timestamps were not backfilled: created %v, updated %v", chirp.CreatedAt, chirp.UpdatedAt)
+	}
+	if len(chirp.Entities.Hashtags) != 1 || chirp.Entities.Hashtags[0].Tag != "go" {
+		t.Errorf("chirp 1 hashtags were not extracted: %+v", chirp.Entities.Hashtags)
+	}
+
+	// the baseline had no usernames, and an email local part no longer resolves a mention
+	chirp, err = db.ReadSingleChirp(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirp.Entities.Mentions) != 0 {
+		t.Errorf("chirp 2 mentions resolved without a username: %+v", chirp.Entities.Mentions)
+	}
+
+	user, err := db.ReadSingleUser(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "alice@example.com" || !user.IsChirpyRed || string(user.HashedPassword) != "$2a$10$baseline-hash-not-real" {
+		t.Errorf("user 1 changed: %+v", user)
+	}
+	if user.Role != RoleUser {
+		t.Errorf("user 1 has role %q, want %q", user.Role, RoleUser)
+	}
+	if user.CreatedAt.IsZero() {
+		t.Error("user 1 created_at was not backfilled")
+	}
+	if user.TwoFactor.Enabled || user.EmailVerified || user.Suspended {
+		t.Errorf("user 1 has flags the baseline did not: %+v", user)
+	}
+
+	refreshToken, err := db.ReadSingleRefreshTokenWDetails(hashRefreshToken("baseline-refresh-token"))
+	if err != nil {
+		t.Fatalf("baseline refresh token is not found by its hash: %v", err)
+	}
+	if refreshToken.UserID != 1 || !refreshToken.ExpiresAt.Equal(baselineExpiry) || refreshToken.FamilyID != "" {
+		t.Errorf("refresh token changed: %+v", refreshToken)
+	}
+	sessions, err := db.ReadSessions(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != refreshToken.SessionID {
+		t.Errorf("got sessions %+v, want one for the refresh token's session %d", sessions, refreshToken.SessionID)
+	}
+	_, err = db.ReadSingleRefreshTokenWDetails("baseline-refresh-token")
+	if err == nil {
+		t.Error("the raw refresh token is still stored")
+	}
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	stores := []struct {
+		kind string
+		fixture func(t *testing.T) string
+		migrations int
+	}{
+		{"json", newBaselineJSON, dbSchemaVersion},
+		{"sqlite", newBaselineSQLite, sqliteSchemaVersion},
+	}
+	for _, store := range stores {
+		t.Run(store.kind, func(t *testing.T) {
+			path := store.fixture(t)
+
+			db, err := NewStore(store.kind, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dryRun, err := db.Migrate(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(dryRun) != store.migrations {
+				t.Errorf("dry run reported %d migrations, want %d: %v", len(dryRun), store.migrations, dryRun)
+			}
+			// a dry run must leave the baseline as it was, including the raw refresh token
+			_, err = db.ReadSingleRefreshTokenWDetails(hashRefreshToken("baseline-refresh-token"))
+			if err == nil {
+				t.Error("dry run migrated the refresh tokens")
+			}
+
+			applied, err := db.Migrate(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// every migration plus the line about the backup
+			if len(applied) != store.migrations+1 {
+				t.Errorf("applied %d steps, want %d: %v", len(applied), store.migrations+1, applied)
+			}
+			checkBaselineMigrated(t, db)
+
+			chirp, err := db.CreateChirp("after the migration", 2, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chirp.ID != 3 {
+				t.Errorf("new chirp got ID %d, want 3 after the baseline chirps", chirp.ID)
+			}
+
+			err = db.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			reopened, err := NewStore(store.kind, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.Close()
+			again, err := reopened.Migrate(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(again) != 0 {
+				t.Errorf("migrations ran again after a restart: %v", again)
+			}
+			checkBaselineMigrated(t, reopened)
+		})
+	}
+}
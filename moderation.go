@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Moderation actions, from mildest to strictest
+const (
+	ModerationAllow = ""
+	ModerationMask = "mask"
+	ModerationHold = "hold"
+	ModerationReject = "reject"
+)
+
+// moderationMask replaces every masked span of a chirp body
+const moderationMask = "****"
+
+var errChirpRejected = errors.New("chirp was rejected by moderation")
+
+// defaultModerationRules apply when no rules file exists yet, they are the words chirpy always masked
+var defaultModerationRules = []ModerationRule{
+	{ID: "profanity", Words: []string{"kerfuffle", "sharbert", "fornax"}, Action: ModerationMask, Reason: "profanity"},
+}
+
+// ModerationRule flags chirp bodies containing any of its words or matching any of its patterns.
+// Words match whole words after Unicode normalization, so case, accents, fullwidth letters, invisible
+// characters and surrounding punctuation make no difference; a word of several words matches them in a row.
+// Patterns are regular expressions run against the normalized, lower-cased body.
+type ModerationRule struct {
+	ID string `json:"id"`
+	Words []string `json:"words,omitempty"`
+	Patterns []string `json:"patterns,omitempty"`
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+}
+
+// ModerationVerdict is the outcome of moderating a chirp body: the strictest action of the rules that
+// matched, their reason codes in rule order, and the body with the spans of masking rules replaced
+type ModerationVerdict struct {
+	Action string
+	Reasons []string
+	Body string
+}
+
+// Moderator holds the moderation rules, loaded from a JSON file and editable at runtime
+type Moderator struct {
+	mux *sync.RWMutex
+	path string
+	rules []ModerationRule
+	compiled []compiledRule
+}
+
+// compiledRule is a ModerationRule ready for matching
+type compiledRule struct {
+	phrases [][]string
+	patterns []*regexp.Regexp
+}
+
+// normalizedText is a chirp body folded for matching, with the byte span in the original body of every rune
+type normalizedText struct {
+	text string
+	// starts holds the byte offset in text of every rune, origins the original span it came from
+	starts []int
+	origins [][2]int
+}
+
+// NewModerator loads the rules at path, falling back to defaultModerationRules when the file does not exist
+func NewModerator(path string) (*Moderator, error) {
+	moderator := &Moderator{mux: &sync.RWMutex{}, path: path}
+
+	rules := defaultModerationRules
+	dat, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(dat, &rules)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	compiled, err := compileModerationRules(rules)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	moderator.rules, moderator.compiled = rules, compiled
+	return moderator, nil
+}
+
+// Rules returns a copy of the current rules
+func (moderator *Moderator) Rules() []ModerationRule {
+	moderator.mux.RLock()
+	defer moderator.mux.RUnlock()
+
+	return slices.Clone(moderator.rules)
+}
+
+// SetRules validates and replaces every rule, then saves them to the rules file
+func (moderator *Moderator) SetRules(rules []ModerationRule) error {
+	compiled, err := compileModerationRules(rules)
+	if err != nil {
+		return err
+	}
+
+	moderator.mux.Lock()
+	defer moderator.mux.Unlock()
+
+	dat, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := moderator.path + ".tmp"
+	err = os.WriteFile(tmpPath, dat, 0666)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, moderator.path)
+	if err != nil {
+		return err
+	}
+
+	moderator.rules, moderator.compiled = rules, compiled
+	return nil
+}
+
+// PutRule adds a rule or replaces the rule with the same ID
+func (moderator *Moderator) PutRule(rule ModerationRule) error {
+	rules := moderator.Rules()
+	i := slices.IndexFunc(rules, func(r ModerationRule) bool { return r.ID == rule.ID })
+	if i < 0 {
+		rules = append(rules, rule)
+	} else {
+		rules[i] = rule
+	}
+	return moderator.SetRules(rules)
+}
+
+// DeleteRule removes the rule with ruleID, reporting whether it existed
+func (moderator *Moderator) DeleteRule(ruleID string) (bool, error) {
+	rules := moderator.Rules()
+	i := slices.IndexFunc(rules, func(r ModerationRule) bool { return r.ID == ruleID })
+	if i < 0 {
+		return false, nil
+	}
+	return true, moderator.SetRules(slices.Delete(rules, i, i+1))
+}
+
+// compileModerationRules checks every rule and prepares it for matching
+func compileModerationRules(rules []ModerationRule) ([]compiledRule, error) {
+	compiled := []compiledRule{}
+	seen := map[string]bool{}
+	for _, rule := range rules {
+		if rule.ID == "" || seen[rule.ID] {
+			return nil, fmt.Errorf("every moderation rule needs a unique id, got %q", rule.ID)
+		}
+		seen[rule.ID] = true
+		if !slices.Contains([]string{ModerationMask, ModerationHold, ModerationReject}, rule.Action) {
+			return nil, fmt.Errorf("rule %q: action must be mask, hold or reject", rule.ID)
+		}
+		if rule.Reason == "" {
+			return nil, fmt.Errorf("rule %q: a reason code is required", rule.ID)
+		}
+
+		c := compiledRule{}
+		for _, word := range rule.Words {
+			phrase := tokenize(normalizeText(word).text)
+			if len(phrase) == 0 {
+				return nil, fmt.Errorf("rule %q: %q contains no letters or digits", rule.ID, word)
+			}
+			c.phrases = append(c.phrases, phrase)
+		}
+		for _, pattern := range rule.Patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", rule.ID, err)
+			}
+			c.patterns = append(c.patterns, re)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// Moderate runs every rule against body
+func (moderator *Moderator) Moderate(body string) ModerationVerdict {
+	moderator.mux.RLock()
+	defer moderator.mux.RUnlock()
+
+	normalized := normalizeText(body)
+	words := normalized.words()
+	verdict := ModerationVerdict{Action: ModerationAllow, Reasons: []string{}, Body: body}
+	masked := [][2]int{}
+
+	for i, rule := range moderator.rules {
+		spans := moderator.compiled[i].match(normalized, words)
+		if len(spans) == 0 {
+			continue
+		}
+		if !slices.Contains(verdict.Reasons, rule.Reason) {
+			verdict.Reasons = append(verdict.Reasons, rule.Reason)
+		}
+		if moderationSeverity(rule.Action) > moderationSeverity(verdict.Action) {
+			verdict.Action = rule.Action
+		}
+		if rule.Action == ModerationMask {
+			masked = append(masked, spans...)
+		}
+	}
+
+	verdict.Body = maskSpans(body, masked)
+	return verdict
+}
+
+// moderationSeverity orders the actions so the strictest one wins
+func moderationSeverity(action string) int {
+	return slices.Index([]string{ModerationAllow, ModerationMask, ModerationHold, ModerationReject}, action)
+}
+
+// match returns the original byte spans where the rule matches
+func (rule compiledRule) match(normalized normalizedText, words []normalizedWord) [][2]int {
+	spans := [][2]int{}
+	for _, phrase := range rule.phrases {
+		for i := 0; i+len(phrase) <= len(words); i++ {
+			found := true
+			for j, term := range phrase {
+				if words[i+j].text != term {
+					found = false
+					break
+				}
+			}
+			if found {
+				spans = append(spans, [2]int{words[i].start, words[i+len(phrase)-1].end})
+			}
+		}
+	}
+	for _, re := range rule.patterns {
+		for _, loc := range re.FindAllStringIndex(normalized.text, -1) {
+			if loc[0] < loc[1] {
+				spans = append(spans, normalized.origin(loc[0], loc[1]))
+			}
+		}
+	}
+	return spans
+}
+
+// normalizedWord is a word of a normalized body and its byte span in the original body
+type normalizedWord struct {
+	text string
+	start int
+	end int
+}
+
+// words splits the normalized text like tokenize does, keeping where each word came from
+func (normalized normalizedText) words() []normalizedWord {
+	words := []normalizedWord{}
+	start := -1
+	for i := 0; i <= len(normalized.starts); i++ {
+		inWord := false
+		if i < len(normalized.starts) {
+			r, _ := utf8.DecodeRuneInString(normalized.text[normalized.starts[i]:])
+			inWord = unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+		}
+		if inWord && start < 0 {
+			start = i
+		}
+		if !inWord && start >= 0 {
+			span := normalized.origin(normalized.starts[start], normalized.byteEnd(i-1))
+			words = append(words, normalizedWord{text: normalized.text[normalized.starts[start]:normalized.byteEnd(i-1)], start: span[0], end: span[1]})
+			start = -1
+		}
+	}
+	return words
+}
+
+// byteEnd is the byte offset in text just past rune i
+func (normalized normalizedText) byteEnd(i int) int {
+	if i+1 < len(normalized.starts) {
+		return normalized.starts[i+1]
+	}
+	return len(normalized.text)
+}
+
+// origin maps a byte range of the normalized text back to the original body
+func (normalized normalizedText) origin(start int, end int) [2]int {
+	first := sort.SearchInts(normalized.starts, start+1) - 1
+	last := sort.SearchInts(normalized.starts, end) - 1
+	return [2]int{normalized.origins[first][0], normalized.origins[last][1]}
+}
+
+// normalizeText lower-cases body, folds fullwidth forms and accented Latin letters to plain ASCII, and drops
+// combining marks and invisible format characters such as zero-width spaces and soft hyphens
+func normalizeText(body string) normalizedText {
+	normalized := normalizedText{}
+	builder := strings.Builder{}
+	for i, r := range body {
+		size := utf8.RuneLen(r)
+		if size < 0 {
+			size = 1
+		}
+		if unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Cf, r) {
+			// the dropped rune still belongs to the span of the rune before it
+			if n := len(normalized.origins); n > 0 {
+				normalized.origins[n-1][1] = i + size
+			}
+			continue
+		}
+		if r >= 0xFF01 && r <= 0xFF5E {
+			r -= 0xFEE0
+		}
+		r = unicode.ToLower(r)
+		folded := string(r)
+		if ascii, found := latinFolds[r]; found {
+			folded = ascii
+		}
+		for _, f := range folded {
+			normalized.starts = append(normalized.starts, builder.Len())
+			normalized.origins = append(normalized.origins, [2]int{i, i + size})
+			builder.WriteRune(f)
+		}
+	}
+	normalized.text = builder.String()
+	return normalized
+}
+
+// latinFolds maps lower-case accented Latin letters to their unaccented form
+var latinFolds = func() map[rune]string {
+	folds := map[rune]string{'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'ł': "l", 'đ': "d", 'ı': "i"}
+	for ascii, accented := range map[string]string{
+		"a": "àáâãäåāăą", "c": "çćĉċč", "d": "ď", "e": "èéêëēĕėęě", "g": "ĝğġģ", "h": "ĥħ",
+		"i": "ìíîïĩīĭįı", "j": "ĵ", "k": "ķ", "l": "ĺļľŀ", "n": "ñńņňŉ", "o": "òóôõöōŏő",
+		"r": "ŕŗř", "s": "śŝşšſ", "t": "ţťŧ", "u": "ùúûüũūŭůűų", "w": "ŵ", "y": "ýÿŷ", "z": "źżž",
+	} {
+		for _, r := range accented {
+			folds[r] = ascii
+		}
+	}
+	return folds
+}()
+
+// maskSpans replaces the given byte spans of body with moderationMask, merging overlapping spans
+func maskSpans(body string, spans [][2]int) string {
+	if len(spans) == 0 {
+		return body
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+
+	builder := strings.Builder{}
+	last := 0
+	for _, span := range spans {
+		if span[1] <= last {
+			continue
+		}
+		if span[0] >= last {
+			builder.WriteString(body[last:span[0]])
+			builder.WriteString(moderationMask)
+		}
+		last = span[1]
+	}
+	builder.WriteString(body[last:])
+	return builder.String()
+}
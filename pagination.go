@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit = 200
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// cursorWire is the JSON inside an opaque cursor, timestamps are kept as Unix nanoseconds to stay short
+type cursorWire struct {
+	ID int `json:"id"`
+	At int64 `json:"at,omitempty"`
+	Before bool `json:"before,omitempty"`
+	Score float64 `json:"score,omitempty"`
+}
+
+// encodeCursor turns a cursor into the opaque string clients send back
+func encodeCursor(cursor Cursor) string {
+	wire := cursorWire{ID: cursor.ID, Before: cursor.Before, Score: cursor.Score}
+	if !cursor.At.IsZero() {
+		wire.At = cursor.At.UnixNano()
+	}
+	dat, _ := json.Marshal(wire)
+	return base64.RawURLEncoding.EncodeToString(dat)
+}
+
+// decodeCursor parses a cursor produced by encodeCursor
+func decodeCursor(s string) (Cursor, error) {
+	cursor := Cursor{}
+	dat, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor, errInvalidCursor
+	}
+	wire := cursorWire{}
+	err = json.Unmarshal(dat, &wire)
+	if err != nil || wire.ID <= 0 {
+		return cursor, errInvalidCursor
+	}
+
+	cursor.ID = wire.ID
+	cursor.Before = wire.Before
+	cursor.Score = wire.Score
+	if wire.At != 0 {
+		cursor.At = time.Unix(0, wire.At).UTC()
+	}
+	return cursor, nil
+}
+
+// parseLimit reads the limit query parameter, falling back to defaultPageLimit
+func parseLimit(r *http.Request) (int, error) {
+	limitParam := r.URL.Query().Get("limit")
+	if limitParam == "" {
+		return defaultPageLimit, nil
+	}
+	limit, err := strconv.Atoi(limitParam)
+	if err != nil || limit < 1 || limit > maxPageLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+	}
+	return limit, nil
+}
+
+// writePageHeaders advertises the next and previous pages through Link and X-*-Cursor headers.
+// An empty cursor means there is no page in that direction.
+func writePageHeaders(w http.ResponseWriter, r *http.Request, nextCursor string, prevCursor string) {
+	links := []string{}
+	if nextCursor != "" {
+		w.Header().Set("X-Next-Cursor", nextCursor)
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(r, nextCursor)))
+	}
+	if prevCursor != "" {
+		w.Header().Set("X-Prev-Cursor", prevCursor)
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, pageURL(r, prevCursor)))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
+
+// pageURL is the request URL with its cursor parameter replaced
+func pageURL(r *http.Request, cursor string) string {
+	query := r.URL.Query()
+	query.Set("cursor", cursor)
+	u := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	return u.String()
+}
+
+// pageNewestFirst sorts items newest first by at, ties broken by id, and returns the page after cursor
+// along with whether more items follow it
+func pageNewestFirst[T any](items []T, at func(item T) time.Time, id func(item T) int, cursor *Cursor, limit int) ([]T, bool) {
+	newestFirst := ChirpQuery{Desc: true}
+	sort.Slice(items, func(i, j int) bool {
+		return newestFirst.precedes(at(items[i]), id(items[i]), at(items[j]), id(items[j]))
+	})
+
+	start := 0
+	if cursor != nil {
+		for start < len(items) && !newestFirst.precedes(cursor.At, cursor.ID, at(items[start]), id(items[start])) {
+			start++
+		}
+	}
+	end := min(start+limit, len(items))
+	return items[start:end], end < len(items)
+}
+
+// matches reports whether a chirp passes every filter of the query, ignoring the page window
+func (query ChirpQuery) matches(chirp Chirp) bool {
+	if !chirp.visible() && !query.IncludeDeleted {
+		return false
+	}
+	if query.InReplyTo != 0 && chirp.InReplyTo != query.InReplyTo {
+		return false
+	}
+	if query.AuthorID != 0 && chirp.AuthorID != query.AuthorID {
+		return false
+	}
+	if !query.CreatedFrom.IsZero() && chirp.CreatedAt.Before(query.CreatedFrom) {
+		return false
+	}
+	if !query.CreatedTo.IsZero() && !chirp.CreatedAt.Before(query.CreatedTo) {
+		return false
+	}
+	if query.Contains != "" && !strings.Contains(strings.ToLower(chirp.Body), strings.ToLower(query.Contains)) {
+		return false
+	}
+	if query.Hashtag != "" && !slices.ContainsFunc(chirp.Entities.Hashtags, func(hashtag Hashtag) bool { return hashtag.Tag == query.Hashtag }) {
+		return false
+	}
+	if query.MentionedUserID != 0 && !slices.ContainsFunc(chirp.Entities.Mentions, func(mention Mention) bool { return mention.UserID == query.MentionedUserID }) {
+		return false
+	}
+	if query.SinceID != 0 && chirp.ID <= query.SinceID {
+		return false
+	}
+	if query.MaxID != 0 && chirp.ID > query.MaxID {
+		return false
+	}
+	return true
+}
+
+// sortKey returns the timestamp a chirp is ordered by, zero when ordering by ID alone
+func (query ChirpQuery) sortKey(chirp Chirp) time.Time {
+	switch query.SortBy {
+	case "created_at":
+		return chirp.CreatedAt
+	case "updated_at":
+		return chirp.UpdatedAt
+	}
+	return time.Time{}
+}
+
+// precedes reports whether the position (atA, idA) comes before (atB, idB) in the query's order
+func (query ChirpQuery) precedes(atA time.Time, idA int, atB time.Time, idB int) bool {
+	if !atA.Equal(atB) {
+		return atA.Before(atB) != query.Desc
+	}
+	if idA == idB {
+		return false
+	}
+	return (idA < idB) != query.Desc
+}
+
+// sort puts chirps into the query's order, ties on a timestamp are broken by ID
+func (query ChirpQuery) sort(chirps []Chirp) {
+	sort.Slice(chirps, func(i, j int) bool {
+		return query.precedes(query.sortKey(chirps[i]), chirps[i].ID, query.sortKey(chirps[j]), chirps[j].ID)
+	})
+}
+
+// page cuts the window described by the query out of chirps that already match and are in order
+func (query ChirpQuery) page(sorted []Chirp) ChirpPage {
+	start, end := 0, len(sorted)
+	cursor := query.Cursor
+
+	if cursor != nil && !cursor.Before {
+		for start < len(sorted) && !query.precedes(cursor.At, cursor.ID, query.sortKey(sorted[start]), sorted[start].ID) {
+			start++
+		}
+		if query.Limit > 0 {
+			end = min(start+query.Limit, len(sorted))
+		}
+	} else if cursor != nil {
+		end = 0
+		for end < len(sorted) && query.precedes(query.sortKey(sorted[end]), sorted[end].ID, cursor.At, cursor.ID) {
+			end++
+		}
+		if query.Limit > 0 {
+			start = max(end-query.Limit, 0)
+		}
+	} else if query.Limit > 0 {
+		end = min(query.Limit, len(sorted))
+	}
+
+	return ChirpPage{Chirps: sorted[start:end], HasNext: end < len(sorted), HasPrev: start > 0}
+}
+
+// cursors returns the next and previous cursors for a page, empty when there is no such page
+func (chirpPage ChirpPage) cursors(query ChirpQuery) (string, string) {
+	nextCursor, prevCursor := "", ""
+	if len(chirpPage.Chirps) == 0 {
+		return nextCursor, prevCursor
+	}
+	if chirpPage.HasNext {
+		last := chirpPage.Chirps[len(chirpPage.Chirps)-1]
+		nextCursor = encodeCursor(Cursor{ID: last.ID, At: query.sortKey(last)})
+	}
+	if chirpPage.HasPrev {
+		first := chirpPage.Chirps[0]
+		prevCursor = encodeCursor(Cursor{ID: first.ID, At: query.sortKey(first), Before: true})
+	}
+	return nextCursor, prevCursor
+}
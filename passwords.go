@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms
+const (
+	PasswordHashBcrypt = "bcrypt"
+	PasswordHashArgon2id = "argon2id"
+)
+
+// maxPasswordLength caps passwords so that hashing a huge one cannot be used to tie up the server
+const maxPasswordLength = 64
+
+// bcryptMaxPasswordBytes is the longest password bcrypt hashes, it refuses longer ones
+const bcryptMaxPasswordBytes = 72
+
+var (
+	errWeakPassword = errors.New("password does not meet the password policy")
+	errUnknownPasswordHash = errors.New("password hash is in an unknown format")
+)
+
+// PasswordHasher hashes new passwords with one algorithm and its parameters. Every hash records the
+// algorithm and parameters it was made with, bcrypt as $2a$<cost>$... and argon2id in the PHC string
+// format $argon2id$v=19$m=<KiB>,t=<iterations>,p=<parallelism>$<salt>$<key>, so that checkPassword can
+// verify any of them whatever the current configuration is.
+type PasswordHasher interface {
+	Hash(password string) ([]byte, error)
+	// NeedsRehash reports whether hashedPassword was made with another algorithm or other parameters
+	NeedsRehash(hashedPassword []byte) bool
+}
+
+// NewPasswordHasher returns the hasher for algorithm, bcryptCost only applies to bcrypt and the argon2
+// parameters only to argon2id
+func NewPasswordHasher(algorithm string, bcryptCost int, argon2Memory uint32, argon2Iterations uint32, argon2Parallelism uint8) (PasswordHasher, error){
+	switch algorithm {
+	case PasswordHashBcrypt:
+		if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return BcryptHasher{Cost: bcryptCost}, nil
+	case PasswordHashArgon2id:
+		if argon2Memory < 8*uint32(argon2Parallelism) || argon2Iterations < 1 || argon2Parallelism < 1 {
+			return nil, errors.New("argon2id needs at least one iteration, one thread and 8 KiB of memory per thread")
+		}
+		return Argon2idHasher{Memory: argon2Memory, Iterations: argon2Iterations, Parallelism: argon2Parallelism}, nil
+	}
+	return nil, fmt.Errorf("unknown password hashing algorithm %q, expected %s or %s", algorithm, PasswordHashBcrypt, PasswordHashArgon2id)
+}
+
+// BcryptHasher hashes passwords with bcrypt at Cost
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(password string) ([]byte, error){
+	if len(password) > bcryptMaxPasswordBytes {
+		return nil, fmt.Errorf("%w: passwords are limited to %d bytes", errWeakPassword, bcryptMaxPasswordBytes)
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+}
+
+func (h BcryptHasher) NeedsRehash(hashedPassword []byte) bool {
+	cost, err := bcrypt.Cost(hashedPassword)
+	return err != nil || cost != h.Cost
+}
+
+// Argon2idHasher hashes passwords with argon2id using Memory KiB, Iterations passes and Parallelism threads
+type Argon2idHasher struct {
+	Memory uint32
+	Iterations uint32
+	Parallelism uint8
+}
+
+// argon2id salt and key sizes, as recommended by RFC 9106
+const (
+	argon2SaltLength = 16
+	argon2KeyLength = 32
+)
+
+func (h Argon2idHasher) Hash(password string) ([]byte, error){
+	salt := make([]byte, argon2SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, argon2KeyLength)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+func (h Argon2idHasher) NeedsRehash(hashedPassword []byte) bool {
+	params, salt, key, err := parseArgon2idHash(hashedPassword)
+	return err != nil || params != h || len(salt) != argon2SaltLength || len(key) != argon2KeyLength
+}
+
+// parseArgon2idHash splits an argon2id PHC string into its parameters, salt and key
+func parseArgon2idHash(hashedPassword []byte) (Argon2idHasher, []byte, []byte, error){
+	params := Argon2idHasher{}
+	parts := strings.Split(string(hashedPassword), "$")
+	if len(parts) != 6 || parts[1] != PasswordHashArgon2id || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return params, nil, nil, errUnknownPasswordHash
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return params, nil, nil, errUnknownPasswordHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errUnknownPasswordHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errUnknownPasswordHash
+	}
+	return params, salt, key, nil
+}
+
+// checkPassword reports whether password matches hashedPassword, made by any supported algorithm with
+// any parameters. The error is only set for a hash it cannot read.
+func checkPassword(hashedPassword []byte, password string) (bool, error){
+	if bytes.HasPrefix(hashedPassword, []byte("$"+PasswordHashArgon2id+"$")) {
+		params, salt, key, err := parseArgon2idHash(hashedPassword)
+		if err != nil {
+			return false, err
+		}
+		candidate := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+		return subtle.ConstantTimeCompare(candidate, key) == 1, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword(hashedPassword, []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", errUnknownPasswordHash, err)
+	}
+	return true, nil
+}
+
+// PasswordPolicy decides which new passwords are acceptable
+type PasswordPolicy struct {
+	MinLength int
+	// breached holds the upper-case hex SHA-1 of every password known from a breach
+	breached map[string]struct{}
+}
+
+// NewPasswordPolicy creates a policy requiring minLength characters. When breachedPath is set, the passwords
+// listed in that file are refused too. Each line is either a password or, as in the Have I Been Pwned
+// downloads, its SHA-1 in hex optionally followed by ":<count>".
+func NewPasswordPolicy(minLength int, breachedPath string) (*PasswordPolicy, error){
+	policy := &PasswordPolicy{MinLength: minLength, breached: map[string]struct{}{}}
+	if breachedPath == "" {
+		return policy, nil
+	}
+
+	file, err := os.Open(breachedPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if hash, _, _ := strings.Cut(line, ":"); isSHA1Hex(hash) {
+			policy.breached[strings.ToUpper(hash)] = struct{}{}
+			continue
+		}
+		policy.breached[sha1Hex(line)] = struct{}{}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", breachedPath, err)
+	}
+	return policy, nil
+}
+
+// Check returns an error wrapping errWeakPassword when password breaks the policy
+func (p *PasswordPolicy) Check(password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		return fmt.Errorf("%w: use at least %d characters", errWeakPassword, p.MinLength)
+	}
+	if length > maxPasswordLength {
+		return fmt.Errorf("%w: use at most %d characters", errWeakPassword, maxPasswordLength)
+	}
+	if _, breached := p.breached[sha1Hex(password)]; breached {
+		return fmt.Errorf("%w: this password appeared in a data breach, pick another one", errWeakPassword)
+	}
+	return nil
+}
+
+// isSHA1Hex reports whether s looks like a hex encoded SHA-1
+func isSHA1Hex(s string) bool {
+	if len(s) != sha1.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// sha1Hex is the upper-case hex SHA-1 of s, the form breach lists use
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// hashNewPassword checks a password a user picked against the policy and hashes it with the current hasher
+func (cfg *apiConfig)hashNewPassword(password string) ([]byte, error){
+	err := cfg.passwordPolicy.Check(password)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.passwordHasher.Hash(password)
+}
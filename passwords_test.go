@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// stored hashes of "correct horse battery", they have to keep verifying whatever the hasher is configured to
+const (
+	testArgon2idHash = "$argon2id$v=19$m=64,t=1,p=1$MDEyMzQ1Njc4OWFiY2RlZg$/ur5fLELUb1eXkT9oKHqq6gHGZ9Phwgbj4qyIcCNaYc"
+	testBcryptHash = "$2a$04$RuDw7B2NX/C2/QcXEAmT2uHDlYvyen4mv5h2Eunep56dF6FqtEkJu"
+)
+
+func TestCheckPassword(t *testing.T) {
+	tests := []struct {
+		name string
+		hash string
+		password string
+		ok bool
+		err error
+	}{
+		{"argon2id", testArgon2idHash, "correct horse battery", true, nil},
+		{"argon2id wrong password", testArgon2idHash, "correct horse battery staple", false, nil},
+		{"bcrypt", testBcryptHash, "correct horse battery", true, nil},
+		{"bcrypt wrong password", testBcryptHash, "Correct horse battery", false, nil},
+		{"argon2id other version", strings.Replace(testArgon2idHash, "v=19", "v=16", 1), "correct horse battery", false, errUnknownPasswordHash},
+		{"argon2id missing key", strings.TrimSuffix(testArgon2idHash, "$/ur5fLELUb1eXkT9oKHqq6gHGZ9Phwgbj4qyIcCNaYc"), "correct horse battery", false, errUnknownPasswordHash},
+		{"argon2id empty key", testArgon2idHash[:strings.LastIndex(testArgon2idHash, "$")+1], "correct horse battery", false, errUnknownPasswordHash},
+		{"argon2id bad parameters", strings.Replace(testArgon2idHash, "m=64,t=1,p=1", "m=64;t=1;p=1", 1), "correct horse battery", false, errUnknownPasswordHash},
+		{"argon2id bad salt", strings.Replace(testArgon2idHash, "MDEyMzQ1Njc4OWFiY2RlZg", "not*base64", 1), "correct horse battery", false, errUnknownPasswordHash},
+		{"plain text", "correct horse battery", "correct horse battery", false, errUnknownPasswordHash},
+		{"empty", "", "", false, errUnknownPasswordHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := checkPassword([]byte(tt.hash), tt.password)
+			if ok != tt.ok || !errors.Is(err, tt.err) {
+				t.Errorf("got %v, %v, want %v, %v", ok, err, tt.ok, tt.err)
+			}
+		})
+	}
+}
+
+func TestPasswordHasherRoundTrip(t *testing.T) {
+	hashers := map[string]PasswordHasher{
+		PasswordHashBcrypt: BcryptHasher{Cost: 4},
+		PasswordHashArgon2id: Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1},
+	}
+	for name, hasher := range hashers {
+		t.Run(name, func(t *testing.T) {
+			hash, err := hasher.Hash("correct horse battery")
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := hasher.Hash("correct horse battery")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(hash) == string(other) {
+				t.Error("two hashes of the same password are equal, the salt is not random")
+			}
+
+			ok, err := checkPassword(hash, "correct horse battery")
+			if !ok || err != nil {
+				t.Errorf("right password: got %v, %v", ok, err)
+			}
+			ok, err = checkPassword(hash, "wrong horse battery")
+			if ok || err != nil {
+				t.Errorf("wrong password: got %v, %v", ok, err)
+			}
+			if hasher.NeedsRehash(hash) {
+				t.Error("a fresh hash needs a rehash")
+			}
+		})
+	}
+}
+
+func TestArgon2idHashFormat(t *testing.T) {
+	hash, err := Argon2idHasher{Memory: 64, Iterations: 2, Parallelism: 1}.Hash("correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(hash), "$argon2id$v=19$m=64,t=2,p=1$") {
+		t.Errorf("hash %s is not in the PHC string format", hash)
+	}
+
+	params, salt, key, err := parseArgon2idHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params != (Argon2idHasher{Memory: 64, Iterations: 2, Parallelism: 1}) || len(salt) != argon2SaltLength || len(key) != argon2KeyLength {
+		t.Errorf("parsed %+v with a %d byte salt and %d byte key", params, len(salt), len(key))
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	argon2id := Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1}
+	shortSalt := strings.Replace(testArgon2idHash, "MDEyMzQ1Njc4OWFiY2RlZg", "MDEyMzQ1Njc4OQ", 1)
+
+	tests := []struct {
+		name string
+		hasher PasswordHasher
+		hash string
+		want bool
+	}{
+		{"argon2id same parameters", argon2id, testArgon2idHash, false},
+		{"argon2id more memory", Argon2idHasher{Memory: 128, Iterations: 1, Parallelism: 1}, testArgon2idHash, true},
+		{"argon2id more iterations", Argon2idHasher{Memory: 64, Iterations: 2, Parallelism: 1}, testArgon2idHash, true},
+		{"argon2id more threads", Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 2}, testArgon2idHash, true},
+		{"argon2id short salt", argon2id, shortSalt, true},
+		{"bcrypt to argon2id", argon2id, testBcryptHash, true},
+		{"bcrypt same cost", BcryptHasher{Cost: 4}, testBcryptHash, false},
+		{"bcrypt higher cost", BcryptHasher{Cost: 10}, testBcryptHash, true},
+		{"argon2id to bcrypt", BcryptHasher{Cost: 4}, testArgon2idHash, true},
+		{"garbage", argon2id, "garbage", true},
+	}
+	for _, tt := range tests {
+		if got := tt.hasher.NeedsRehash([]byte(tt.hash)); got != tt.want {
+			t.Errorf("%s: NeedsRehash = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewPasswordHasher(t *testing.T) {
+	tests := []struct {
+		name string
+		algorithm string
+		bcryptCost int
+		memory uint32
+		iterations uint32
+		parallelism uint8
+		ok bool
+	}{
+		{"bcrypt", PasswordHashBcrypt, 10, 0, 0, 0, true},
+		{"bcrypt cost too low", PasswordHashBcrypt, 3, 0, 0, 0, false},
+		{"bcrypt cost too high", PasswordHashBcrypt, 32, 0, 0, 0, false},
+		{"argon2id", PasswordHashArgon2id, 0, 64 * 1024, 3, 4, true},
+		{"argon2id too little memory per thread", PasswordHashArgon2id, 0, 31, 1, 4, false},
+		{"argon2id no iterations", PasswordHashArgon2id, 0, 64, 0, 1, false},
+		{"argon2id no threads", PasswordHashArgon2id, 0, 64, 1, 0, false},
+		{"unknown", "scrypt", 10, 64, 1, 1, false},
+	}
+	for _, tt := range tests {
+		_, err := NewPasswordHasher(tt.algorithm, tt.bcryptCost, tt.memory, tt.iterations, tt.parallelism)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestBcryptRefusesLongPasswords(t *testing.T) {
+	// bcrypt would silently ignore everything past 72 bytes, so such passwords are refused instead
+	_, err := BcryptHasher{Cost: 4}.Hash(strings.Repeat("é", 37))
+	if !errors.Is(err, errWeakPassword) {
+		t.Errorf("74 byte password: got %v, want %v", err, errWeakPassword)
+	}
+	_, err = BcryptHasher{Cost: 4}.Hash(strings.Repeat("a", 72))
+	if err != nil {
+		t.Errorf("72 byte password: %v", err)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	breachedPath := filepath.Join(t.TempDir(), "breached.txt")
+	// the SHA-1 of "password123456" with a count as in the Have I Been Pwned downloads, in lower case, and a plain password
+	err := os.WriteFile(breachedPath, []byte("98a16c09b0759e63ef7df53592724e8eeddb953a:12\r\ncorrect horse battery staple\n\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := NewPasswordPolicy(12, breachedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		password string
+		ok bool
+	}{
+		{"correct horse battery", true},
+		{"short", false},
+		{"12 characters", true},
+		{"eleven char", false},
+		// length is counted in characters, not bytes
+		{strings.Repeat("é", 12), true},
+		{strings.Repeat("é", maxPasswordLength), true},
+		{strings.Repeat("a", maxPasswordLength+1), false},
+		{"password123456", false},
+		{"correct horse battery staple", false},
+	}
+	for _, tt := range tests {
+		err := policy.Check(tt.password)
+		if (err == nil) != tt.ok || (err != nil && !errors.Is(err, errWeakPassword)) {
+			t.Errorf("Check(%q) = %v, want ok %v", tt.password, err, tt.ok)
+		}
+	}
+
+	_, err = NewPasswordPolicy(12, filepath.Join(t.TempDir(), "missing.txt"))
+	if err == nil {
+		t.Error("a missing breach list was accepted")
+	}
+}
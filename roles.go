@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Roles a user can have, every new account starts as RoleUser
+const (
+	RoleUser = "user"
+	RoleModerator = "moderator"
+	RoleAdmin = "admin"
+)
+
+// Permissions guarded by middlewareRequirePermission
+const (
+	PermissionReviewReports = "reports:review"
+	PermissionReviewHeldChirps = "moderation:review"
+	PermissionManageModerationRules = "moderation:rules"
+	PermissionViewMetrics = "metrics:view"
+	PermissionResetMetrics = "metrics:reset"
+	PermissionManageRoles = "users:roles"
+	PermissionResetTwoFactor = "users:2fa"
+	PermissionUnlockUsers = "users:unlock"
+	PermissionUnsuspendUsers = "users:unsuspend"
+)
+
+// rolePermissions lists what each role may do beyond what any signed-in user can
+var rolePermissions = map[string][]string{
+	RoleUser: {},
+	RoleModerator: {PermissionReviewReports, PermissionReviewHeldChirps},
+	RoleAdmin: {PermissionReviewReports, PermissionReviewHeldChirps, PermissionManageModerationRules, PermissionViewMetrics, PermissionResetMetrics, PermissionManageRoles, PermissionResetTwoFactor, PermissionUnlockUsers, PermissionUnsuspendUsers},
+}
+
+var errInvalidRole = fmt.Errorf("role must be %s, %s or %s", RoleUser, RoleModerator, RoleAdmin)
+
+// roleHasPermission reports whether role grants permission, an empty role from an older token counts as RoleUser
+func roleHasPermission(role string, permission string) bool {
+	if role == "" {
+		role = RoleUser
+	}
+	return slices.Contains(rolePermissions[role], permission)
+}
+
+// validateRole checks a role picked by an admin
+func validateRole(role string) error {
+	if _, exist := rolePermissions[role]; !exist {
+		return errInvalidRole
+	}
+	return nil
+}
+
+// bootstrapAdmin makes the user with email the first admin, it refuses once any admin exists so that
+// further roles are handed out through the API by an admin
+func bootstrapAdmin(store Store, email string) (User, error) {
+	users, err := store.ReadUsers()
+	if err != nil {
+		return User{}, err
+	}
+	for _, user := range users {
+		if user.Role == RoleAdmin {
+			return User{}, errors.New("an admin already exists, grant further roles with PUT /admin/users/{userID}/role")
+		}
+	}
+
+	user, err := store.ReadSingleUserbyEmail(email)
+	if err != nil {
+		return User{}, err
+	}
+	return store.UpdateUserRole(user.ID, RoleAdmin)
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	// maxPrefixExpansions caps how many indexed terms a single prefix like "a*" may stand for
+	maxPrefixExpansions = 100
+	bm25K1 = 1.2
+	bm25B = 0.75
+)
+
+var errEmptySearch = errors.New("search query must contain at least one word")
+
+// SearchIndex is an in-memory inverted index over chirp bodies plus a prefix index over usernames.
+// It is rebuilt from the store on startup and kept current by indexedStore.
+type SearchIndex struct {
+	mux *sync.RWMutex
+	// postings maps a term to the chirps containing it and the word positions it appears at
+	postings map[string]map[int][]int
+	// terms is every indexed term in sorted order, for prefix lookups
+	terms []string
+	chirpTerms map[int][]string
+	chirpLengths map[int]int
+	chirpAuthors map[int]int
+	totalLength int
+	// userKeys holds lower-cased usernames in sorted order. Emails are left out on purpose, user search
+	// is public and must not reveal who has an account.
+	userKeys []userKey
+	userKeysByID map[int][]string
+}
+
+// userKey is one searchable name of a user
+type userKey struct {
+	key string
+	userID int
+}
+
+// SearchQuery is a parsed chirp search, every clause must match
+type SearchQuery struct {
+	Clauses []SearchClause
+	AuthorID int
+	// Recent orders by newest first instead of relevance
+	Recent bool
+	Cursor *Cursor
+	Limit int
+}
+
+// SearchClause is one word, a word prefix, or a quoted phrase of consecutive words
+type SearchClause struct {
+	Terms []string
+	Prefix bool
+}
+
+// SearchHit is a chirp that matched a search and its relevance score
+type SearchHit struct {
+	ChirpID int
+	Score float64
+}
+
+// NewSearchIndex creates an empty search index
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		mux: &sync.RWMutex{},
+		postings: map[string]map[int][]int{},
+		chirpTerms: map[int][]string{},
+		chirpLengths: map[int]int{},
+		chirpAuthors: map[int]int{},
+		userKeysByID: map[int][]string{},
+	}
+}
+
+// Rebuild replaces the index contents with every live chirp and user in store
+func (index *SearchIndex) Rebuild(store Store) error {
+	chirps, err := store.ReadChirps()
+	if err != nil {
+		return err
+	}
+	users, err := store.ReadUsers()
+	if err != nil {
+		return err
+	}
+
+	fresh := NewSearchIndex()
+	for _, chirp := range chirps {
+		fresh.addChirp(chirp)
+	}
+	for _, user := range users {
+		fresh.addUser(user)
+	}
+
+	index.mux.Lock()
+	defer index.mux.Unlock()
+	mux := index.mux
+	*index = *fresh
+	index.mux = mux
+	return nil
+}
+
+// tokenize splits text into lower-cased words of letters, digits and underscores
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+}
+
+// IndexChirp adds a chirp, or replaces it when it is already indexed
+func (index *SearchIndex) IndexChirp(chirp Chirp) {
+	index.mux.Lock()
+	defer index.mux.Unlock()
+
+	index.removeChirp(chirp.ID)
+	if !chirp.Deleted {
+		index.addChirp(chirp)
+	}
+}
+
+// RemoveChirp drops a chirp from the index
+func (index *SearchIndex) RemoveChirp(chirpID int) {
+	index.mux.Lock()
+	defer index.mux.Unlock()
+
+	index.removeChirp(chirpID)
+}
+
+// addChirp indexes a chirp that is not indexed yet, the caller must hold the write lock
+func (index *SearchIndex) addChirp(chirp Chirp) {
+	words := tokenize(chirp.Body)
+	seen := map[string]bool{}
+	for position, word := range words {
+		docs := index.postings[word]
+		if docs == nil {
+			docs = map[int][]int{}
+			index.postings[word] = docs
+			i, _ := slices.BinarySearch(index.terms, word)
+			index.terms = slices.Insert(index.terms, i, word)
+		}
+		docs[chirp.ID] = append(docs[chirp.ID], position)
+		if !seen[word] {
+			seen[word] = true
+			index.chirpTerms[chirp.ID] = append(index.chirpTerms[chirp.ID], word)
+		}
+	}
+	index.chirpLengths[chirp.ID] = len(words)
+	index.chirpAuthors[chirp.ID] = chirp.AuthorID
+	index.totalLength += len(words)
+}
+
+// removeChirp forgets a chirp, the caller must hold the write lock
+func (index *SearchIndex) removeChirp(chirpID int) {
+	if _, indexed := index.chirpAuthors[chirpID]; !indexed {
+		return
+	}
+	for _, term := range index.chirpTerms[chirpID] {
+		delete(index.postings[term], chirpID)
+		if len(index.postings[term]) == 0 {
+			delete(index.postings, term)
+			i, found := slices.BinarySearch(index.terms, term)
+			if found {
+				index.terms = slices.Delete(index.terms, i, i+1)
+			}
+		}
+	}
+	index.totalLength -= index.chirpLengths[chirpID]
+	delete(index.chirpTerms, chirpID)
+	delete(index.chirpLengths, chirpID)
+	delete(index.chirpAuthors, chirpID)
+}
+
+// IndexUser adds a user, or replaces their username when they are already indexed
+func (index *SearchIndex) IndexUser(user User) {
+	index.mux.Lock()
+	defer index.mux.Unlock()
+
+	for _, key := range index.userKeysByID[user.ID] {
+		index.userKeys = slices.DeleteFunc(index.userKeys, func(k userKey) bool { return k.key == key && k.userID == user.ID })
+	}
+	delete(index.userKeysByID, user.ID)
+	index.addUser(user)
+}
+
+// addUser indexes the username of a user, the caller must hold the write lock
+func (index *SearchIndex) addUser(user User) {
+	key := strings.ToLower(user.Username)
+	if key == "" || slices.Contains(index.userKeysByID[user.ID], key) {
+		return
+	}
+	i := sort.Search(len(index.userKeys), func(i int) bool {
+		return index.userKeys[i].key > key || (index.userKeys[i].key == key && index.userKeys[i].userID >= user.ID)
+	})
+	index.userKeys = slices.Insert(index.userKeys, i, userKey{key: key, userID: user.ID})
+	index.userKeysByID[user.ID] = append(index.userKeysByID[user.ID], key)
+}
+
+// SearchUsers returns the IDs of up to limit users whose username starts with prefix, ignoring case
+func (index *SearchIndex) SearchUsers(prefix string, limit int) []int {
+	index.mux.RLock()
+	defer index.mux.RUnlock()
+
+	prefix = strings.ToLower(prefix)
+	userIDs := []int{}
+	seen := map[int]bool{}
+	start := sort.Search(len(index.userKeys), func(i int) bool { return index.userKeys[i].key >= prefix })
+	for i := start; i < len(index.userKeys) && strings.HasPrefix(index.userKeys[i].key, prefix) && len(userIDs) < limit; i++ {
+		if !seen[index.userKeys[i].userID] {
+			seen[index.userKeys[i].userID] = true
+			userIDs = append(userIDs, index.userKeys[i].userID)
+		}
+	}
+	return userIDs
+}
+
+// ParseSearchQuery splits q into clauses: plain words, words ending in * for a prefix match,
+// and "quoted phrases" whose words must appear next to each other
+func ParseSearchQuery(q string) ([]SearchClause, error) {
+	clauses := []SearchClause{}
+	for i, part := range strings.Split(q, `"`) {
+		if i%2 == 1 {
+			terms := tokenize(part)
+			if len(terms) > 0 {
+				clauses = append(clauses, SearchClause{Terms: terms})
+			}
+			continue
+		}
+		for _, field := range strings.Fields(part) {
+			terms := tokenize(field)
+			prefix := strings.HasSuffix(field, "*")
+			for j, term := range terms {
+				clauses = append(clauses, SearchClause{Terms: []string{term}, Prefix: prefix && j == len(terms)-1})
+			}
+		}
+	}
+	if len(clauses) == 0 {
+		return clauses, errEmptySearch
+	}
+	return clauses, nil
+}
+
+// SearchChirps returns one page of the chirps matching every clause of query and whether more follow.
+// Relevance is BM25 summed over the words of each clause.
+func (index *SearchIndex) SearchChirps(query SearchQuery) ([]SearchHit, bool) {
+	index.mux.RLock()
+	defer index.mux.RUnlock()
+
+	var scores map[int]float64
+	for _, clause := range query.Clauses {
+		clauseScores := index.matchClause(clause, scores)
+		if scores == nil {
+			scores = clauseScores
+			continue
+		}
+		for chirpID := range scores {
+			if _, match := clauseScores[chirpID]; match {
+				scores[chirpID] += clauseScores[chirpID]
+			} else {
+				delete(scores, chirpID)
+			}
+		}
+	}
+
+	hits := []SearchHit{}
+	for chirpID, score := range scores {
+		if query.AuthorID != 0 && index.chirpAuthors[chirpID] != query.AuthorID {
+			continue
+		}
+		if query.Recent {
+			score = 0
+		}
+		hit := SearchHit{ChirpID: chirpID, Score: score}
+		if query.Cursor != nil && !hitBefore(Cursor{ID: query.Cursor.ID, Score: query.Cursor.Score}, hit) {
+			continue
+		}
+		hits = append(hits, hit)
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		return hitBefore(Cursor{ID: hits[i].ChirpID, Score: hits[i].Score}, hits[j])
+	})
+
+	if len(hits) > query.Limit {
+		return hits[:query.Limit], true
+	}
+	return hits, false
+}
+
+// hitBefore reports whether position comes before hit: higher score first, then newer chirp first
+func hitBefore(position Cursor, hit SearchHit) bool {
+	if position.Score != hit.Score {
+		return position.Score > hit.Score
+	}
+	return position.ID > hit.ChirpID
+}
+
+// matchClause scores the chirps matching one clause. When within is not nil only those chirps are considered.
+func (index *SearchIndex) matchClause(clause SearchClause, within map[int]float64) map[int]float64 {
+	scores := map[int]float64{}
+
+	if clause.Prefix {
+		term := clause.Terms[0]
+		start, _ := slices.BinarySearch(index.terms, term)
+		for i := start; i < len(index.terms) && i-start < maxPrefixExpansions && strings.HasPrefix(index.terms[i], term); i++ {
+			for chirpID := range index.postings[index.terms[i]] {
+				if within == nil || hasKey(within, chirpID) {
+					scores[chirpID] += index.bm25(index.terms[i], chirpID)
+				}
+			}
+		}
+		return scores
+	}
+
+	for chirpID, positions := range index.postings[clause.Terms[0]] {
+		if within != nil && !hasKey(within, chirpID) {
+			continue
+		}
+		if !index.phraseAt(clause.Terms, chirpID, positions) {
+			continue
+		}
+		for _, term := range clause.Terms {
+			scores[chirpID] += index.bm25(term, chirpID)
+		}
+	}
+	return scores
+}
+
+// phraseAt reports whether the terms appear consecutively in a chirp, starting at one of positions
+func (index *SearchIndex) phraseAt(terms []string, chirpID int, positions []int) bool {
+	for _, start := range positions {
+		found := true
+		for offset, term := range terms[1:] {
+			if !slices.Contains(index.postings[term][chirpID], start+offset+1) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// bm25 scores how well a single term describes a chirp
+func (index *SearchIndex) bm25(term string, chirpID int) float64 {
+	docs := float64(len(index.chirpLengths))
+	df := float64(len(index.postings[term]))
+	tf := float64(len(index.postings[term][chirpID]))
+	avgLength := float64(index.totalLength) / max(docs, 1)
+	idf := math.Log(1 + (docs-df+0.5)/(df+0.5))
+	return idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*float64(index.chirpLengths[chirpID])/max(avgLength, 1)))
+}
+
+// hasKey reports whether m contains key
+func hasKey[K comparable, V any](m map[K]V, key K) bool {
+	_, ok := m[key]
+	return ok
+}
+
+// indexedStore is a Store that keeps a SearchIndex current with every chirp and user it writes
+type indexedStore struct {
+	Store
+	search *SearchIndex
+}
+
+// CreateChirp creates a chirp and indexes its body
+func (store *indexedStore) CreateChirp(body string, authorID int, inReplyTo int) (Chirp, error){
+	chirp, err := store.Store.CreateChirp(body, authorID, inReplyTo)
+	if err == nil {
+		store.search.IndexChirp(chirp)
+	}
+	return chirp, err
+}
+
+// UpdateChirp edits a chirp and reindexes its new body
+func (store *indexedStore) UpdateChirp(chirpID int, body string) (Chirp, error){
+	chirp, err := store.Store.UpdateChirp(chirpID, body)
+	if err == nil {
+		store.search.IndexChirp(chirp)
+	}
+	return chirp, err
+}
+
+// DeleteSingleChirp deletes a chirp and drops it from the index, tombstones have no body left to find
+func (store *indexedStore) DeleteSingleChirp(chirpID int) error{
+	err := store.Store.DeleteSingleChirp(chirpID)
+	if err == nil {
+		store.search.RemoveChirp(chirpID)
+	}
+	return err
+}
+
+// ApproveHeldChirp publishes a held chirp and indexes it
+func (store *indexedStore) ApproveHeldChirp(heldID int) (Chirp, error){
+	chirp, err := store.Store.ApproveHeldChirp(heldID)
+	if err == nil {
+		store.search.IndexChirp(chirp)
+	}
+	return chirp, err
+}
+
+// ResolveReport resolves a report and drops the chirp from the index when it was hidden
+func (store *indexedStore) ResolveReport(reportID int, resolution string) (Report, error){
+	report, err := store.Store.ResolveReport(reportID, resolution)
+	if err == nil && resolution == ResolutionHideChirp {
+		store.search.RemoveChirp(report.ChirpID)
+	}
+	return report, err
+}
+
+// CreateUsers creates a user and indexes their username
+func (store *indexedStore) CreateUsers(email string, username string, hashedPassword []byte) (User, error){
+	user, err := store.Store.CreateUsers(email, username, hashedPassword)
+	if err == nil {
+		store.search.IndexUser(user)
+	}
+	return user, err
+}
+
+// UpdateUser updates a user and reindexes their username
+func (store *indexedStore) UpdateUser(newEmail string, newUsername string, newHashedPassword []byte, userID int) (User, error){
+	user, err := store.Store.UpdateUser(newEmail, newUsername, newHashedPassword, userID)
+	if err == nil {
+		store.search.IndexUser(user)
+	}
+	return user, err
+}
@@ -0,0 +1,1693 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteDB is a Store backed by an embedded SQLite database file
+type SQLiteDB struct {
+	path string
+	conn *sql.DB
+}
+
+// chirpColumns is the column list every chirp SELECT passes to queryChirps
+const chirpColumns = `id, author_id, body, in_reply_to, reply_count, like_count, rechirp_count, entities, deleted, hidden, author_suspended, created_at, updated_at`
+
+// userColumns is the column list every user SELECT passes to scanUser
+const userColumns = `id, email, email_verified, username, hashed_password, is_chirpy_red, suspended, role, totp_secret, totp_enabled, recovery_codes, totp_last_step, created_at, updated_at`
+
+// refreshTokenColumns is the column list every refresh token SELECT passes to readRefreshToken
+const refreshTokenColumns = `token_hash, user_id, session_id, expires_at, rotated_at`
+
+// sessionColumns is the column list every session SELECT passes to scanSession
+const sessionColumns = `id, user_id, device_name, user_agent, ip, audience, created_at, last_used_at`
+
+// reportColumns is the column list every report SELECT passes to queryReports
+const reportColumns = `id, chirp_id, reporter_id, reason, details, status, resolution, created_at, resolved_at`
+
+// NewSQLiteDB opens the SQLite database at path, the schema is created by Migrate
+func NewSQLiteDB(path string) (*SQLiteDB, error){
+	// secure_delete zeroes deleted content, so raw refresh tokens replaced by their hashes do not linger in free pages
+	conn, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_pragma=secure_delete(1)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, serialize through one connection to avoid SQLITE_BUSY
+	conn.SetMaxOpenConns(1)
+
+	db := &SQLiteDB{path: path, conn: conn}
+	version, err := db.schemaVersion()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if version > sqliteSchemaVersion {
+		conn.Close()
+		return nil, fmt.Errorf("%s has schema version %d but this build only supports up to %d", path, version, sqliteSchemaVersion)
+	}
+	return db, nil
+}
+
+// Close closes the underlying database connection
+func (db *SQLiteDB) Close() error{
+	return db.conn.Close()
+}
+
+// CreateChirp creates a new chirp and saves it to disk
+func (db *SQLiteDB) CreateChirp(body string, authorID int, inReplyTo int) (Chirp, error){
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	chirp, err := createChirpTx(tx, body, authorID, inReplyTo)
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, tx.Commit()
+}
+
+// createChirpTx adds a chirp within tx and counts it as a reply on its parent
+func createChirpTx(tx *sql.Tx, body string, authorID int, inReplyTo int) (Chirp, error){
+	if inReplyTo != 0 {
+		res, err := tx.Exec(`UPDATE chirps SET reply_count = reply_count + 1 WHERE id = ? AND deleted = 0 AND hidden = 0 AND author_suspended = 0`, inReplyTo)
+		if err != nil {
+			return Chirp{}, err
+		}
+		err = requireAffected(res, ErrParentChirpNotExist)
+		if err != nil {
+			return Chirp{}, err
+		}
+	}
+
+	createdAt := time.Now().UTC()
+	var id int64
+	var authorSuspended bool
+	err := tx.QueryRow(`INSERT INTO chirps (author_id, body, in_reply_to, author_suspended, created_at, updated_at)
+		VALUES (?, ?, ?, COALESCE((SELECT suspended FROM users WHERE id = ?), 0), ?, ?) RETURNING id, author_suspended`,
+		authorID, body, inReplyTo, authorID, createdAt.UnixNano(), createdAt.UnixNano()).Scan(&id, &authorSuspended)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	entities, err := sqliteChirpEntities(tx, body)
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = writeChirpEntities(tx, int(id), entities)
+	if err != nil {
+		return Chirp{}, err
+	}
+	return Chirp{ID: int(id), AuthorID: authorID, Body: body, InReplyTo: inReplyTo, Entities: entities, AuthorSuspended: authorSuspended, CreatedAt: createdAt, UpdatedAt: createdAt}, nil
+}
+
+// HoldChirp queues a chirp that moderation wants reviewed before it is published
+func (db *SQLiteDB) HoldChirp(body string, authorID int, inReplyTo int, reasons []string) (HeldChirp, error){
+	if inReplyTo != 0 {
+		_, err := db.ReadSingleChirp(inReplyTo)
+		if errors.Is(err, ErrChirpNotExist) {
+			return HeldChirp{}, ErrParentChirpNotExist
+		}
+		if err != nil {
+			return HeldChirp{}, err
+		}
+	}
+
+	reasonsJSON, err := json.Marshal(reasons)
+	if err != nil {
+		return HeldChirp{}, err
+	}
+	createdAt := time.Now().UTC()
+	res, err := db.conn.Exec(`INSERT INTO held_chirps (author_id, body, in_reply_to, reasons, created_at) VALUES (?, ?, ?, ?, ?)`, authorID, body, inReplyTo, string(reasonsJSON), createdAt.UnixNano())
+	if err != nil {
+		return HeldChirp{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return HeldChirp{}, err
+	}
+	return HeldChirp{ID: int(id), AuthorID: authorID, Body: body, InReplyTo: inReplyTo, Reasons: reasons, CreatedAt: createdAt}, nil
+}
+
+// ReadHeldChirps returns the chirps waiting for review, oldest first
+func (db *SQLiteDB) ReadHeldChirps() ([]HeldChirp, error){
+	return queryHeldChirps(db.conn, `SELECT id, author_id, body, in_reply_to, reasons, created_at FROM held_chirps ORDER BY id`)
+}
+
+// ApproveHeldChirp publishes a held chirp and removes it from the review queue
+func (db *SQLiteDB) ApproveHeldChirp(heldID int) (Chirp, error){
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	held, err := queryHeldChirps(tx, `SELECT id, author_id, body, in_reply_to, reasons, created_at FROM held_chirps WHERE id = ?`, heldID)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if len(held) == 0 {
+		return Chirp{}, ErrHeldChirpNotExist
+	}
+	_, err = tx.Exec(`DELETE FROM held_chirps WHERE id = ?`, heldID)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	chirp, err := createChirpTx(tx, held[0].Body, held[0].AuthorID, held[0].InReplyTo)
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, tx.Commit()
+}
+
+// DiscardHeldChirp drops a held chirp without publishing it
+func (db *SQLiteDB) DiscardHeldChirp(heldID int) error{
+	res, err := db.conn.Exec(`DELETE FROM held_chirps WHERE id = ?`, heldID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res, ErrHeldChirpNotExist)
+}
+
+// ReportChirp files a report against a chirp, a reporter who already has an open report on it gets that one back
+func (db *SQLiteDB) ReportChirp(chirpID int, reporterID int, reason string, details string) (Report, error){
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Report{}, err
+	}
+	defer tx.Rollback()
+
+	var exist bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM chirps WHERE id = ? AND deleted = 0 AND hidden = 0 AND author_suspended = 0)`, chirpID).Scan(&exist)
+	if err != nil {
+		return Report{}, err
+	}
+	if !exist {
+		return Report{}, ErrChirpNotExist
+	}
+
+	existing, err := queryReports(tx, `SELECT `+reportColumns+` FROM reports WHERE chirp_id = ? AND reporter_id = ? AND status = ?`, chirpID, reporterID, ReportOpen)
+	if err != nil {
+		return Report{}, err
+	}
+	if len(existing) > 0 {
+		return existing[0], nil
+	}
+
+	createdAt := time.Now().UTC()
+	res, err := tx.Exec(`INSERT INTO reports (chirp_id, reporter_id, reason, details, status, created_at) VALUES (?, ?, ?, ?, ?, ?)`, chirpID, reporterID, reason, details, ReportOpen, createdAt.UnixNano())
+	if err != nil {
+		return Report{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Report{}, err
+	}
+	return Report{ID: int(id), ChirpID: chirpID, ReporterID: reporterID, Reason: reason, Details: details, Status: ReportOpen, CreatedAt: createdAt}, tx.Commit()
+}
+
+// ReadReports returns a page of the reports with status, or of every report when status is empty, oldest first
+func (db *SQLiteDB) ReadReports(status string, cursor *Cursor, limit int) (ReportPage, error){
+	afterID := 0
+	if cursor != nil {
+		afterID = cursor.ID
+	}
+	reports, err := queryReports(db.conn, `SELECT `+reportColumns+` FROM reports WHERE (? = '' OR status = ?) AND id > ? ORDER BY id LIMIT ?`, status, status, afterID, limit+1)
+	if err != nil {
+		return ReportPage{}, err
+	}
+	if len(reports) > limit {
+		return ReportPage{Reports: reports[:limit], HasNext: true}, nil
+	}
+	return ReportPage{Reports: reports}, nil
+}
+
+// ResolveReport closes an open report. Hiding the chirp or suspending its author also resolves every other
+// open report on the same chirp, since they are about the same thing.
+func (db *SQLiteDB) ResolveReport(reportID int, resolution string) (Report, error){
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Report{}, err
+	}
+	defer tx.Rollback()
+
+	reports, err := queryReports(tx, `SELECT `+reportColumns+` FROM reports WHERE id = ?`, reportID)
+	if err != nil {
+		return Report{}, err
+	}
+	if len(reports) == 0 {
+		return Report{}, ErrReportNotExist
+	}
+	report := reports[0]
+	if report.Status != ReportOpen {
+		return Report{}, ErrReportResolved
+	}
+
+	now := time.Now().UTC()
+	switch resolution {
+	case ResolutionHideChirp:
+		_, err = tx.Exec(`UPDATE chirps SET hidden = 1 WHERE id = ?`, report.ChirpID)
+	case ResolutionSuspendAuthor:
+		var authorID int
+		err = tx.QueryRow(`SELECT author_id FROM chirps WHERE id = ?`, report.ChirpID).Scan(&authorID)
+		if err == nil {
+			err = setUserSuspendedTx(tx, authorID, true)
+		}
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, ErrUserNotExist) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return Report{}, err
+	}
+
+	if resolution == ResolutionDismiss {
+		_, err = tx.Exec(`UPDATE reports SET status = ?, resolution = ?, resolved_at = ? WHERE id = ?`, ReportResolved, resolution, now.UnixNano(), reportID)
+	} else {
+		_, err = tx.Exec(`UPDATE reports SET status = ?, resolution = ?, resolved_at = ? WHERE chirp_id = ? AND status = ?`, ReportResolved, resolution, now.UnixNano(), report.ChirpID, ReportOpen)
+	}
+	if err != nil {
+		return Report{}, err
+	}
+
+	report.Status = ReportResolved
+	report.Resolution = resolution
+	report.ResolvedAt = &now
+	return report, tx.Commit()
+}
+
+// ReadChirps returns all chirps in the database
+func (db *SQLiteDB) ReadChirps() ([]Chirp, error){
+	return db.queryChirps(`SELECT `+chirpColumns+` FROM chirps WHERE deleted = 0 AND hidden = 0 AND author_suspended = 0 ORDER BY id`)
+}
+
+// ReadChirpsByAuthorID returns all chirps with the same authorID in the database
+func (db *SQLiteDB) ReadChirpsByAuthorID(authorID int) ([]Chirp, error){
+	return db.queryChirps(`SELECT `+chirpColumns+` FROM chirps WHERE author_id = ? AND deleted = 0 AND hidden = 0 AND author_suspended = 0 ORDER BY id`, authorID)
+}
+
+// QueryChirps returns one page of the chirps matching query in the order it asks for
+func (db *SQLiteDB) QueryChirps(query ChirpQuery) (ChirpPage, error){
+	where := []string{}
+	args := []any{}
+
+	if !query.IncludeDeleted {
+		where = append(where, "deleted = 0", "hidden = 0", "author_suspended = 0")
+	}
+	if query.InReplyTo != 0 {
+		where = append(where, "in_reply_to = ?")
+		args = append(args, query.InReplyTo)
+	}
+	if query.AuthorID != 0 {
+		where = append(where, "author_id = ?")
+		args = append(args, query.AuthorID)
+	}
+	if !query.CreatedFrom.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, query.CreatedFrom.UnixNano())
+	}
+	if !query.CreatedTo.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, query.CreatedTo.UnixNano())
+	}
+	if query.Contains != "" {
+		where = append(where, "instr(lower(body), lower(?)) > 0")
+		args = append(args, query.Contains)
+	}
+	if query.Hashtag != "" {
+		where = append(where, "id IN (SELECT chirp_id FROM chirp_tags WHERE tag = ?)")
+		args = append(args, query.Hashtag)
+	}
+	if query.MentionedUserID != 0 {
+		where = append(where, "id IN (SELECT chirp_id FROM chirp_mentions WHERE user_id = ?)")
+		args = append(args, query.MentionedUserID)
+	}
+	if query.SinceID != 0 {
+		where = append(where, "id > ?")
+		args = append(args, query.SinceID)
+	}
+	if query.MaxID != 0 {
+		where = append(where, "id <= ?")
+		args = append(args, query.MaxID)
+	}
+
+	// rows are compared on (sort column, id) so that ties on a timestamp still page stably
+	position, placeholders, orderBy := "id", "?", []string{"id"}
+	switch query.SortBy {
+	case "":
+	case "created_at", "updated_at":
+		position, placeholders, orderBy = "("+query.SortBy+", id)", "(?, ?)", []string{query.SortBy, "id"}
+	default:
+		return ChirpPage{}, fmt.Errorf("cannot sort chirps by %q", query.SortBy)
+	}
+	cursorArgs := func(cursor *Cursor) []any {
+		if query.SortBy == "" {
+			return []any{cursor.ID}
+		}
+		return []any{cursor.At.UnixNano(), cursor.ID}
+	}
+
+	// a before-cursor is read in the opposite order and flipped back afterwards
+	desc, backwards := query.Desc, false
+	if query.Cursor != nil {
+		backwards = query.Cursor.Before
+		if desc != backwards {
+			where = append(where, position+" < "+placeholders)
+		} else {
+			where = append(where, position+" > "+placeholders)
+		}
+		args = append(args, cursorArgs(query.Cursor)...)
+		desc = desc != backwards
+	}
+
+	direction := " ASC"
+	if desc {
+		direction = " DESC"
+	}
+	stmt := `SELECT ` + chirpColumns + ` FROM chirps`
+	if len(where) > 0 {
+		stmt += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	stmt += ` ORDER BY ` + strings.Join(orderBy, direction+", ") + direction
+	if query.Limit > 0 {
+		stmt += ` LIMIT ?`
+		args = append(args, query.Limit+1)
+	}
+
+	chirps, err := db.queryChirps(stmt, args...)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	more := query.Limit > 0 && len(chirps) > query.Limit
+	if more {
+		chirps = chirps[:query.Limit]
+	}
+	for i := range chirps {
+		chirps[i] = chirps[i].tombstone()
+	}
+	if backwards {
+		slices.Reverse(chirps)
+		return ChirpPage{Chirps: chirps, HasNext: true, HasPrev: more}, nil
+	}
+	return ChirpPage{Chirps: chirps, HasNext: more, HasPrev: query.Cursor != nil}, nil
+}
+
+// ReadSingleChirp returns a chirp in the database using a chirpID
+func (db *SQLiteDB) ReadSingleChirp(chirpID int) (Chirp, error){
+	chirp := Chirp{}
+	chirps, err := db.queryChirps(`SELECT `+chirpColumns+` FROM chirps WHERE id = ? AND deleted = 0 AND hidden = 0 AND author_suspended = 0`, chirpID)
+	if err != nil {
+		return chirp, err
+	}
+	if len(chirps) == 0 {
+		return chirp, ErrChirpNotExist
+	}
+	return chirps[0], nil
+}
+
+// ReadChirpsByIDs returns the live chirps among chirpIDs in the order given, missing and deleted ones are skipped
+func (db *SQLiteDB) ReadChirpsByIDs(chirpIDs []int) ([]Chirp, error){
+	if len(chirpIDs) == 0 {
+		return []Chirp{}, nil
+	}
+	chirps, err := db.queryChirps(`SELECT `+chirpColumns+` FROM chirps WHERE deleted = 0 AND hidden = 0 AND author_suspended = 0 AND id IN (?`+strings.Repeat(", ?", len(chirpIDs)-1)+`)`, idArgs(chirpIDs)...)
+	if err != nil {
+		return chirps, err
+	}
+	return inIDOrder(chirpIDs, chirps, func(chirp Chirp) int { return chirp.ID }), nil
+}
+
+// ReadChirpLineage returns a chirp followed by the chain of chirps it replies to, up to the root.
+// Deleted and hidden chirps are included as tombstones so that a thread stays connected, but a hidden
+// chirp cannot be asked for itself.
+func (db *SQLiteDB) ReadChirpLineage(chirpID int) ([]Chirp, error){
+	lineage, err := db.queryChirps(`WITH RECURSIVE lineage(id, depth) AS (
+			SELECT id, 0 FROM chirps WHERE id = ? AND hidden = 0 AND author_suspended = 0
+			UNION ALL
+			SELECT chirps.in_reply_to, lineage.depth + 1 FROM chirps JOIN lineage ON chirps.id = lineage.id WHERE chirps.in_reply_to != 0
+		)
+		SELECT `+chirpColumns+` FROM chirps JOIN lineage USING (id) ORDER BY depth`, chirpID)
+	if err != nil {
+		return lineage, err
+	}
+	if len(lineage) == 0 {
+		return lineage, ErrChirpNotExist
+	}
+	for i := range lineage {
+		lineage[i] = lineage[i].tombstone()
+	}
+	return lineage, nil
+}
+
+// UpdateChirp replaces the body of a chirp and keeps the previous body as a revision
+func (db *SQLiteDB) UpdateChirp(chirpID int, body string) (Chirp, error){
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	var oldBody string
+	var oldUpdatedAt int64
+	err = tx.QueryRow(`SELECT body, updated_at FROM chirps WHERE id = ? AND deleted = 0`, chirpID).Scan(&oldBody, &oldUpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpNotExist
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	now := time.Now().UTC()
+	_, err = tx.Exec(`INSERT INTO chirp_revisions (chirp_id, revision, body, created_at, replaced_at)
+		VALUES (?, (SELECT COUNT(*) + 1 FROM chirp_revisions WHERE chirp_id = ?), ?, ?, ?)`, chirpID, chirpID, oldBody, oldUpdatedAt, now.UnixNano())
+	if err != nil {
+		return Chirp{}, err
+	}
+	_, err = tx.Exec(`UPDATE chirps SET body = ?, updated_at = ? WHERE id = ?`, body, now.UnixNano(), chirpID)
+	if err != nil {
+		return Chirp{}, err
+	}
+	entities, err := sqliteChirpEntities(tx, body)
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = writeChirpEntities(tx, chirpID, entities)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Chirp{}, err
+	}
+	return db.ReadSingleChirp(chirpID)
+}
+
+// ReadChirpHistory returns the previous bodies of a chirp, oldest first
+func (db *SQLiteDB) ReadChirpHistory(chirpID int) ([]ChirpRevision, error){
+	revisions := []ChirpRevision{}
+
+	rows, err := db.conn.Query(`SELECT revision, chirp_id, body, created_at, replaced_at FROM chirp_revisions WHERE chirp_id = ? ORDER BY revision`, chirpID)
+	if err != nil {
+		return revisions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		revision := ChirpRevision{}
+		var createdAt, replacedAt int64
+		err = rows.Scan(&revision.Revision, &revision.ChirpID, &revision.Body, &createdAt, &replacedAt)
+		if err != nil {
+			return revisions, err
+		}
+		revision.CreatedAt = time.Unix(0, createdAt).UTC()
+		revision.ReplacedAt = time.Unix(0, replacedAt).UTC()
+		revisions = append(revisions, revision)
+	}
+	return revisions, rows.Err()
+}
+
+// DeleteSingleChirp deletes a Chirp and its revisions from the database. A chirp that has replies
+// is kept as an empty tombstone so the thread under it stays reachable, and tombstones left without
+// any replies are removed up the chain.
+func (db *SQLiteDB) DeleteSingleChirp(chirpID int) error{
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var replyCount, inReplyTo int
+	err = tx.QueryRow(`SELECT reply_count, in_reply_to FROM chirps WHERE id = ? AND deleted = 0`, chirpID).Scan(&replyCount, &inReplyTo)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrChirpNotExist
+	}
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"chirp_revisions", "likes", "rechirps", "chirp_tags", "chirp_mentions"} {
+		_, err = tx.Exec(`DELETE FROM `+table+` WHERE chirp_id = ?`, chirpID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if replyCount > 0 {
+		_, err = tx.Exec(`UPDATE chirps SET body = '', entities = '{"hashtags":[],"mentions":[]}', deleted = 1, like_count = 0, rechirp_count = 0, updated_at = ? WHERE id = ?`, time.Now().UTC().UnixNano(), chirpID)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	for id := chirpID; ; {
+		_, err = tx.Exec(`DELETE FROM chirps WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		if inReplyTo == 0 {
+			break
+		}
+
+		var deleted bool
+		var grandparent int
+		err = tx.QueryRow(`UPDATE chirps SET reply_count = reply_count - 1 WHERE id = ? RETURNING reply_count, deleted, in_reply_to`, inReplyTo).Scan(&replyCount, &deleted, &grandparent)
+		if errors.Is(err, sql.ErrNoRows) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !deleted || replyCount > 0 {
+			break
+		}
+		// the parent is a tombstone with nothing left under it, remove it as well
+		id, inReplyTo = inReplyTo, grandparent
+	}
+	return tx.Commit()
+}
+
+// CreateUsers creates a new User and saves it to disk
+func (db *SQLiteDB) CreateUsers(email string, username string, hashedPassword []byte) (User, error){
+	now := time.Now().UTC()
+	res, err := db.conn.Exec(`INSERT INTO users (email, username, hashed_password, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`, email, username, hashedPassword, now.UnixNano(), now.UnixNano())
+	if isUniqueViolation(err) {
+		return User{}, userUniqueError(err)
+	}
+	if err != nil {
+		return User{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	return User{ID: int(id), Email: email, Username: username, HashedPassword: hashedPassword, Role: RoleUser, CreatedAt: now, UpdatedAt: now}, nil
+}
+
+// UpdateUser update a User and saves it to disk, an empty newEmail or newUsername and a nil newHashedPassword
+// keep the current value
+func (db *SQLiteDB) UpdateUser(newEmail string, newUsername string, newHashedPassword []byte, userID int) (User, error){
+	// a nil []byte would be stored as an empty password hash, only an untyped nil becomes NULL
+	var hashedPassword any
+	if newHashedPassword != nil {
+		hashedPassword = newHashedPassword
+	}
+	res, err := db.conn.Exec(`UPDATE users SET email_verified = CASE WHEN ? IN ('', email) THEN email_verified ELSE 0 END, email = CASE WHEN ? = '' THEN email ELSE ? END,
+		username = CASE WHEN ? = '' THEN username ELSE ? END, hashed_password = COALESCE(?, hashed_password), updated_at = ? WHERE id = ?`,
+		newEmail, newEmail, newEmail, newUsername, newUsername, hashedPassword, time.Now().UTC().UnixNano(), userID)
+	if isUniqueViolation(err) {
+		return User{}, userUniqueError(err)
+	}
+	if err != nil {
+		return User{}, err
+	}
+	err = requireAffected(res, ErrUserNotExist)
+	if err != nil {
+		return User{}, err
+	}
+	return db.readUser(`WHERE id = ?`, userID)
+}
+
+// UpdateUserPassword swaps the hash only WHERE it still equals currentHashedPassword, so two changes racing
+// from the same old hash cannot both win. The loser gets ErrPasswordChanged, or ErrUserNotExist if the
+// user is gone.
+func (db *SQLiteDB) UpdateUserPassword(userID int, currentHashedPassword []byte, newHashedPassword []byte) (User, error){
+	res, err := db.conn.Exec(`UPDATE users SET hashed_password = ?, updated_at = ? WHERE id = ? AND hashed_password = ?`, newHashedPassword, time.Now().UTC().UnixNano(), userID, currentHashedPassword)
+	if err != nil {
+		return User{}, err
+	}
+	err = requireAffected(res, ErrPasswordChanged)
+	if err != nil {
+		_, readErr := db.readUser(`WHERE id = ?`, userID)
+		if readErr != nil {
+			return User{}, readErr
+		}
+		return User{}, err
+	}
+	return db.readUser(`WHERE id = ?`, userID)
+}
+
+// VerifyUserEmail sets email_verified while email is still the address of the user and returns
+// ErrEmailChanged once it was changed, the UPDATE checks it again in case it changed after the read
+func (db *SQLiteDB) VerifyUserEmail(userID int, email string) (User, error){
+	user, err := db.readUser(`WHERE id = ?`, userID)
+	if err != nil {
+		return User{}, err
+	}
+	if user.Email != email {
+		return User{}, ErrEmailChanged
+	}
+	if user.EmailVerified {
+		return user, nil
+	}
+
+	res, err := db.conn.Exec(`UPDATE users SET email_verified = 1, updated_at = ? WHERE id = ? AND email = ?`, time.Now().UTC().UnixNano(), userID, email)
+	if err != nil {
+		return User{}, err
+	}
+	err = requireAffected(res, ErrEmailChanged)
+	if err != nil {
+		return User{}, err
+	}
+	return db.readUser(`WHERE id = ?`, userID)
+}
+
+// UpgradeUser upgrade a User to Chripy Red and saves it to disk
+func (db *SQLiteDB) UpgradeUser(userID int) (User, error){
+	res, err := db.conn.Exec(`UPDATE users SET is_chirpy_red = 1, updated_at = ? WHERE id = ?`, time.Now().UTC().UnixNano(), userID)
+	if err != nil {
+		return User{}, err
+	}
+	err = requireAffected(res, ErrUserNotExist)
+	if err != nil {
+		return User{}, err
+	}
+	return db.readUser(`WHERE id = ?`, userID)
+}
+
+// UpdateUserRole gives a user a new role, demoting the only admin left is refused
+func (db *SQLiteDB) UpdateUserRole(userID int, role string) (User, error){
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	var currentRole string
+	var admins int
+	err = tx.QueryRow(`SELECT role, (SELECT COUNT(*) FROM users WHERE role = ?) FROM users WHERE id = ?`, RoleAdmin, userID).Scan(&currentRole, &admins)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotExist
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if currentRole == RoleAdmin && role != RoleAdmin && admins == 1 {
+		return User{}, ErrLastAdmin
+	}
+
+	_, err = tx.Exec(`UPDATE users SET role = ?, updated_at = ? WHERE id = ?`, role, time.Now().UTC().UnixNano(), userID)
+	if err != nil {
+		return User{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return User{}, err
+	}
+	return db.readUser(`WHERE id = ?`, userID)
+}
+
+// UpdateUserSuspended suspends or reinstates a user, a suspended user cannot sign in and their chirps are hidden
+func (db *SQLiteDB) UpdateUserSuspended(userID int, suspended bool) (User, error){
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	err = setUserSuspendedTx(tx, userID, suspended)
+	if err != nil {
+		return User{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return User{}, err
+	}
+	return db.readUser(`WHERE id = ?`, userID)
+}
+
+// setUserSuspendedTx changes the suspension of a user within tx and copies it onto every chirp they wrote
+func setUserSuspendedTx(tx *sql.Tx, userID int, suspended bool) error{
+	res, err := tx.Exec(`UPDATE users SET suspended = ?, updated_at = ? WHERE id = ?`, suspended, time.Now().UTC().UnixNano(), userID)
+	if err != nil {
+		return err
+	}
+	err = requireAffected(res, ErrUserNotExist)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE chirps SET author_suspended = ? WHERE author_id = ? AND author_suspended != ?`, suspended, userID, suspended)
+	return err
+}
+
+// UpdateUserTwoFactor replaces the whole two-factor state of a user, TwoFactor{} turns it off
+func (db *SQLiteDB) UpdateUserTwoFactor(userID int, twoFactor TwoFactor) (User, error){
+	recoveryCodes, err := json.Marshal(twoFactor.RecoveryCodeHashes)
+	if err != nil {
+		return User{}, err
+	}
+
+	res, err := db.conn.Exec(`UPDATE users SET totp_secret = ?, totp_enabled = ?, recovery_codes = ?, totp_last_step = ?, updated_at = ? WHERE id = ?`,
+		twoFactor.Secret, twoFactor.Enabled, string(recoveryCodes), twoFactor.LastStep, time.Now().UTC().UnixNano(), userID)
+	if err != nil {
+		return User{}, err
+	}
+	err = requireAffected(res, ErrUserNotExist)
+	if err != nil {
+		return User{}, err
+	}
+	return db.readUser(`WHERE id = ?`, userID)
+}
+
+// ConsumeTwoFactorStep accepts a TOTP code for step at most once: it fails with ErrTwoFactorCodeUsed
+// unless step is later than every step accepted before, so a code cannot be replayed, not even an older one
+func (db *SQLiteDB) ConsumeTwoFactorStep(userID int, step int64) error{
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var lastStep int64
+	err = tx.QueryRow(`SELECT totp_last_step FROM users WHERE id = ?`, userID).Scan(&lastStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotExist
+	}
+	if err != nil {
+		return err
+	}
+	if step <= lastStep {
+		return ErrTwoFactorCodeUsed
+	}
+
+	_, err = tx.Exec(`UPDATE users SET totp_last_step = ? WHERE id = ?`, step, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ConsumeRecoveryCode removes a recovery code by its hash so it works only once, and returns how many are left
+func (db *SQLiteDB) ConsumeRecoveryCode(userID int, recoveryCodeHash string) (int, error){
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var recoveryCodes string
+	err = tx.QueryRow(`SELECT recovery_codes FROM users WHERE id = ?`, userID).Scan(&recoveryCodes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrUserNotExist
+	}
+	if err != nil {
+		return 0, err
+	}
+	hashes := []string{}
+	err = json.Unmarshal([]byte(recoveryCodes), &hashes)
+	if err != nil {
+		return 0, err
+	}
+	i := slices.Index(hashes, recoveryCodeHash)
+	if i == -1 {
+		return 0, ErrRecoveryCodeNotExist
+	}
+	hashes = slices.Delete(hashes, i, i+1)
+
+	remaining, err := json.Marshal(hashes)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`UPDATE users SET recovery_codes = ? WHERE id = ?`, string(remaining), userID)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return len(hashes), nil
+}
+
+// ReadUsers returns all users in the database
+func (db *SQLiteDB) ReadUsers() ([]User, error){
+	return db.queryUsers(`SELECT ` + userColumns + ` FROM users ORDER BY id`)
+}
+
+// ReadUsersByIDs returns the users among userIDs in the order given, missing ones are skipped
+func (db *SQLiteDB) ReadUsersByIDs(userIDs []int) ([]User, error){
+	if len(userIDs) == 0 {
+		return []User{}, nil
+	}
+	users, err := db.queryUsers(`SELECT `+userColumns+` FROM users WHERE id IN (?`+strings.Repeat(", ?", len(userIDs)-1)+`)`, idArgs(userIDs)...)
+	if err != nil {
+		return users, err
+	}
+	return inIDOrder(userIDs, users, func(user User) int { return user.ID }), nil
+}
+
+// queryUsers runs a query selecting userColumns and scans every row
+func (db *SQLiteDB) queryUsers(query string, args ...any) ([]User, error){
+	usersSlice := []User{}
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return usersSlice, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return usersSlice, err
+		}
+		usersSlice = append(usersSlice, user)
+	}
+	return usersSlice, rows.Err()
+}
+
+// ReadSingleUser returns a user in the database using a userID
+func (db *SQLiteDB) ReadSingleUser(userID int) (User, error){
+	return db.readUser(`WHERE id = ?`, userID)
+}
+
+// ReadSingleUserbyEmail returns a user in the database
+func (db *SQLiteDB) ReadSingleUserbyEmail(userEmail string) (User, error){
+	user, err := db.readUser(`WHERE email = ?`, userEmail)
+	if errors.Is(err, ErrUserNotExist) {
+		return user, ErrNoUserWithEmail
+	}
+	return user, err
+}
+
+// FollowUser makes followerID follow followeeID, following someone twice keeps the original follow
+func (db *SQLiteDB) FollowUser(followerID int, followeeID int) (Follow, error){
+	if followerID == followeeID {
+		return Follow{}, ErrCannotFollowSelf
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Follow{}, err
+	}
+	defer tx.Rollback()
+
+	var exist bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)`, followeeID).Scan(&exist)
+	if err != nil {
+		return Follow{}, err
+	}
+	if !exist {
+		return Follow{}, ErrUserNotExist
+	}
+
+	_, err = tx.Exec(`INSERT OR IGNORE INTO follows (follower_id, followee_id, created_at) VALUES (?, ?, ?)`, followerID, followeeID, time.Now().UTC().UnixNano())
+	if err != nil {
+		return Follow{}, err
+	}
+	follows, err := queryFollows(tx, `SELECT follower_id, followee_id, created_at FROM follows WHERE follower_id = ? AND followee_id = ?`, followerID, followeeID)
+	if err != nil {
+		return Follow{}, err
+	}
+	return follows[0], tx.Commit()
+}
+
+// UnfollowUser stops followerID from following followeeID
+func (db *SQLiteDB) UnfollowUser(followerID int, followeeID int) error{
+	res, err := db.conn.Exec(`DELETE FROM follows WHERE follower_id = ? AND followee_id = ?`, followerID, followeeID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res, ErrNotFollowing)
+}
+
+// ReadFollowers returns a page of the users following userID, newest follow first
+func (db *SQLiteDB) ReadFollowers(userID int, cursor *Cursor, limit int) (FollowPage, error){
+	return db.readFollowPage("followee_id", "follower_id", userID, cursor, limit)
+}
+
+// ReadFollowing returns a page of the users userID follows, newest follow first
+func (db *SQLiteDB) ReadFollowing(userID int, cursor *Cursor, limit int) (FollowPage, error){
+	return db.readFollowPage("follower_id", "followee_id", userID, cursor, limit)
+}
+
+// readFollowPage lists the follows whose userColumn is userID, ordered by follow time then otherColumn
+func (db *SQLiteDB) readFollowPage(userColumn string, otherColumn string, userID int, cursor *Cursor, limit int) (FollowPage, error){
+	_, err := db.readUser(`WHERE id = ?`, userID)
+	if err != nil {
+		return FollowPage{}, err
+	}
+
+	stmt := `SELECT follower_id, followee_id, created_at FROM follows WHERE ` + userColumn + ` = ?`
+	args := []any{userID}
+	if cursor != nil {
+		stmt += ` AND (created_at, ` + otherColumn + `) < (?, ?)`
+		args = append(args, cursor.At.UnixNano(), cursor.ID)
+	}
+	stmt += ` ORDER BY created_at DESC, ` + otherColumn + ` DESC LIMIT ?`
+	args = append(args, limit+1)
+
+	follows, err := queryFollows(db.conn, stmt, args...)
+	if err != nil {
+		return FollowPage{}, err
+	}
+	followPage := FollowPage{Follows: follows, HasNext: len(follows) > limit}
+	if followPage.HasNext {
+		followPage.Follows = follows[:limit]
+	}
+	return followPage, nil
+}
+
+// ReadTimeline returns a page of the chirps and rechirps by userID and everyone they follow, newest first.
+// The timeline is assembled on read, the follows primary key and the author and rechirp indexes keep the lookup cheap.
+func (db *SQLiteDB) ReadTimeline(userID int, cursor *Cursor, limit int) (ChirpPage, error){
+	stmt := `SELECT * FROM (
+			SELECT ` + chirpColumns + `, created_at AS at, 0 AS rechirped_by FROM chirps
+			WHERE deleted = 0 AND hidden = 0 AND author_suspended = 0 AND (author_id = ? OR author_id IN (SELECT followee_id FROM follows WHERE follower_id = ?))
+			UNION ALL
+			SELECT ` + prefixColumns("chirps", chirpColumns) + `, rechirps.created_at, rechirps.user_id FROM rechirps JOIN chirps ON chirps.id = rechirps.chirp_id
+			WHERE chirps.deleted = 0 AND chirps.hidden = 0 AND chirps.author_suspended = 0 AND (rechirps.user_id = ? OR rechirps.user_id IN (SELECT followee_id FROM follows WHERE follower_id = ?))
+		)`
+	args := []any{userID, userID, userID, userID}
+	if cursor != nil {
+		stmt += ` WHERE (at, id) < (?, ?)`
+		args = append(args, cursor.At.UnixNano(), cursor.ID)
+	}
+	stmt += ` ORDER BY at DESC, id DESC LIMIT ?`
+	args = append(args, limit+1)
+
+	rows, err := db.conn.Query(stmt, args...)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		var at int64
+		var rechirpedBy int
+		chirp, err := scanChirp(rows, &at, &rechirpedBy)
+		if err != nil {
+			return ChirpPage{}, err
+		}
+		if rechirpedBy != 0 {
+			rechirpedAt := time.Unix(0, at).UTC()
+			chirp.RechirpedBy, chirp.RechirpedAt = rechirpedBy, &rechirpedAt
+		}
+		chirps = append(chirps, chirp)
+	}
+	err = rows.Err()
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	chirpPage := ChirpPage{Chirps: chirps, HasNext: len(chirps) > limit, HasPrev: cursor != nil}
+	if chirpPage.HasNext {
+		chirpPage.Chirps = chirps[:limit]
+	}
+	return chirpPage, nil
+}
+
+// LikeChirp records that userID likes chirpID, liking a chirp twice keeps the first like
+func (db *SQLiteDB) LikeChirp(userID int, chirpID int) (Chirp, error){
+	return db.engage("likes", "like_count", userID, chirpID)
+}
+
+// UnlikeChirp removes the like of userID from chirpID
+func (db *SQLiteDB) UnlikeChirp(userID int, chirpID int) (Chirp, error){
+	return db.disengage("likes", "like_count", userID, chirpID, ErrNotLiked)
+}
+
+// RechirpChirp records that userID rechirped chirpID, rechirping a chirp twice keeps the first rechirp
+func (db *SQLiteDB) RechirpChirp(userID int, chirpID int) (Chirp, error){
+	return db.engage("rechirps", "rechirp_count", userID, chirpID)
+}
+
+// UnrechirpChirp removes the rechirp of chirpID by userID
+func (db *SQLiteDB) UnrechirpChirp(userID int, chirpID int) (Chirp, error){
+	return db.disengage("rechirps", "rechirp_count", userID, chirpID, ErrNotRechirped)
+}
+
+// engage inserts a like or rechirp and bumps countColumn on the chirp
+func (db *SQLiteDB) engage(table string, countColumn string, userID int, chirpID int) (Chirp, error){
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	var exist bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM chirps WHERE id = ? AND deleted = 0 AND hidden = 0 AND author_suspended = 0)`, chirpID).Scan(&exist)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if !exist {
+		return Chirp{}, ErrChirpNotExist
+	}
+
+	res, err := tx.Exec(`INSERT OR IGNORE INTO `+table+` (chirp_id, user_id, created_at) VALUES (?, ?, ?)`, chirpID, userID, time.Now().UTC().UnixNano())
+	if err != nil {
+		return Chirp{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return Chirp{}, err
+	}
+	if n > 0 {
+		_, err = tx.Exec(`UPDATE chirps SET `+countColumn+` = `+countColumn+` + 1 WHERE id = ?`, chirpID)
+		if err != nil {
+			return Chirp{}, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Chirp{}, err
+	}
+	return db.ReadSingleChirp(chirpID)
+}
+
+// disengage deletes a like or rechirp and lowers countColumn on the chirp, notEngaged is returned when there is none
+func (db *SQLiteDB) disengage(table string, countColumn string, userID int, chirpID int, notEngaged error) (Chirp, error){
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM `+table+` WHERE chirp_id = ? AND user_id = ?`, chirpID, userID)
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = requireAffected(res, notEngaged)
+	if err != nil {
+		return Chirp{}, err
+	}
+	_, err = tx.Exec(`UPDATE chirps SET `+countColumn+` = `+countColumn+` - 1 WHERE id = ?`, chirpID)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Chirp{}, err
+	}
+	return db.ReadSingleChirp(chirpID)
+}
+
+// ReadChirpLikes returns a page of the likes of a chirp, newest first
+func (db *SQLiteDB) ReadChirpLikes(chirpID int, cursor *Cursor, limit int) (EngagementPage, error){
+	return db.readEngagementPage("likes", chirpID, cursor, limit)
+}
+
+// ReadChirpRechirps returns a page of the rechirps of a chirp, newest first
+func (db *SQLiteDB) ReadChirpRechirps(chirpID int, cursor *Cursor, limit int) (EngagementPage, error){
+	return db.readEngagementPage("rechirps", chirpID, cursor, limit)
+}
+
+// readEngagementPage lists the likes or rechirps of a chirp ordered by time then user ID
+func (db *SQLiteDB) readEngagementPage(table string, chirpID int, cursor *Cursor, limit int) (EngagementPage, error){
+	_, err := db.ReadSingleChirp(chirpID)
+	if err != nil {
+		return EngagementPage{}, err
+	}
+
+	stmt := `SELECT user_id, chirp_id, created_at FROM ` + table + ` WHERE chirp_id = ?`
+	args := []any{chirpID}
+	if cursor != nil {
+		stmt += ` AND (created_at, user_id) < (?, ?)`
+		args = append(args, cursor.At.UnixNano(), cursor.ID)
+	}
+	stmt += ` ORDER BY created_at DESC, user_id DESC LIMIT ?`
+	args = append(args, limit+1)
+
+	rows, err := db.conn.Query(stmt, args...)
+	if err != nil {
+		return EngagementPage{}, err
+	}
+	defer rows.Close()
+
+	engagements := []Engagement{}
+	for rows.Next() {
+		engagement := Engagement{}
+		var createdAt int64
+		err = rows.Scan(&engagement.UserID, &engagement.ChirpID, &createdAt)
+		if err != nil {
+			return EngagementPage{}, err
+		}
+		engagement.CreatedAt = time.Unix(0, createdAt).UTC()
+		engagements = append(engagements, engagement)
+	}
+	err = rows.Err()
+	if err != nil {
+		return EngagementPage{}, err
+	}
+
+	engagementPage := EngagementPage{Engagements: engagements, HasNext: len(engagements) > limit}
+	if engagementPage.HasNext {
+		engagementPage.Engagements = engagements[:limit]
+	}
+	return engagementPage, nil
+}
+
+// ReadLikedChirpIDs reports which of chirpIDs userID has liked
+func (db *SQLiteDB) ReadLikedChirpIDs(userID int, chirpIDs []int) (map[int]bool, error){
+	return db.readEngagedChirpIDs("likes", userID, chirpIDs)
+}
+
+// ReadRechirpedChirpIDs reports which of chirpIDs userID has rechirped
+func (db *SQLiteDB) ReadRechirpedChirpIDs(userID int, chirpIDs []int) (map[int]bool, error){
+	return db.readEngagedChirpIDs("rechirps", userID, chirpIDs)
+}
+
+// readEngagedChirpIDs looks up a whole page of chirps in a single query on the likes or rechirps table
+func (db *SQLiteDB) readEngagedChirpIDs(table string, userID int, chirpIDs []int) (map[int]bool, error){
+	engaged := map[int]bool{}
+	if len(chirpIDs) == 0 {
+		return engaged, nil
+	}
+
+	args := append([]any{userID}, idArgs(chirpIDs)...)
+	rows, err := db.conn.Query(`SELECT chirp_id FROM `+table+` WHERE user_id = ? AND chirp_id IN (?`+strings.Repeat(", ?", len(chirpIDs)-1)+`)`, args...)
+	if err != nil {
+		return engaged, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var chirpID int
+		err = rows.Scan(&chirpID)
+		if err != nil {
+			return engaged, err
+		}
+		engaged[chirpID] = true
+	}
+	return engaged, rows.Err()
+}
+
+// CreateRefreshTokenWDetails starts a session for session.UserID with its first refresh token and saves both to disk
+func (db *SQLiteDB) CreateRefreshTokenWDetails(session Session, refreshTokenHash string, refreshTokenExpiry time.Time) (RefreshToken, Session, error){
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return RefreshToken{}, Session{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	res, err := tx.Exec(`INSERT INTO sessions (user_id, device_name, user_agent, ip, audience, created_at, last_used_at) VALUES (?, ?, ?, ?, ?, ?, ?)`, session.UserID, session.DeviceName, session.UserAgent, session.IP, session.Audience, now.UnixNano(), now.UnixNano())
+	if err != nil {
+		return RefreshToken{}, Session{}, err
+	}
+	sessionID, err := res.LastInsertId()
+	if err != nil {
+		return RefreshToken{}, Session{}, err
+	}
+	session.ID, session.Current, session.CreatedAt, session.LastUsedAt = int(sessionID), false, now, now
+
+	_, err = tx.Exec(`INSERT INTO refresh_tokens (token_hash, user_id, session_id, expires_at) VALUES (?, ?, ?, ?)`, refreshTokenHash, session.UserID, session.ID, refreshTokenExpiry.UnixNano())
+	if err != nil {
+		return RefreshToken{}, Session{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return RefreshToken{}, Session{}, err
+	}
+	return RefreshToken{UserID: session.UserID, TokenHash: refreshTokenHash, SessionID: session.ID, ExpiresAt: refreshTokenExpiry}, session, nil
+}
+
+// ReadSingleRefreshTokenWDetails returns a refresh token in the database, a rotated token no longer exists
+func (db *SQLiteDB) ReadSingleRefreshTokenWDetails(refreshTokenHash string) (RefreshToken, error){
+	refreshTokenStruct, err := readRefreshToken(db.conn.QueryRow(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE token_hash = ?`, refreshTokenHash))
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if refreshTokenStruct.RotatedAt != nil {
+		return RefreshToken{}, ErrRefreshTokenNotExist
+	}
+	if refreshTokenStruct.ExpiresAt.Before(time.Now()) {
+		return RefreshToken{}, ErrRefreshTokenExpired
+	}
+	return refreshTokenStruct, nil
+}
+
+// RotateRefreshToken marks a refresh token as rotated, issues the new one in its session and records the use
+func (db *SQLiteDB) RotateRefreshToken(refreshTokenHash string, newRefreshTokenHash string, newRefreshTokenExpiry time.Time, ip string, userAgent string) (RefreshToken, Session, error){
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return RefreshToken{}, Session{}, err
+	}
+	defer tx.Rollback()
+
+	old, err := readRefreshToken(tx.QueryRow(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE token_hash = ?`, refreshTokenHash))
+	if err != nil {
+		return RefreshToken{}, Session{}, err
+	}
+	if old.RotatedAt != nil {
+		err = deleteSessionTx(tx, old.SessionID)
+		if err != nil {
+			return RefreshToken{}, Session{}, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return RefreshToken{}, Session{}, err
+		}
+		return old, Session{}, ErrRefreshTokenReused
+	}
+	if old.ExpiresAt.Before(time.Now()) {
+		return RefreshToken{}, Session{}, ErrRefreshTokenExpired
+	}
+
+	now := time.Now().UTC().UnixNano()
+	_, err = tx.Exec(`UPDATE refresh_tokens SET rotated_at = ? WHERE token_hash = ?`, now, refreshTokenHash)
+	if err != nil {
+		return RefreshToken{}, Session{}, err
+	}
+	_, err = tx.Exec(`INSERT INTO refresh_tokens (token_hash, user_id, session_id, expires_at) VALUES (?, ?, ?, ?)`, newRefreshTokenHash, old.UserID, old.SessionID, newRefreshTokenExpiry.UnixNano())
+	if err != nil {
+		return RefreshToken{}, Session{}, err
+	}
+	res, err := tx.Exec(`UPDATE sessions SET ip = ?, user_agent = ?, last_used_at = ? WHERE id = ?`, ip, userAgent, now, old.SessionID)
+	if err != nil {
+		return RefreshToken{}, Session{}, err
+	}
+	err = requireAffected(res, ErrSessionNotExist)
+	if err != nil {
+		return RefreshToken{}, Session{}, err
+	}
+	session, err := scanSession(tx.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, old.SessionID))
+	if err != nil {
+		return RefreshToken{}, Session{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return RefreshToken{}, Session{}, err
+	}
+	return RefreshToken{UserID: old.UserID, TokenHash: newRefreshTokenHash, SessionID: old.SessionID, ExpiresAt: newRefreshTokenExpiry}, session, nil
+}
+
+// DeleteRefreshToken deletes a refresh token, its session and every other token of the session from the database
+func (db *SQLiteDB) DeleteRefreshToken(refreshTokenHash string) error{
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var sessionID int
+	err = tx.QueryRow(`SELECT session_id FROM refresh_tokens WHERE token_hash = ?`, refreshTokenHash).Scan(&sessionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRefreshTokenNotExist
+	}
+	if err != nil {
+		return err
+	}
+	err = deleteSessionTx(tx, sessionID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReadSessions returns the sessions of a user, most recently used first
+func (db *SQLiteDB) ReadSessions(userID int) ([]Session, error){
+	sessions := []Session{}
+
+	rows, err := db.conn.Query(`SELECT `+sessionColumns+` FROM sessions WHERE user_id = ? ORDER BY last_used_at DESC, id DESC`, userID)
+	if err != nil {
+		return sessions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return sessions, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// ReadSingleSession returns a session by its ID
+func (db *SQLiteDB) ReadSingleSession(sessionID int) (Session, error){
+	return scanSession(db.conn.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, sessionID))
+}
+
+// scanSession reads a row selected with sessionColumns
+func scanSession(row interface{ Scan(dest ...any) error }) (Session, error){
+	session := Session{}
+	var createdAt, lastUsedAt int64
+
+	err := row.Scan(&session.ID, &session.UserID, &session.DeviceName, &session.UserAgent, &session.IP, &session.Audience, &createdAt, &lastUsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, ErrSessionNotExist
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	session.CreatedAt = time.Unix(0, createdAt).UTC()
+	session.LastUsedAt = time.Unix(0, lastUsedAt).UTC()
+	return session, nil
+}
+
+// DeleteSession revokes one session of a user along with its refresh tokens
+func (db *SQLiteDB) DeleteSession(userID int, sessionID int) error{
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exist bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM sessions WHERE id = ? AND user_id = ?)`, sessionID, userID).Scan(&exist)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return ErrSessionNotExist
+	}
+	err = deleteSessionTx(tx, sessionID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteUserSessions revokes every session of a user except keepSessionID
+func (db *SQLiteDB) DeleteUserSessions(userID int, keepSessionID int) (int, error){
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM refresh_tokens WHERE user_id = ? AND session_id != ?`, userID, keepSessionID)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ? AND id != ?`, userID, keepSessionID)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
+}
+
+// deleteSessionTx removes a session and every refresh token issued to it
+func deleteSessionTx(tx *sql.Tx, sessionID int) error{
+	_, err := tx.Exec(`DELETE FROM refresh_tokens WHERE session_id = ?`, sessionID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM sessions WHERE id = ?`, sessionID)
+	return err
+}
+
+// readRefreshToken scans a row of refreshTokenColumns
+func readRefreshToken(row *sql.Row) (RefreshToken, error){
+	refreshToken := RefreshToken{}
+	var expiresAt int64
+	var rotatedAt sql.NullInt64
+
+	err := row.Scan(&refreshToken.TokenHash, &refreshToken.UserID, &refreshToken.SessionID, &expiresAt, &rotatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshToken{}, ErrRefreshTokenNotExist
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	refreshToken.ExpiresAt = time.Unix(0, expiresAt).UTC()
+	if rotatedAt.Valid {
+		at := time.Unix(0, rotatedAt.Int64).UTC()
+		refreshToken.RotatedAt = &at
+	}
+	return refreshToken, nil
+}
+
+// queryChirps runs a chirp SELECT and collects the rows
+func (db *SQLiteDB) queryChirps(query string, args ...any) ([]Chirp, error){
+	chirpsSlice := []Chirp{}
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return chirpsSlice, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return chirpsSlice, err
+		}
+		chirpsSlice = append(chirpsSlice, chirp)
+	}
+	return chirpsSlice, rows.Err()
+}
+
+// queryReports scans reports selected with reportColumns
+func queryReports(querier sqlQuerier, query string, args ...any) ([]Report, error){
+	reports := []Report{}
+
+	rows, err := querier.Query(query, args...)
+	if err != nil {
+		return reports, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		report := Report{}
+		var createdAt int64
+		var resolvedAt sql.NullInt64
+		err = rows.Scan(&report.ID, &report.ChirpID, &report.ReporterID, &report.Reason, &report.Details, &report.Status, &report.Resolution, &createdAt, &resolvedAt)
+		if err != nil {
+			return reports, err
+		}
+		report.CreatedAt = time.Unix(0, createdAt).UTC()
+		if resolvedAt.Valid {
+			at := time.Unix(0, resolvedAt.Int64).UTC()
+			report.ResolvedAt = &at
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+// queryHeldChirps scans held chirps selected as id, author_id, body, in_reply_to, reasons, created_at
+func queryHeldChirps(querier sqlQuerier, query string, args ...any) ([]HeldChirp, error){
+	heldSlice := []HeldChirp{}
+
+	rows, err := querier.Query(query, args...)
+	if err != nil {
+		return heldSlice, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		held := HeldChirp{}
+		var reasons string
+		var createdAt int64
+		err = rows.Scan(&held.ID, &held.AuthorID, &held.Body, &held.InReplyTo, &reasons, &createdAt)
+		if err != nil {
+			return heldSlice, err
+		}
+		err = json.Unmarshal([]byte(reasons), &held.Reasons)
+		if err != nil {
+			return heldSlice, err
+		}
+		held.CreatedAt = time.Unix(0, createdAt).UTC()
+		heldSlice = append(heldSlice, held)
+	}
+	return heldSlice, rows.Err()
+}
+
+// idArgs turns IDs into query arguments for an IN list
+func idArgs(ids []int) []any {
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return args
+}
+
+// inIDOrder puts rows fetched with an IN list back into the order of ids
+func inIDOrder[T any](ids []int, rows []T, id func(T) int) []T {
+	byID := map[int]T{}
+	for _, row := range rows {
+		byID[id(row)] = row
+	}
+	ordered := []T{}
+	for _, rowID := range ids {
+		if row, found := byID[rowID]; found {
+			ordered = append(ordered, row)
+		}
+	}
+	return ordered
+}
+
+// scanChirp reads a row selected with chirpColumns, any extra columns after them are scanned into extra
+func scanChirp(row interface{ Scan(dest ...any) error }, extra ...any) (Chirp, error){
+	chirp := Chirp{}
+	var entities string
+	var createdAt, updatedAt int64
+	dest := []any{&chirp.ID, &chirp.AuthorID, &chirp.Body, &chirp.InReplyTo, &chirp.ReplyCount, &chirp.LikeCount, &chirp.RechirpCount, &entities, &chirp.Deleted, &chirp.Hidden, &chirp.AuthorSuspended, &createdAt, &updatedAt}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = json.Unmarshal([]byte(entities), &chirp.Entities)
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.CreatedAt = time.Unix(0, createdAt).UTC()
+	chirp.UpdatedAt = time.Unix(0, updatedAt).UTC()
+	return chirp, nil
+}
+
+// sqlQuerier is satisfied by both *sql.DB and *sql.Tx
+type sqlQuerier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// queryFollows runs a follow SELECT on the connection or a transaction and collects the rows
+func queryFollows(q sqlQuerier, query string, args ...any) ([]Follow, error){
+	follows := []Follow{}
+
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return follows, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		follow := Follow{}
+		var createdAt int64
+		err = rows.Scan(&follow.FollowerID, &follow.FolloweeID, &createdAt)
+		if err != nil {
+			return follows, err
+		}
+		follow.CreatedAt = time.Unix(0, createdAt).UTC()
+		follows = append(follows, follow)
+	}
+	return follows, rows.Err()
+}
+
+// prefixColumns qualifies every column in a comma separated list with table
+func prefixColumns(table string, columns string) string{
+	return table + "." + strings.ReplaceAll(columns, ", ", ", "+table+".")
+}
+
+// readUser returns the first user matching the where clause
+func (db *SQLiteDB) readUser(where string, args ...any) (User, error){
+	user, err := scanUser(db.conn.QueryRow(`SELECT `+userColumns+` FROM users `+where, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotExist
+	}
+	return user, err
+}
+
+// scanUser reads a row selected with userColumns
+func scanUser(row interface{ Scan(dest ...any) error }) (User, error){
+	user := User{}
+	var createdAt, updatedAt int64
+	var recoveryCodes string
+	err := row.Scan(&user.ID, &user.Email, &user.EmailVerified, &user.Username, &user.HashedPassword, &user.IsChirpyRed, &user.Suspended, &user.Role,
+		&user.TwoFactor.Secret, &user.TwoFactor.Enabled, &recoveryCodes, &user.TwoFactor.LastStep, &createdAt, &updatedAt)
+	if err != nil {
+		return User{}, err
+	}
+	err = json.Unmarshal([]byte(recoveryCodes), &user.TwoFactor.RecoveryCodeHashes)
+	if err != nil {
+		return User{}, err
+	}
+	user.CreatedAt = time.Unix(0, createdAt).UTC()
+	user.UpdatedAt = time.Unix(0, updatedAt).UTC()
+	return user, nil
+}
+
+// requireAffected returns notFound when a statement touched no rows
+func requireAffected(res sql.Result, notFound error) error{
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+	return nil
+}
+
+// userUniqueError maps a UNIQUE failure on users to the column that collided
+func userUniqueError(err error) error{
+	if strings.Contains(err.Error(), "username") {
+		return ErrUsernameTaken
+	}
+	return ErrUserEmailTaken
+}
+
+// sqliteChirpEntities extracts the entities of a chirp body and resolves its mentions with q
+func sqliteChirpEntities(q sqlQuerier, body string) (ChirpEntities, error){
+	return resolveMentions(extractEntities(body), func(handle string) (int, error) {
+		rows, err := q.Query(`SELECT `+userColumns+` FROM users
+			WHERE username = ? COLLATE NOCASE AND username != ''`, handle)
+		if err != nil {
+			return 0, err
+		}
+		defer rows.Close()
+
+		candidates := []User{}
+		for rows.Next() {
+			user, err := scanUser(rows)
+			if err != nil {
+				return 0, err
+			}
+			candidates = append(candidates, user)
+		}
+		return matchHandle(handle, candidates), rows.Err()
+	})
+}
+
+// writeChirpEntities stores the entities of a chirp and replaces its rows in chirp_tags and chirp_mentions
+func writeChirpEntities(tx *sql.Tx, chirpID int, entities ChirpEntities) error{
+	dat, err := json.Marshal(entities)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE chirps SET entities = ? WHERE id = ?`, string(dat), chirpID)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"chirp_tags", "chirp_mentions"} {
+		_, err = tx.Exec(`DELETE FROM `+table+` WHERE chirp_id = ?`, chirpID)
+		if err != nil {
+			return err
+		}
+	}
+	for _, hashtag := range entities.Hashtags {
+		_, err = tx.Exec(`INSERT OR IGNORE INTO chirp_tags (tag, chirp_id) VALUES (?, ?)`, hashtag.Tag, chirpID)
+		if err != nil {
+			return err
+		}
+	}
+	for _, mention := range entities.Mentions {
+		_, err = tx.Exec(`INSERT OR IGNORE INTO chirp_mentions (user_id, chirp_id) VALUES (?, ?)`, mention.UserID, chirpID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is a UNIQUE constraint failure
+func isUniqueViolation(err error) bool{
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
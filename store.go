@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrChirpNotExist        = errors.New("chirp does not exist")
+	ErrParentChirpNotExist  = errors.New("the chirp being replied to does not exist")
+	ErrHeldChirpNotExist    = errors.New("held chirp does not exist")
+	ErrReportNotExist       = errors.New("report does not exist")
+	ErrReportResolved       = errors.New("report has already been resolved")
+	ErrLastAdmin            = errors.New("the last admin cannot give up the admin role")
+	ErrUserNotExist         = errors.New("user does not exist")
+	ErrUserEmailTaken       = errors.New("a user with the input email already exists")
+	ErrUsernameTaken        = errors.New("a user with the input username already exists")
+	ErrNoUserWithEmail      = errors.New("no user with a matching email")
+	ErrCannotFollowSelf     = errors.New("users cannot follow themselves")
+	ErrNotFollowing         = errors.New("user is not being followed")
+	ErrNotLiked             = errors.New("chirp is not liked by the user")
+	ErrNotRechirped         = errors.New("chirp is not rechirped by the user")
+	ErrRefreshTokenNotExist = errors.New("refresh token does not exist")
+	ErrRefreshTokenExpired  = errors.New("refresh token has expired")
+	ErrRefreshTokenReused   = errors.New("refresh token was already used, its session has been revoked")
+	ErrSessionNotExist      = errors.New("session does not exist")
+	ErrTwoFactorCodeUsed    = errors.New("two-factor code was already used")
+	ErrRecoveryCodeNotExist = errors.New("recovery code does not exist")
+	ErrEmailChanged         = errors.New("the email address of the user has changed")
+	ErrPasswordChanged      = errors.New("the password of the user has changed")
+)
+
+// Report statuses, and the resolutions a moderator can pick for a report
+const (
+	ReportOpen = "open"
+	ReportResolved = "resolved"
+
+	ResolutionDismiss = "dismiss"
+	ResolutionHideChirp = "hide_chirp"
+	ResolutionSuspendAuthor = "suspend_author"
+)
+
+// Store is the persistence layer used by the handlers, implemented by the JSON file DB and SQLiteDB
+type Store interface {
+	CreateChirp(body string, authorID int, inReplyTo int) (Chirp, error)
+	ReadChirps() ([]Chirp, error)
+	ReadChirpsByAuthorID(authorID int) ([]Chirp, error)
+	QueryChirps(query ChirpQuery) (ChirpPage, error)
+	ReadSingleChirp(chirpID int) (Chirp, error)
+	ReadChirpsByIDs(chirpIDs []int) ([]Chirp, error)
+	ReadChirpLineage(chirpID int) ([]Chirp, error)
+	UpdateChirp(chirpID int, body string) (Chirp, error)
+	ReadChirpHistory(chirpID int) ([]ChirpRevision, error)
+	DeleteSingleChirp(chirpID int) error
+
+	ReportChirp(chirpID int, reporterID int, reason string, details string) (Report, error)
+	ReadReports(status string, cursor *Cursor, limit int) (ReportPage, error)
+	ResolveReport(reportID int, resolution string) (Report, error)
+
+	HoldChirp(body string, authorID int, inReplyTo int, reasons []string) (HeldChirp, error)
+	ReadHeldChirps() ([]HeldChirp, error)
+	ApproveHeldChirp(heldID int) (Chirp, error)
+	DiscardHeldChirp(heldID int) error
+
+	LikeChirp(userID int, chirpID int) (Chirp, error)
+	UnlikeChirp(userID int, chirpID int) (Chirp, error)
+	RechirpChirp(userID int, chirpID int) (Chirp, error)
+	UnrechirpChirp(userID int, chirpID int) (Chirp, error)
+	ReadChirpLikes(chirpID int, cursor *Cursor, limit int) (EngagementPage, error)
+	ReadChirpRechirps(chirpID int, cursor *Cursor, limit int) (EngagementPage, error)
+	ReadLikedChirpIDs(userID int, chirpIDs []int) (map[int]bool, error)
+	ReadRechirpedChirpIDs(userID int, chirpIDs []int) (map[int]bool, error)
+
+	CreateUsers(email string, username string, hashedPassword []byte) (User, error)
+	// UpdateUser changes the profile of a user, an empty newEmail or newUsername and a nil newHashedPassword
+	// keep the current value. A new email address has to be verified again.
+	UpdateUser(newEmail string, newUsername string, newHashedPassword []byte, userID int) (User, error)
+	// UpdateUserPassword replaces the password hash only while it still is currentHashedPassword and
+	// returns ErrPasswordChanged otherwise
+	UpdateUserPassword(userID int, currentHashedPassword []byte, newHashedPassword []byte) (User, error)
+	// VerifyUserEmail marks email as verified if it still is the address of the user, ErrEmailChanged otherwise
+	VerifyUserEmail(userID int, email string) (User, error)
+	UpgradeUser(userID int) (User, error)
+	UpdateUserRole(userID int, role string) (User, error)
+	// UpdateUserSuspended suspends or reinstates a user and hides or shows their chirps with them
+	UpdateUserSuspended(userID int, suspended bool) (User, error)
+	UpdateUserTwoFactor(userID int, twoFactor TwoFactor) (User, error)
+	// ConsumeTwoFactorStep records that a TOTP code for step was accepted, it returns ErrTwoFactorCodeUsed
+	// when a code for that step or a later one was accepted already
+	ConsumeTwoFactorStep(userID int, step int64) error
+	// ConsumeRecoveryCode removes a recovery code by its hash and returns how many are left
+	ConsumeRecoveryCode(userID int, recoveryCodeHash string) (int, error)
+	ReadUsers() ([]User, error)
+	ReadUsersByIDs(userIDs []int) ([]User, error)
+	ReadSingleUser(userID int) (User, error)
+	ReadSingleUserbyEmail(userEmail string) (User, error)
+
+	FollowUser(followerID int, followeeID int) (Follow, error)
+	UnfollowUser(followerID int, followeeID int) error
+	ReadFollowers(userID int, cursor *Cursor, limit int) (FollowPage, error)
+	ReadFollowing(userID int, cursor *Cursor, limit int) (FollowPage, error)
+	ReadTimeline(userID int, cursor *Cursor, limit int) (ChirpPage, error)
+
+	// Refresh tokens are looked up by the SHA-256 hash of the token, see hashRefreshToken
+	CreateRefreshTokenWDetails(session Session, refreshTokenHash string, refreshTokenExpiry time.Time) (RefreshToken, Session, error)
+	ReadSingleRefreshTokenWDetails(refreshTokenHash string) (RefreshToken, error)
+	// RotateRefreshToken replaces a refresh token with a new one in the same session and records where the
+	// session was used from. Presenting a token that was already rotated revokes the whole session and
+	// returns ErrRefreshTokenReused with the reused token.
+	RotateRefreshToken(refreshTokenHash string, newRefreshTokenHash string, newRefreshTokenExpiry time.Time, ip string, userAgent string) (RefreshToken, Session, error)
+	// DeleteRefreshToken revokes a refresh token together with its session
+	DeleteRefreshToken(refreshTokenHash string) error
+	ReadSessions(userID int) ([]Session, error)
+	// ReadSingleSession returns a session by its ID, ErrSessionNotExist once it was revoked
+	ReadSingleSession(sessionID int) (Session, error)
+	DeleteSession(userID int, sessionID int) error
+	// DeleteUserSessions revokes every session of a user except keepSessionID and returns how many it revoked
+	DeleteUserSessions(userID int, keepSessionID int) (int, error)
+
+	// Migrate brings the stored schema up to date, with dryRun it only reports what would change
+	Migrate(dryRun bool) ([]string, error)
+	Close() error
+}
+
+// NewStore opens the storage backend selected by kind ("json" or "sqlite") at path
+func NewStore(kind string, path string) (Store, error){
+	switch kind {
+	case "json":
+		db, err := NewDB(path)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case "sqlite":
+		db, err := NewSQLiteDB(path)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	}
+	return nil, fmt.Errorf("unknown store %q, expected json or sqlite", kind)
+}
+
+// hashRefreshToken returns the hex SHA-256 of a refresh token, the form refresh tokens are stored and looked up by
+func hashRefreshToken(refreshToken string) string{
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// defaultStorePath returns the database file used by a backend when none is given
+func defaultStorePath(kind string) string{
+	if kind == "sqlite" {
+		return "./database.db"
+	}
+	return "./database.json"
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// forEachStore runs test against a fresh, migrated database of every backend
+func forEachStore(t *testing.T, test func(t *testing.T, db Store)) {
+	for _, kind := range []string{"json", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			db, err := NewStore(kind, filepath.Join(t.TempDir(), defaultStorePath(kind)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			_, err = db.Migrate(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test(t, db)
+		})
+	}
+}
+
+func TestSuspendedAuthorChirpsHidden(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		for _, email := range []string{"carol@example.com", "bob@example.com"} {
+			_, err := db.CreateUsers(email, "", []byte("hash"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		root, err := db.CreateChirp("root by carol #tag", 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := db.CreateChirp("reply by bob #tag", 2, root.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		readable := func() string {
+			t.Helper()
+			chirps, err := db.ReadChirps()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tagged, err := db.QueryChirps(ChirpQuery{Hashtag: "tag", Limit: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			byID, err := db.ReadChirpsByIDs([]int{root.ID, reply.ID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			replies, err := db.QueryChirps(ChirpQuery{InReplyTo: root.ID, IncludeDeleted: true, Limit: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.ReadSingleChirp(reply.ID)
+			return fmt.Sprintf("all %d, tagged %d, by id %d, reply body %q, single %v", len(chirps), len(tagged.Chirps), len(byID), replies.Chirps[0].Body, err)
+		}
+
+		want := `all 2, tagged 2, by id 2, reply body "reply by bob #tag", single <nil>`
+		if got := readable(); got != want {
+			t.Fatalf("before suspending: %s, want %s", got, want)
+		}
+
+		_, err = db.UpdateUserSuspended(2, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = fmt.Sprintf(`all 1, tagged 1, by id 1, reply body "", single %v`, ErrChirpNotExist)
+		if got := readable(); got != want {
+			t.Errorf("while suspended: %s, want %s", got, want)
+		}
+		// a chirp approved from the moderation queue while its author is suspended stays hidden too
+		created, err := db.CreateChirp("written while suspended", 2, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created.visible() {
+			t.Error("a chirp by a suspended author is visible")
+		}
+
+		user, err := db.UpdateUserSuspended(2, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Suspended {
+			t.Error("user is still suspended")
+		}
+		want = `all 3, tagged 2, by id 2, reply body "reply by bob #tag", single <nil>`
+		if got := readable(); got != want {
+			t.Errorf("after lifting the suspension: %s, want %s", got, want)
+		}
+
+		_, err = db.UpdateUserSuspended(99, false)
+		if err != ErrUserNotExist {
+			t.Errorf("got %v for a missing user, want %v", err, ErrUserNotExist)
+		}
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loginBackoffBase is the wait after the first failure that is not free, every further failure doubles it
+const loginBackoffBase = time.Second
+
+// LoginThrottle counts failed logins per account and per client IP. The first half of the failures
+// allowed for each are free, every one after that makes the next attempt wait twice as long as the
+// previous one, starting from loginBackoffBase, and the last one locks the account or IP out for the
+// lockout duration. Counters are forgotten a lockout duration after the last failure.
+// Every attempt is charged as a failure before the password is checked and refunded once it turns out
+// right, so that a burst of parallel guesses is throttled as it arrives rather than after it was checked.
+// Accounts are keyed by the email that was tried, whether or not a user has it, so that throttling
+// does not reveal which emails are signed up. The counters live in memory and are per server.
+type LoginThrottle struct {
+	mux *sync.Mutex
+	accounts map[string]*loginFailures
+	ips map[string]*loginFailures
+	maxAccountFailures int
+	maxIPFailures int
+	lockout time.Duration
+	nextPrune time.Time
+	// action names what is throttled in the log
+	action string
+}
+
+// loginFailures is the failure counter of one account or IP
+type loginFailures struct {
+	count int
+	last time.Time
+	blockedUntil time.Time
+	locked bool
+}
+
+// NewLoginThrottle creates a throttle, a maximum of 0 failures turns that counter off
+func NewLoginThrottle(maxAccountFailures int, maxIPFailures int, lockout time.Duration) *LoginThrottle {
+	return &LoginThrottle{
+		mux: &sync.Mutex{},
+		accounts: map[string]*loginFailures{},
+		ips: map[string]*loginFailures{},
+		maxAccountFailures: maxAccountFailures,
+		maxIPFailures: maxIPFailures,
+		lockout: lockout,
+		action: "logins",
+	}
+}
+
+// NewPasswordResetThrottle creates a throttle for password reset emails. Every request is charged and
+// none is refunded, so each email and IP gets maxAccountRequests and maxIPRequests per window.
+func NewPasswordResetThrottle(maxAccountRequests int, maxIPRequests int, window time.Duration) *LoginThrottle {
+	t := NewLoginThrottle(maxAccountRequests, maxIPRequests, window)
+	t.action = "password reset requests"
+	return t
+}
+
+// Attempt starts a login for email from ip. When it has to wait it returns how long, and whether the wait
+// is a lockout rather than a backoff, and nothing is counted. Otherwise it returns a zero wait and charges
+// the attempt as a failure, which Refund takes back when the credentials turn out right.
+func (t *LoginThrottle) Attempt(email string, ip string, now time.Time) (time.Duration, bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	wait, locked := time.Duration(0), false
+	for _, failures := range []*loginFailures{t.accounts[throttleKey(email)], t.ips[ip]} {
+		if failures == nil || !now.Before(failures.blockedUntil) {
+			continue
+		}
+		if failures.blockedUntil.Sub(now) > wait {
+			wait, locked = failures.blockedUntil.Sub(now), failures.locked
+		}
+	}
+	if wait > 0 {
+		return wait, locked
+	}
+
+	if now.After(t.nextPrune) {
+		t.prune(now)
+	}
+
+	if t.maxAccountFailures > 0 && t.charge(t.accounts, throttleKey(email), t.maxAccountFailures, now) {
+		log.Printf("security: %s for %s locked for %v after %d attempts", t.action, email, t.lockout, t.maxAccountFailures)
+	}
+	if t.maxIPFailures > 0 && t.charge(t.ips, ip, t.maxIPFailures, now) {
+		log.Printf("security: %s from %s locked for %v after %d attempts", t.action, ip, t.lockout, t.maxIPFailures)
+	}
+	return 0, false
+}
+
+// charge counts a failure under key and reports whether it locked key out
+func (t *LoginThrottle) charge(counters map[string]*loginFailures, key string, maxFailures int, now time.Time) bool {
+	failures, exist := counters[key]
+	if !exist || t.expired(failures, now) {
+		failures = &loginFailures{}
+		counters[key] = failures
+	}
+	failures.count++
+	failures.last = now
+	t.block(failures, maxFailures)
+	return failures.locked
+}
+
+// refund takes back one failure charged under key
+func (t *LoginThrottle) refund(counters map[string]*loginFailures, key string, maxFailures int) {
+	failures, exist := counters[key]
+	if !exist {
+		return
+	}
+	failures.count--
+	if failures.count <= 0 {
+		delete(counters, key)
+		return
+	}
+	t.block(failures, maxFailures)
+}
+
+// block sets how long the counter blocks logins after its last failure
+func (t *LoginThrottle) block(failures *loginFailures, maxFailures int) {
+	failures.blockedUntil, failures.locked = time.Time{}, false
+
+	free := maxFailures / 2
+	switch {
+	case failures.count >= maxFailures:
+		failures.blockedUntil, failures.locked = failures.last.Add(t.lockout), true
+	case failures.count > free:
+		backoff := t.lockout
+		// past 2^32 seconds the shift would overflow, and the wait is capped at the lockout long before
+		if shift := failures.count - free - 1; shift < 32 {
+			backoff = loginBackoffBase << shift
+		}
+		if backoff > t.lockout {
+			backoff = t.lockout
+		}
+		failures.blockedUntil = failures.last.Add(backoff)
+	}
+}
+
+// Refund takes back the failure Attempt charged for email and ip, once the credentials were right
+func (t *LoginThrottle) Refund(email string, ip string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if t.maxAccountFailures > 0 {
+		t.refund(t.accounts, throttleKey(email), t.maxAccountFailures)
+	}
+	if t.maxIPFailures > 0 {
+		t.refund(t.ips, ip, t.maxIPFailures)
+	}
+}
+
+// Succeed forgets the failures of an account once someone logged into it. The IP counter is kept so
+// that an attacker cannot clear it by logging into an account of their own.
+func (t *LoginThrottle) Succeed(email string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	delete(t.accounts, throttleKey(email))
+}
+
+// Unlock lifts a lockout of an account and reports whether there was anything to lift
+func (t *LoginThrottle) Unlock(email string) bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	failures, exist := t.accounts[throttleKey(email)]
+	delete(t.accounts, throttleKey(email))
+	return exist && failures.locked && time.Now().Before(failures.blockedUntil)
+}
+
+// expired reports whether a counter is old enough to be forgotten
+func (t *LoginThrottle) expired(failures *loginFailures, now time.Time) bool {
+	return !now.Before(failures.last.Add(t.lockout))
+}
+
+// prune drops expired counters so that tried emails and IPs do not pile up, at most once a minute
+func (t *LoginThrottle) prune(now time.Time) {
+	for _, counters := range []map[string]*loginFailures{t.accounts, t.ips} {
+		for key, failures := range counters {
+			if t.expired(failures, now) {
+				delete(counters, key)
+			}
+		}
+	}
+	t.nextPrune = now.Add(time.Minute)
+}
+
+// throttleKey folds an email so that changing its case does not get around the account counter
+func throttleKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleSchedule(t *testing.T) {
+	// 6 failures per account: 3 free, then 1s and 2s of backoff, and the 6th locks for the lockout
+	throttle := NewLoginThrottle(6, 0, 15*time.Minute)
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		at time.Duration
+		wait time.Duration
+		locked bool
+	}{
+		{0, 0, false},
+		{0, 0, false},
+		{0, 0, false},
+		{0, 0, false},
+		// a blocked attempt is not charged, hammering does not make the wait longer
+		{0, time.Second, false},
+		{500 * time.Millisecond, 500 * time.Millisecond, false},
+		{time.Second, 0, false},
+		{2 * time.Second, time.Second, false},
+		{3 * time.Second, 0, false},
+		{4 * time.Second, 15*time.Minute - time.Second, true},
+		{3*time.Second + 15*time.Minute - time.Nanosecond, time.Nanosecond, true},
+		// once the lockout is over the counter starts again from scratch
+		{3*time.Second + 15*time.Minute, 0, false},
+		{3*time.Second + 15*time.Minute, 0, false},
+	}
+	for i, tt := range steps {
+		wait, locked := throttle.Attempt("alice@example.com", "192.0.2.1", t0.Add(tt.at))
+		if wait != tt.wait || locked != tt.locked {
+			t.Errorf("attempt %d at +%v: got wait %v locked %v, want wait %v locked %v", i+1, tt.at, wait, locked, tt.wait, tt.locked)
+		}
+	}
+}
+
+func TestLoginThrottleBackoffCappedAtLockout(t *testing.T) {
+	throttle := NewLoginThrottle(200, 0, time.Minute)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 150; i++ {
+		wait, locked := throttle.Attempt("alice@example.com", "192.0.2.1", now)
+		if wait > time.Minute || locked {
+			t.Fatalf("attempt %d: wait %v locked %v, the backoff must stay under the lockout", i+1, wait, locked)
+		}
+		now = now.Add(wait)
+		if wait == 0 {
+			continue
+		}
+		wait, _ = throttle.Attempt("alice@example.com", "192.0.2.1", now)
+		if wait != 0 {
+			t.Fatalf("attempt %d: still blocked for %v after waiting", i+1, wait)
+		}
+	}
+}
+
+func TestLoginThrottleRefund(t *testing.T) {
+	throttle := NewLoginThrottle(4, 4, time.Minute)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// right credentials are refunded, so they never add up to a backoff
+	for i := 0; i < 10; i++ {
+		wait, _ := throttle.Attempt("alice@example.com", "192.0.2.1", now)
+		if wait != 0 {
+			t.Fatalf("attempt %d after refunds: blocked for %v", i+1, wait)
+		}
+		throttle.Refund("alice@example.com", "192.0.2.1")
+	}
+
+	for i := 0; i < 3; i++ {
+		throttle.Attempt("alice@example.com", "192.0.2.1", now)
+	}
+	wait, _ := throttle.Attempt("alice@example.com", "192.0.2.1", now)
+	if wait != time.Second {
+		t.Fatalf("after 3 failures: wait %v, want %v", wait, time.Second)
+	}
+	// the third attempt turned out right, taking it back lifts the backoff it caused
+	throttle.Refund("alice@example.com", "192.0.2.1")
+	wait, _ = throttle.Attempt("alice@example.com", "192.0.2.1", now)
+	if wait != 0 {
+		t.Errorf("after a refund: wait %v, want none", wait)
+	}
+}
+
+func TestLoginThrottleKeys(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		first string
+		firstIP string
+		second string
+		secondIP string
+		shared bool
+	}{
+		{"same email", "alice@example.com", "192.0.2.1", "alice@example.com", "192.0.2.2", true},
+		{"email case and spaces", "alice@example.com", "192.0.2.1", " Alice@Example.COM", "192.0.2.2", true},
+		{"other email", "alice@example.com", "192.0.2.1", "bob@example.com", "192.0.2.2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			throttle := NewLoginThrottle(2, 0, time.Minute)
+			throttle.Attempt(tt.first, tt.firstIP, now)
+			throttle.Attempt(tt.first, tt.firstIP, now)
+			wait, _ := throttle.Attempt(tt.second, tt.secondIP, now)
+			if (wait > 0) != tt.shared {
+				t.Errorf("wait %v, want the counter shared: %v", wait, tt.shared)
+			}
+		})
+	}
+
+	// the IP counter adds up across accounts
+	throttle := NewLoginThrottle(0, 2, time.Minute)
+	throttle.Attempt("alice@example.com", "192.0.2.1", now)
+	throttle.Attempt("bob@example.com", "192.0.2.1", now)
+	wait, locked := throttle.Attempt("carol@example.com", "192.0.2.1", now)
+	if wait != time.Minute || !locked {
+		t.Errorf("IP after 2 failures: wait %v locked %v, want a lockout", wait, locked)
+	}
+	wait, _ = throttle.Attempt("carol@example.com", "192.0.2.2", now)
+	if wait != 0 {
+		t.Errorf("other IP: wait %v, want none", wait)
+	}
+}
+
+func TestLoginThrottleSucceedKeepsIPCounter(t *testing.T) {
+	throttle := NewLoginThrottle(2, 2, time.Minute)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	throttle.Attempt("victim@example.com", "192.0.2.1", now)
+	// logging into an account of their own must not clear the failures charged to the IP
+	throttle.Attempt("mallory@example.com", "192.0.2.1", now)
+	throttle.Refund("mallory@example.com", "192.0.2.1")
+	throttle.Succeed("mallory@example.com")
+	throttle.Attempt("victim@example.com", "192.0.2.1", now)
+
+	wait, locked := throttle.Attempt("victim@example.com", "192.0.2.1", now)
+	if wait == 0 || !locked {
+		t.Fatalf("victim account: wait %v locked %v, want a lockout", wait, locked)
+	}
+	throttle.Succeed("victim@example.com")
+	wait, locked = throttle.Attempt("victim@example.com", "192.0.2.1", now)
+	if wait == 0 || !locked {
+		t.Errorf("after Succeed: wait %v locked %v, the IP should still be locked out", wait, locked)
+	}
+}
+
+func TestLoginThrottleUnlock(t *testing.T) {
+	throttle := NewLoginThrottle(2, 0, time.Minute)
+	now := time.Now()
+
+	if throttle.Unlock("alice@example.com") {
+		t.Error("Unlock reported a lockout for an account without failures")
+	}
+	throttle.Attempt("alice@example.com", "192.0.2.1", now)
+	if throttle.Unlock("alice@example.com") {
+		t.Error("Unlock reported a lockout for an account that is not locked")
+	}
+
+	throttle.Attempt("alice@example.com", "192.0.2.1", now)
+	throttle.Attempt("alice@example.com", "192.0.2.1", now)
+	if !throttle.Unlock("Alice@example.com") {
+		t.Error("Unlock did not report the lockout it lifted")
+	}
+	wait, _ := throttle.Attempt("alice@example.com", "192.0.2.1", now)
+	if wait != 0 {
+		t.Errorf("after Unlock: wait %v, want none", wait)
+	}
+}
+
+func TestLoginThrottleDisabled(t *testing.T) {
+	throttle := NewLoginThrottle(0, 0, time.Minute)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 100; i++ {
+		wait, _ := throttle.Attempt("alice@example.com", "192.0.2.1", now)
+		if wait != 0 {
+			t.Fatalf("attempt %d: blocked for %v with both limits off", i+1, wait)
+		}
+	}
+}
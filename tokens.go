@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// tokenIssuer is the iss claim of every token chirpy signs
+const tokenIssuer = "chirpy"
+
+// Kinds of token, carried in the token_use claim
+const (
+	TokenUseAccess = "access"
+	TokenUseTwoFactorChallenge = "2fa_challenge"
+	TokenUseEmailVerification = "email_verification"
+	TokenUsePasswordReset = "password_reset"
+)
+
+// twoFactorChallengeLife is how long a user has to enter their second factor after the password
+const twoFactorChallengeLife = 5 * time.Minute
+
+// How long the links chirpy emails stay valid
+const (
+	emailVerificationLife = 48 * time.Hour
+	passwordResetLife = time.Hour
+)
+
+var (
+	errTokenMissing = errors.New("no bearer token in the Authorization header")
+	errWrongTokenUse = errors.New("token is not meant for this use")
+	errSessionRevoked = errors.New("the session of this token was signed out")
+)
+
+// Error codes returned with a 401 so clients can tell why their token was refused
+const (
+	TokenErrorMissing = "token_missing"
+	TokenErrorMalformed = "token_malformed"
+	TokenErrorExpired = "token_expired"
+	TokenErrorNotYetValid = "token_not_yet_valid"
+	TokenErrorBadSignature = "bad_signature"
+	TokenErrorWrongIssuer = "wrong_issuer"
+	TokenErrorWrongAudience = "wrong_audience"
+	TokenErrorWrongTokenUse = "wrong_token_use"
+	TokenErrorSessionRevoked = "session_revoked"
+	TokenErrorInvalid = "token_invalid"
+)
+
+// tokenErrorCode maps an error from parseToken to the code reported to the client
+func tokenErrorCode(err error) string {
+	switch {
+	case errors.Is(err, errTokenMissing):
+		return TokenErrorMissing
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return TokenErrorMalformed
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return TokenErrorExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return TokenErrorNotYetValid
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		return TokenErrorBadSignature
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return TokenErrorWrongIssuer
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		return TokenErrorWrongAudience
+	case errors.Is(err, errWrongTokenUse):
+		return TokenErrorWrongTokenUse
+	case errors.Is(err, errSessionRevoked):
+		return TokenErrorSessionRevoked
+	}
+	return TokenErrorInvalid
+}
+
+// parseToken verifies a token signed by the key ring and checks that it was issued by chirpy, for one of
+// the configured audiences and for tokenUse. Expiry and issue times are allowed cfg.tokenLeeway of clock skew.
+func (cfg *apiConfig)parseToken(tokenString string, tokenUse string)(chirpyClaims, error){
+	claims := chirpyClaims{}
+
+	_, err := jwt.ParseWithClaims(tokenString, &claims, cfg.keys.VerificationKey,
+		jwt.WithValidMethods(cfg.keys.Algorithms()),
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(cfg.tokenLeeway),
+	)
+	if err != nil {
+		return claims, err
+	}
+	if !slices.ContainsFunc(claims.Audience, func(audience string) bool { return slices.Contains(cfg.audiences, audience) }) {
+		return claims, fmt.Errorf("%w: %v", jwt.ErrTokenInvalidAudience, claims.Audience)
+	}
+	if claims.TokenUse != tokenUse {
+		return claims, fmt.Errorf("%w: expected %q, got %q", errWrongTokenUse, tokenUse, claims.TokenUse)
+	}
+	return claims, nil
+}
+
+// parseAccessToken validates the Bearer access token of a request and returns its claims
+func (cfg *apiConfig)parseAccessToken(r *http.Request)(chirpyClaims, error){
+	jwtTokenString, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || jwtTokenString == "" {
+		return chirpyClaims{}, errTokenMissing
+	}
+	return cfg.parseToken(jwtTokenString, TokenUseAccess)
+}
+
+// mintAccessToken signs an access token for user in a session with the current signing key
+func (cfg *apiConfig)mintAccessToken(user User, session Session, expirationTime time.Time)(string, error){
+	return cfg.keys.Sign(chirpyClaims{TokenUse: TokenUseAccess, SessionID: session.ID, Role: user.Role, RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
+			Audience:  jwt.ClaimStrings{cfg.sessionAudience(session)},
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			Subject:   fmt.Sprint(user.ID),
+	}})
+}
+
+// mintChallengeToken signs the token that proves the password of user was checked, it can only be
+// exchanged at POST /api/login/2fa for a session with audience
+func (cfg *apiConfig)mintChallengeToken(user User, audience string)(string, error){
+	now := time.Now().UTC()
+	return cfg.keys.Sign(chirpyClaims{TokenUse: TokenUseTwoFactorChallenge, RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(twoFactorChallengeLife)),
+			Subject:   fmt.Sprint(user.ID),
+	}})
+}
+
+// mintEmailVerificationToken signs the token of a link proving that user owns their current email address
+func (cfg *apiConfig)mintEmailVerificationToken(user User)(string, error){
+	now := time.Now().UTC()
+	return cfg.keys.Sign(chirpyClaims{TokenUse: TokenUseEmailVerification, Email: user.Email, RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
+			Audience:  jwt.ClaimStrings{cfg.audiences[0]},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(emailVerificationLife)),
+			Subject:   fmt.Sprint(user.ID),
+	}})
+}
+
+// mintPasswordResetToken signs a token that sets a new password for user. It carries a fingerprint of the
+// current password, so it stops working as soon as the password changes, including through itself.
+func (cfg *apiConfig)mintPasswordResetToken(user User)(string, error){
+	now := time.Now().UTC()
+	return cfg.keys.Sign(chirpyClaims{TokenUse: TokenUsePasswordReset, PasswordFingerprint: passwordFingerprint(user.HashedPassword), RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
+			Audience:  jwt.ClaimStrings{cfg.audiences[0]},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(passwordResetLife)),
+			Subject:   fmt.Sprint(user.ID),
+	}})
+}
+
+// passwordFingerprint identifies a password hash without revealing it
+func passwordFingerprint(hashedPassword []byte) string {
+	sum := sha256.Sum256(hashedPassword)
+	return hex.EncodeToString(sum[:16])
+}
+
+// sessionAudience is the audience of a session, sessions older than audiences belong to the default one
+func (cfg *apiConfig)sessionAudience(session Session) string {
+	if session.Audience == "" {
+		return cfg.audiences[0]
+	}
+	return session.Audience
+}
+
+// handlerTokenErrors answers a request whose token was refused with 401, or 403 for a suspended account,
+// naming the reason in error_code and in the WWW-Authenticate header
+func (cfg *apiConfig)handlerTokenErrors(w http.ResponseWriter, err error, respBody *RespBody){
+	w.Header().Set("Content-Type", "application/json")
+	code := 401
+	if errors.Is(err, errAccountSuspended) {
+		code = 403
+		respBody.ErrorCode = "account_suspended"
+	} else {
+		respBody.ErrorCode = tokenErrorCode(err)
+	}
+
+	if code == 401 && respBody.ErrorCode == TokenErrorMissing {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chirpy"`)
+	} else if code == 401 {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="chirpy", error="invalid_token", error_description=%q`, respBody.ErrorCode))
+	}
+	cfg.handlerErrors(w, err, respBody, code)
+
+	dat, err := json.Marshal(respBody)
+	if err != nil {
+		return
+	}
+	w.Write(dat)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newTokenTestConfig returns an apiConfig with a fresh EdDSA key ring accepting the audiences chirpy and mobile
+func newTokenTestConfig(t *testing.T) *apiConfig {
+	t.Helper()
+	keys, err := NewKeyRing(t.TempDir(), AlgorithmEdDSA, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &apiConfig{keys: keys, audiences: []string{"chirpy", "mobile"}, tokenLeeway: 5 * time.Second}
+}
+
+// testClaims are valid access token claims, each case changes what it tests
+func testClaims(now time.Time) chirpyClaims {
+	return chirpyClaims{TokenUse: TokenUseAccess, SessionID: 1, RegisteredClaims: jwt.RegisteredClaims{
+		Issuer:    tokenIssuer,
+		Audience:  jwt.ClaimStrings{"chirpy"},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		Subject:   "1",
+	}}
+}
+
+func TestParseToken(t *testing.T) {
+	cfg := newTokenTestConfig(t)
+	now := time.Now().UTC()
+	kid := cfg.keys.kids()[0]
+	publicKey := cfg.keys.keys[kid].private.Public().(ed25519.PublicKey)
+
+	// sign returns a token for claims signed by the ring
+	sign := func(claims chirpyClaims) string {
+		token, err := cfg.keys.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	// forge returns a token for claims signed with method and key under the ring's kid
+	forge := func(method jwt.SigningMethod, key any) string {
+		token := jwt.NewWithClaims(method, testClaims(now))
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		token string
+		tokenUse string
+		want string
+	}{
+		{"valid", sign(testClaims(now)), TokenUseAccess, ""},
+		{"second audience", sign(func() chirpyClaims { c := testClaims(now); c.Audience = jwt.ClaimStrings{"mobile"}; return c }()), TokenUseAccess, ""},
+		{"expired within leeway", sign(func() chirpyClaims { c := testClaims(now); c.ExpiresAt = jwt.NewNumericDate(now.Add(-2 * time.Second)); return c }()), TokenUseAccess, ""},
+
+		{"empty", "", TokenUseAccess, TokenErrorMalformed},
+		{"garbage", "not.a.token", TokenUseAccess, TokenErrorMalformed},
+		{"alg none", forge(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType), TokenUseAccess, TokenErrorBadSignature},
+		{"HS256 keyed with the public key", forge(jwt.SigningMethodHS256, []byte(publicKey)), TokenUseAccess, TokenErrorBadSignature},
+		{"signed by another key", forge(jwt.SigningMethodEdDSA, otherKey), TokenUseAccess, TokenErrorBadSignature},
+		{"unknown kid", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, testClaims(now))
+			token.Header["kid"] = "unknown"
+			signed, _ := token.SignedString(otherKey)
+			return signed
+		}(), TokenUseAccess, TokenErrorBadSignature},
+		{"wrong issuer", sign(func() chirpyClaims { c := testClaims(now); c.Issuer = "someone-else"; return c }()), TokenUseAccess, TokenErrorWrongIssuer},
+		{"no issuer", sign(func() chirpyClaims { c := testClaims(now); c.Issuer = ""; return c }()), TokenUseAccess, TokenErrorInvalid},
+		{"wrong audience", sign(func() chirpyClaims { c := testClaims(now); c.Audience = jwt.ClaimStrings{"web"}; return c }()), TokenUseAccess, TokenErrorWrongAudience},
+		{"no audience", sign(func() chirpyClaims { c := testClaims(now); c.Audience = nil; return c }()), TokenUseAccess, TokenErrorWrongAudience},
+		{"challenge used as access", sign(func() chirpyClaims { c := testClaims(now); c.TokenUse = TokenUseTwoFactorChallenge; return c }()), TokenUseAccess, TokenErrorWrongTokenUse},
+		{"access used as password reset", sign(testClaims(now)), TokenUsePasswordReset, TokenErrorWrongTokenUse},
+		{"no token_use", sign(func() chirpyClaims { c := testClaims(now); c.TokenUse = ""; return c }()), TokenUseAccess, TokenErrorWrongTokenUse},
+		{"expired", sign(func() chirpyClaims { c := testClaims(now); c.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Minute)); return c }()), TokenUseAccess, TokenErrorExpired},
+		{"no expiry", sign(func() chirpyClaims { c := testClaims(now); c.ExpiresAt = nil; return c }()), TokenUseAccess, TokenErrorInvalid},
+		{"issued in the future", sign(func() chirpyClaims { c := testClaims(now); c.IssuedAt = jwt.NewNumericDate(now.Add(time.Minute)); return c }()), TokenUseAccess, TokenErrorNotYetValid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := cfg.parseToken(tt.token, tt.tokenUse)
+			got := ""
+			if err != nil {
+				got = tokenErrorCode(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q (%v), want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTokenRejectsOtherAlgorithm(t *testing.T) {
+	cfg := newTokenTestConfig(t)
+	rsaRing, err := NewKeyRing(t.TempDir(), AlgorithmRS256, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a correctly signed RS256 token from another ring must not pass a ring that only holds EdDSA keys
+	token, err := rsaRing.Sign(testClaims(time.Now().UTC()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.parseToken(token, TokenUseAccess)
+	if got := tokenErrorCode(err); err == nil || got != TokenErrorBadSignature {
+		t.Errorf("got %q (%v), want %q", got, err, TokenErrorBadSignature)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 secret of the RFC 6238 test vectors, "12345678901234567890" in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// the RFC lists 8-digit codes, a 6-digit code is their last six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(rfc6238Secret, totpStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+		// secrets are accepted in either case, some apps show them lower-cased
+		lower, err := totpCode(strings.ToLower(rfc6238Secret), totpStep(time.Unix(tt.unix, 0)))
+		if err != nil || lower != tt.want {
+			t.Errorf("lower-cased secret at %d = %s (%v), want %s", tt.unix, lower, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTPSkew(t *testing.T) {
+	// 1111111111 is the step the RFC's code 050471 belongs to
+	codeTime := time.Unix(1111111111, 0)
+	tests := []struct {
+		name string
+		now time.Time
+		code string
+		ok bool
+	}{
+		{"same step", codeTime, "050471", true},
+		{"one step later", codeTime.Add(totpPeriod), "050471", true},
+		{"one step earlier", codeTime.Add(-totpPeriod), "050471", true},
+		{"two steps later", codeTime.Add(2 * totpPeriod), "050471", false},
+		{"two steps earlier", codeTime.Add(-2 * totpPeriod), "050471", false},
+		{"wrong code", codeTime, "050472", false},
+		{"8 digits", codeTime, "14050471", false},
+		{"empty", codeTime, "", false},
+	}
+	for _, tt := range tests {
+		step, ok := verifyTOTP(rfc6238Secret, tt.code, tt.now)
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v, want %v", tt.name, ok, tt.ok)
+		}
+		// the step reported is the code's own, not the current one, so replay checks compare like with like
+		if ok && step != totpStep(codeTime) {
+			t.Errorf("%s: matched step %d, want %d", tt.name, step, totpStep(codeTime))
+		}
+	}
+
+	_, ok := verifyTOTP("not base32!", "050471", codeTime)
+	if ok {
+		t.Error("a code was accepted for an invalid secret")
+	}
+}
+
+func TestIsTOTPCode(t *testing.T) {
+	tests := map[string]bool{"123456": true, "000000": true, "12345": false, "1234567": false, "12345a": false, "abcd-efgh": false, "": false}
+	for code, want := range tests {
+		if got := isTOTPCode(code); got != want {
+			t.Errorf("isTOTPCode(%q) = %v, want %v", code, got, want)
+		}
+	}
+}
+
+func TestConsumeTwoFactorStepReplay(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		user, err := db.CreateUsers("alice@example.com", "", []byte("hash"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		steps := []struct {
+			step int64
+			want error
+		}{
+			{100, nil},
+			{100, ErrTwoFactorCodeUsed},
+			// an older code still inside the skew window must not work once a newer one was used
+			{99, ErrTwoFactorCodeUsed},
+			{101, nil},
+			{103, nil},
+			{102, ErrTwoFactorCodeUsed},
+		}
+		for _, tt := range steps {
+			err := db.ConsumeTwoFactorStep(user.ID, tt.step)
+			if err != tt.want {
+				t.Errorf("step %d: got %v, want %v", tt.step, err, tt.want)
+			}
+		}
+
+		err = db.ConsumeTwoFactorStep(99, 1)
+		if err != ErrUserNotExist {
+			t.Errorf("missing user: got %v, want %v", err, ErrUserNotExist)
+		}
+	})
+}
+
+func TestConsumeRecoveryCode(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		user, err := db.CreateUsers("alice@example.com", "", []byte("hash"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+			t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), recoveryCodeCount)
+		}
+		_, err = db.UpdateUserTwoFactor(user.ID, TwoFactor{Secret: rfc6238Secret, Enabled: true, RecoveryCodeHashes: hashes})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// typed back upper-cased and without the dash it is still the same code
+		typed := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+		left, err := db.ConsumeRecoveryCode(user.ID, hashRecoveryCode(typed))
+		if err != nil || left != recoveryCodeCount-1 {
+			t.Errorf("first use: got %d left (%v), want %d", left, err, recoveryCodeCount-1)
+		}
+		_, err = db.ConsumeRecoveryCode(user.ID, hashRecoveryCode(codes[0]))
+		if err != ErrRecoveryCodeNotExist {
+			t.Errorf("second use: got %v, want %v", err, ErrRecoveryCodeNotExist)
+		}
+		left, err = db.ConsumeRecoveryCode(user.ID, hashRecoveryCode(codes[1]))
+		if err != nil || left != recoveryCodeCount-2 {
+			t.Errorf("another code: got %d left (%v), want %d", left, err, recoveryCodeCount-2)
+		}
+	})
+}
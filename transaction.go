@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+)
+
+var errTxReadOnly = errors.New("cannot write inside a read-only transaction")
+
+// Update runs fn inside a read-write transaction. Writers are serialized, changes are applied to
+// the in-memory state as fn makes them and appended to the write-ahead log once fn returns nil;
+// any error undoes them so the whole transaction rolls back.
+func (db *DB) Update(fn func(tx *Tx) error) error{
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	tx := &Tx{data: &db.data, writable: true}
+	err := fn(tx)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	err = db.appendWAL(tx.ops)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+
+	// the transaction is durable in the log already, so a failed compaction must not fail it or the
+	// caller would retry a write that happened. The log keeps growing and the next write tries again.
+	if db.walRecords >= walCompactEvery {
+		err = db.compact()
+		if err != nil {
+			log.Printf("WARNING: compacting %s failed, will retry on the next write: %v", db.walPath(), err)
+		}
+	}
+	return nil
+}
+
+// View runs fn inside a read-only transaction that sees a consistent snapshot of the database
+func (db *DB) View(fn func(tx *Tx) error) error{
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	return fn(&Tx{data: &db.data})
+}
+
+// rollback reverts every change made through tx, newest first
+func (tx *Tx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.undo = nil
+	tx.ops = nil
+}
+
+// nextID reserves the next ID in the named sequence
+func (tx *Tx) nextID(sequence string) (int, error){
+	id := tx.data.Sequences[sequence] + 1
+	err := txPut(tx, "sequences", tx.data.Sequences, sequence, id)
+	return id, err
+}
+
+// putChirp inserts or replaces a chirp and keeps the per-author index in step
+func (tx *Tx) putChirp(chirp Chirp) error{
+	_, existed := tx.data.Chirps[chirp.ID]
+	err := txPut(tx, "chirps", tx.data.Chirps, chirp.ID, chirp)
+	if err != nil || existed {
+		return err
+	}
+	tx.data.indexChirp(chirp)
+	tx.undo = append(tx.undo, func() { tx.data.unindexChirp(chirp) })
+	return nil
+}
+
+// deleteChirp removes a chirp and its entry in the per-author index
+func (tx *Tx) deleteChirp(chirpID int) error{
+	chirp, existed := tx.data.Chirps[chirpID]
+	err := txDelete(tx, "chirps", tx.data.Chirps, chirpID)
+	if err != nil || !existed {
+		return err
+	}
+	tx.data.unindexChirp(chirp)
+	tx.undo = append(tx.undo, func() { tx.data.indexChirp(chirp) })
+	return nil
+}
+
+// putChirpRevisions replaces the revision list of a chirp
+func (tx *Tx) putChirpRevisions(chirpID int, revisions []ChirpRevision) error{
+	return txPut(tx, "chirp_revisions", tx.data.ChirpRevisions, chirpID, revisions)
+}
+
+// deleteChirpRevisions removes every revision of a chirp
+func (tx *Tx) deleteChirpRevisions(chirpID int) error{
+	return txDelete(tx, "chirp_revisions", tx.data.ChirpRevisions, chirpID)
+}
+
+// putUser inserts or replaces a user
+func (tx *Tx) putUser(user User) error{
+	return txPut(tx, "users", tx.data.Users, user.ID, user)
+}
+
+// putFollow inserts a follow and records it in the follow graph
+func (tx *Tx) putFollow(follow Follow) error{
+	err := txPut(tx, "follows", tx.data.Follows, followKey(follow.FollowerID, follow.FolloweeID), follow)
+	if err != nil {
+		return err
+	}
+	tx.data.indexFollow(follow)
+	tx.undo = append(tx.undo, func() { tx.data.unindexFollow(follow) })
+	return nil
+}
+
+// deleteFollow removes a follow from the table and the follow graph
+func (tx *Tx) deleteFollow(follow Follow) error{
+	err := txDelete(tx, "follows", tx.data.Follows, followKey(follow.FollowerID, follow.FolloweeID))
+	if err != nil {
+		return err
+	}
+	tx.data.unindexFollow(follow)
+	tx.undo = append(tx.undo, func() { tx.data.indexFollow(follow) })
+	return nil
+}
+
+// putEngagement inserts a like or rechirp, table is "likes" or "rechirps"
+func (tx *Tx) putEngagement(table string, engagement Engagement) error{
+	err := txPut(tx, table, tx.data.engagements(table), engagementKey(engagement.ChirpID, engagement.UserID), engagement)
+	if err != nil {
+		return err
+	}
+	tx.data.indexEngagement(table, engagement)
+	tx.undo = append(tx.undo, func() { tx.data.unindexEngagement(table, engagement) })
+	return nil
+}
+
+// deleteEngagement removes a like or rechirp, table is "likes" or "rechirps"
+func (tx *Tx) deleteEngagement(table string, engagement Engagement) error{
+	err := txDelete(tx, table, tx.data.engagements(table), engagementKey(engagement.ChirpID, engagement.UserID))
+	if err != nil {
+		return err
+	}
+	tx.data.unindexEngagement(table, engagement)
+	tx.undo = append(tx.undo, func() { tx.data.indexEngagement(table, engagement) })
+	return nil
+}
+
+// deleteChirpEngagements removes every like and rechirp of a chirp
+func (tx *Tx) deleteChirpEngagements(chirpID int) error{
+	for _, table := range []string{"likes", "rechirps"} {
+		for userID := range tx.data.engagedBy(table)[chirpID] {
+			err := tx.deleteEngagement(table, tx.data.engagements(table)[engagementKey(chirpID, userID)])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// putRefreshToken inserts or replaces a refresh token
+func (tx *Tx) putRefreshToken(refreshToken RefreshToken) error{
+	return txPut(tx, "refresh_tokens", tx.data.RefreshTokens, refreshToken.TokenHash, refreshToken)
+}
+
+// deleteRefreshToken removes a refresh token
+func (tx *Tx) deleteRefreshToken(refreshTokenHash string) error{
+	return txDelete(tx, "refresh_tokens", tx.data.RefreshTokens, refreshTokenHash)
+}
+
+// putSession inserts or replaces a session
+func (tx *Tx) putSession(session Session) error{
+	return txPut(tx, "sessions", tx.data.Sessions, session.ID, session)
+}
+
+// deleteSession removes a session and every refresh token issued to it
+func (tx *Tx) deleteSession(sessionID int) error{
+	for tokenHash, refreshToken := range tx.data.RefreshTokens {
+		if refreshToken.SessionID != sessionID {
+			continue
+		}
+		err := tx.deleteRefreshToken(tokenHash)
+		if err != nil {
+			return err
+		}
+	}
+	return txDelete(tx, "sessions", tx.data.Sessions, sessionID)
+}
+
+// txPut stores value under key in table, recording the log entry and how to undo it
+func txPut[K comparable, V any](tx *Tx, table string, m map[K]V, key K, value V) error{
+	if !tx.writable {
+		return errTxReadOnly
+	}
+
+	keyJSON, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	old, existed := m[key]
+	tx.undo = append(tx.undo, func() {
+		if existed {
+			m[key] = old
+		} else {
+			delete(m, key)
+		}
+	})
+	m[key] = value
+	tx.ops = append(tx.ops, walOp{Table: table, Key: keyJSON, Value: valueJSON})
+	return nil
+}
+
+// txDelete removes key from table, recording the log entry and how to undo it
+func txDelete[K comparable, V any](tx *Tx, table string, m map[K]V, key K) error{
+	if !tx.writable {
+		return errTxReadOnly
+	}
+
+	old, existed := m[key]
+	if !existed {
+		return nil
+	}
+
+	keyJSON, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	tx.undo = append(tx.undo, func() { m[key] = old })
+	delete(m, key)
+	tx.ops = append(tx.ops, walOp{Table: table, Key: keyJSON, Delete: true})
+	return nil
+}
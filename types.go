@@ -1,47 +1,337 @@
 package main
 
 import (
+	"encoding/json"
+	"os"
 	"sync"
 	"time"
+
+	"github.com/golang-jwt/jwt/v5"
 )
 
 type RespBody struct {
 	ID int `json:"id"`
 	AuthorID int `json:"author_id"`
 	Error string `json:"error"`
+	ErrorCode string `json:"error_code,omitempty"`
 	Body string `json:"body"`
 	Email string `json:"email"`
 	Token string `json:"token"`
 	RefreshToken string `json:"refresh_token"`
+	ChallengeToken string `json:"challenge_token,omitempty"`
 	IsChirpyRed bool `json:"is_chirpy_red"`
+	EmailVerified bool `json:"email_verified"`
+	Username string `json:"username,omitempty"`
+	Role string `json:"role,omitempty"`
+	Status string `json:"status,omitempty"`
+	Reasons []string `json:"reasons,omitempty"`
+	InReplyTo int `json:"in_reply_to,omitempty"`
+	Entities *ChirpEntities `json:"entities,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
 }
 
 type Chirp struct {
 	ID int `json:"id"`
 	AuthorID int `json:"author_id"`
 	Body string `json:"body"`
+	InReplyTo int `json:"in_reply_to,omitempty"`
+	ReplyCount int `json:"reply_count"`
+	LikeCount int `json:"like_count"`
+	RechirpCount int `json:"rechirp_count"`
+	LikedByMe bool `json:"liked_by_me"`
+	RechirpedByMe bool `json:"rechirped_by_me"`
+	Entities ChirpEntities `json:"entities"`
+	Deleted bool `json:"deleted,omitempty"`
+	// Hidden chirps were taken down by a moderator, they read as if they did not exist
+	Hidden bool `json:"hidden,omitempty"`
+	// AuthorSuspended mirrors the suspension of the author, their chirps read as if they did not exist until it is lifted
+	AuthorSuspended bool `json:"author_suspended,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// RechirpedBy and RechirpedAt are only set on timeline entries that are rechirps
+	RechirpedBy int `json:"rechirped_by,omitempty"`
+	RechirpedAt *time.Time `json:"rechirped_at,omitempty"`
+}
+
+// ChirpEntities are the hashtags and mentions found in a chirp body
+type ChirpEntities struct {
+	Hashtags []Hashtag `json:"hashtags"`
+	Mentions []Mention `json:"mentions"`
+}
+
+// Hashtag is a #tag in a chirp body, Tag is lower-cased without the #, Start and End are character offsets
+type Hashtag struct {
+	Tag string `json:"tag"`
+	Start int `json:"start"`
+	End int `json:"end"`
+}
+
+// Mention is an @handle in a chirp body that resolved to UserID, Start and End are character offsets
+type Mention struct {
+	UserID int `json:"user_id"`
+	Handle string `json:"handle"`
+	Start int `json:"start"`
+	End int `json:"end"`
+}
+
+// ChirpThreadNode is a chirp in a thread together with the replies loaded beneath it
+type ChirpThreadNode struct {
+	Chirp
+	Replies []ChirpThreadNode `json:"replies,omitempty"`
+	MoreReplies bool `json:"more_replies,omitempty"`
+}
+
+// ChirpThread is the conversation around a chirp: its ancestors root first, and a page of its replies
+type ChirpThread struct {
+	Ancestors []Chirp `json:"ancestors"`
+	Chirp Chirp `json:"chirp"`
+	Replies []ChirpThreadNode `json:"replies"`
+}
+
+// HeldChirp is a chirp that moderation held back until an admin approves or discards it
+type HeldChirp struct {
+	ID int `json:"id"`
+	AuthorID int `json:"author_id"`
+	Body string `json:"body"`
+	InReplyTo int `json:"in_reply_to,omitempty"`
+	Reasons []string `json:"reasons"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ChirpRevision is a previous body of an edited chirp
+type ChirpRevision struct {
+	Revision int `json:"revision"`
+	ChirpID int `json:"chirp_id"`
+	Body string `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// ChirpQuery selects a page of chirps, zero values leave a filter unset
+type ChirpQuery struct {
+	AuthorID int
+	InReplyTo int
+	// IncludeDeleted also returns deleted and hidden chirps, blanked as tombstones
+	IncludeDeleted bool
+	CreatedFrom time.Time
+	CreatedTo time.Time
+	Contains string
+	SinceID int
+	MaxID int
+	Hashtag string
+	MentionedUserID int
+	SortBy string
+	Desc bool
+	Cursor *Cursor
+	Limit int
+}
+
+// Cursor marks a position in a sorted listing, At or Score holds the sort key when it is a timestamp
+// or a search relevance, and ID breaks ties
+type Cursor struct {
+	ID int
+	At time.Time
+	Score float64
+	Before bool
+}
+
+// ChirpPage is one page of chirps and whether more exist on either side of it
+type ChirpPage struct {
+	Chirps []Chirp
+	HasNext bool
+	HasPrev bool
+}
+
+// Follow records that FollowerID follows FolloweeID
+type Follow struct {
+	FollowerID int `json:"follower_id"`
+	FolloweeID int `json:"followee_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Engagement is a like or a rechirp of a chirp by a user
+type Engagement struct {
+	UserID int `json:"user_id"`
+	ChirpID int `json:"chirp_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// EngagementPage is one page of the likes or rechirps of a chirp, newest first
+type EngagementPage struct {
+	Engagements []Engagement
+	HasNext bool
+}
+
+// Report is a user flagging a chirp for moderators, Resolution records what was done about it
+type Report struct {
+	ID int `json:"id"`
+	ChirpID int `json:"chirp_id"`
+	ReporterID int `json:"reporter_id"`
+	Reason string `json:"reason"`
+	Details string `json:"details,omitempty"`
+	Status string `json:"status"`
+	Resolution string `json:"resolution,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// ReportPage is one page of the report queue, oldest first
+type ReportPage struct {
+	Reports []Report
+	HasNext bool
+}
+
+// FollowPage is one page of a follower or following list, newest first
+type FollowPage struct {
+	Follows []Follow
+	HasNext bool
 }
 
 type User struct {
 	ID int `json:"id"`
 	Email string `json:"email"`
+	EmailVerified bool `json:"email_verified"`
+	Username string `json:"username,omitempty"`
 	HashedPassword []byte `json:"hashed_password"`
 	IsChirpyRed bool `json:"is_chirpy_red"`
+	Suspended bool `json:"suspended"`
+	Role string `json:"role"`
+	TwoFactor TwoFactor `json:"two_factor"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TwoFactor is the TOTP state of a user. Secret is set once enrollment starts but only counts once Enabled,
+// LastStep is the newest time step a code was accepted for so that a code cannot be replayed.
+type TwoFactor struct {
+	Secret string `json:"secret,omitempty"`
+	Enabled bool `json:"enabled"`
+	RecoveryCodeHashes []string `json:"recovery_code_hashes,omitempty"`
+	LastStep int64 `json:"last_step,omitempty"`
+}
+
+// UserProfile is the public view of a user, as returned by user search. Email and Role are only filled in for admins.
+type UserProfile struct {
+	ID int `json:"id"`
+	Email string `json:"email,omitempty"`
+	Username string `json:"username,omitempty"`
+	Role string `json:"role,omitempty"`
+}
+
+// UserAccount is the full view of an account, only ever returned to its own user
+type UserAccount struct {
+	ID int `json:"id"`
+	Email string `json:"email"`
+	EmailVerified bool `json:"email_verified"`
+	Username string `json:"username,omitempty"`
+	IsChirpyRed bool `json:"is_chirpy_red"`
+	Role string `json:"role"`
+	TwoFactorEnabled bool `json:"two_factor_enabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// chirpyClaims are the claims of the tokens chirpy signs, Role tells clients what the user may do while
+// authorization itself checks the stored role so that a demotion applies at once
+type chirpyClaims struct {
+	// TokenUse tells the kinds of token apart, only TokenUseAccess tokens authenticate requests
+	TokenUse string `json:"token_use"`
+	// SessionID is the session the token was minted for
+	SessionID int `json:"sid,omitempty"`
+	Role string `json:"role,omitempty"`
+	// Email is the address an email verification token proves ownership of
+	Email string `json:"email,omitempty"`
+	// PasswordFingerprint ties a password reset token to the password it replaces, see passwordFingerprint
+	PasswordFingerprint string `json:"pwd,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Principal is the signed-in user a request acts for, put in the request context by middlewareAuthRequired
+// and middlewareAuthOptional
+type Principal struct {
+	User User
+	Claims chirpyClaims
 }
 
 type DB struct {
 	path string
 	mux  *sync.RWMutex
+	data DBStructure
+	wal *os.File
+	walRecords int
+}
+
+// Tx is a transaction on DB, obtained through DB.Update or DB.View
+type Tx struct {
+	data *DBStructure
+	writable bool
+	ops []walOp
+	undo []func()
 }
 
 type DBStructure struct {
+	Version int `json:"version"`
 	Chirps map[int]Chirp `json:"chirps"`
 	Users map[int]User `json:"users"`
 	RefreshTokens map[string]RefreshToken
+	Sessions map[int]Session `json:"sessions"`
+	ChirpRevisions map[int][]ChirpRevision `json:"chirp_revisions"`
+	Follows map[string]Follow `json:"follows"`
+	Likes map[string]Engagement `json:"likes"`
+	Rechirps map[string]Engagement `json:"rechirps"`
+	HeldChirps map[int]HeldChirp `json:"held_chirps"`
+	Reports map[int]Report `json:"reports"`
+	Sequences map[string]int `json:"sequences"`
+
+	indexes dbIndexes
 }
 
+// dbIndexes are lookups derived from DBStructure, rebuilt on load and kept current by Tx
+type dbIndexes struct {
+	chirpsByAuthor map[int][]int
+	// repliesByParent holds the sorted IDs of the direct replies to a chirp
+	repliesByParent map[int][]int
+	following map[int]map[int]bool
+	followers map[int]map[int]bool
+	likers map[int]map[int]bool
+	rechirpers map[int]map[int]bool
+	// rechirpsByUser is kept sorted by CreatedAt then ChirpID
+	rechirpsByUser map[int][]Engagement
+}
+
+// walOp is a single put or delete of one record, the unit stored in the write-ahead log
+type walOp struct {
+	Table string `json:"table"`
+	Key json.RawMessage `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Delete bool `json:"delete,omitempty"`
+}
+
+// RefreshToken is a single-use refresh token, stored by the SHA-256 hash of the token and never the token
+// itself. Every refresh rotates it into a new token of the same session, the rotated one is kept until it
+// expires so that presenting it again can be detected.
 type RefreshToken struct {
 	UserID int
-	RefreshToken string
+	TokenHash string
+	SessionID int
 	ExpiresAt time.Time
+	RotatedAt *time.Time `json:",omitempty"`
+	// FamilyID is only read by JSON migrations 6 and 8, sessions replaced token families
+	FamilyID string `json:",omitempty"`
+}
+
+// Session is a signed-in device, it lasts from login until its refresh tokens are revoked
+type Session struct {
+	ID int `json:"id"`
+	UserID int `json:"user_id"`
+	DeviceName string `json:"device_name"`
+	UserAgent string `json:"user_agent"`
+	IP string `json:"ip"`
+	// Audience is the client the session's access tokens are minted for
+	Audience string `json:"audience"`
+	// Current marks the session the request was made from, it is not stored
+	Current bool `json:"current"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
 }
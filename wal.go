@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// walCompactEvery is how many committed transactions the log holds before it is folded into the snapshot
+const walCompactEvery = 1000
+
+// walRecord is one committed transaction, written to the log as a single line
+type walRecord struct {
+	Ops []walOp `json:"ops"`
+}
+
+// walPath returns the path of the write-ahead log that belongs to the snapshot file
+func (db *DB) walPath() string {
+	return db.path + ".wal"
+}
+
+// appendWAL durably appends one committed transaction to the log
+func (db *DB) appendWAL(ops []walOp) error {
+	dat, err := json.Marshal(walRecord{Ops: ops})
+	if err != nil {
+		return err
+	}
+	dat = append(dat, '\n')
+
+	_, err = db.wal.Write(dat)
+	if err != nil {
+		return err
+	}
+	err = db.wal.Sync()
+	if err != nil {
+		return err
+	}
+
+	db.walRecords++
+	return nil
+}
+
+// replayWAL applies every complete transaction in the log to db.data. A torn last line left by
+// a crash mid-append is cut off and reported, since that transaction was never acknowledged.
+func (db *DB) replayWAL() error {
+	f, err := os.OpenFile(db.walPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(f)
+	var goodOffset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("WARNING: dropped %d bytes of an incomplete transaction at the end of %s", len(line), db.walPath())
+			}
+			break
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		record := walRecord{}
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			rest, _ := io.ReadAll(reader)
+			log.Printf("WARNING: dropped %d bytes of unreadable transactions at the end of %s: %v", len(line)+len(rest), db.walPath(), err)
+			break
+		}
+		for _, op := range record.Ops {
+			err = db.data.apply(op)
+			if err != nil {
+				f.Close()
+				return err
+			}
+		}
+
+		goodOffset += int64(len(line))
+		db.walRecords++
+	}
+
+	err = f.Truncate(goodOffset)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	_, err = f.Seek(goodOffset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	db.wal = f
+	return nil
+}
+
+// compact writes the in-memory state as a new snapshot and empties the log.
+// The caller must hold the write lock.
+func (db *DB) compact() error {
+	err := db.writeDB(db.data)
+	if err != nil {
+		return err
+	}
+
+	err = db.wal.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = db.wal.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	err = db.wal.Sync()
+	if err != nil {
+		return err
+	}
+
+	db.walRecords = 0
+	return nil
+}
+
+// apply replays one logged operation onto the structure
+func (dbStructure *DBStructure) apply(op walOp) error {
+	switch op.Table {
+	case "chirps":
+		return applyOp(dbStructure.Chirps, op)
+	case "chirp_revisions":
+		return applyOp(dbStructure.ChirpRevisions, op)
+	case "users":
+		return applyOp(dbStructure.Users, op)
+	case "refresh_tokens":
+		return applyOp(dbStructure.RefreshTokens, op)
+	case "sessions":
+		return applyOp(dbStructure.Sessions, op)
+	case "follows":
+		return applyOp(dbStructure.Follows, op)
+	case "likes":
+		return applyOp(dbStructure.Likes, op)
+	case "rechirps":
+		return applyOp(dbStructure.Rechirps, op)
+	case "held_chirps":
+		return applyOp(dbStructure.HeldChirps, op)
+	case "reports":
+		return applyOp(dbStructure.Reports, op)
+	case "sequences":
+		return applyOp(dbStructure.Sequences, op)
+	}
+	return fmt.Errorf("unknown table %q in write-ahead log", op.Table)
+}
+
+// applyOp replays a put or delete onto one table
+func applyOp[K comparable, V any](table map[K]V, op walOp) error {
+	var key K
+	err := json.Unmarshal(op.Key, &key)
+	if err != nil {
+		return err
+	}
+
+	if op.Delete {
+		delete(table, key)
+		return nil
+	}
+
+	var value V
+	err = json.Unmarshal(op.Value, &value)
+	if err != nil {
+		return err
+	}
+	table[key] = value
+	return nil
+}